@@ -0,0 +1,174 @@
+// 直接以 TCP 與 adb server（預設 127.0.0.1:5037）溝通，避免每次都啟動 adb 行程
+package adb
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ServerAddr 為 adb server 的預設位址
+const ServerAddr = "127.0.0.1:5037"
+
+const serverDialTimeout = 2 * time.Second
+
+// ADBDevice 為 `adb devices -l` 列出的一台裝置
+type ADBDevice struct {
+	Serial      string `json:"serial"`
+	State       string `json:"state"` // device | offline | unauthorized | ...
+	Product     string `json:"product,omitempty"`
+	Model       string `json:"model,omitempty"`
+	Device      string `json:"device,omitempty"`
+	TransportID string `json:"transportId,omitempty"`
+}
+
+// ListDevices 列出 adb 看得到的裝置：優先直接走 adb server 協定，失敗時退回執行 `adb devices -l`
+func ListDevices() ([]ADBDevice, error) {
+	devs, err := listDevicesDirect(ServerAddr)
+	if err == nil {
+		return devs, nil
+	}
+	return listDevicesExec()
+}
+
+// listDevicesDirect 送出 host:devices-l 請求並解析回應
+func listDevicesDirect(addr string) ([]ADBDevice, error) {
+	conn, err := net.DialTimeout("tcp", addr, serverDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("dial adb server: %w", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(serverDialTimeout))
+
+	payload, err := hostRequest(conn, "host:devices-l")
+	if err != nil {
+		return nil, err
+	}
+	return parseDevicesOutput(string(payload)), nil
+}
+
+// hostRequest 以 adb 線路格式送出請求：[4 位十六進位長度][請求字串]，
+// 回應為 OKAY/FAIL 後接 [4 位十六進位長度][內容]
+func hostRequest(rw io.ReadWriter, req string) ([]byte, error) {
+	if _, err := fmt.Fprintf(rw, "%04x%s", len(req), req); err != nil {
+		return nil, fmt.Errorf("write request: %w", err)
+	}
+	var status [4]byte
+	if _, err := io.ReadFull(rw, status[:]); err != nil {
+		return nil, fmt.Errorf("read status: %w", err)
+	}
+	body, err := readHexLengthPrefixed(rw)
+	if err != nil {
+		return nil, err
+	}
+	switch string(status[:]) {
+	case "OKAY":
+		return body, nil
+	case "FAIL":
+		return nil, fmt.Errorf("adb server: %s", string(body))
+	default:
+		return nil, fmt.Errorf("adb server: unexpected status %q", string(status[:]))
+	}
+}
+
+func readHexLengthPrefixed(r io.Reader) ([]byte, error) {
+	var hexLen [4]byte
+	if _, err := io.ReadFull(r, hexLen[:]); err != nil {
+		return nil, fmt.Errorf("read length: %w", err)
+	}
+	n, err := strconv.ParseUint(string(hexLen[:]), 16, 32)
+	if err != nil {
+		return nil, fmt.Errorf("parse length %q: %w", string(hexLen[:]), err)
+	}
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, fmt.Errorf("read body: %w", err)
+	}
+	return body, nil
+}
+
+// KillServer 執行 `adb kill-server`；所有 reverse/forward 通道與經由 adb 的連線都會中斷
+func KillServer() error {
+	_, err := runADB("adb kill-server", "kill-server")
+	return err
+}
+
+// RestartServer 先 kill 再 start adb server，用於 adb 狀態異常（例如 server version mismatch）時復原
+func RestartServer() error {
+	if err := KillServer(); err != nil {
+		return err
+	}
+	_, err := runADB("adb start-server", "start-server")
+	return err
+}
+
+// listDevicesExec 為後備路徑：執行 adb 指令並解析文字輸出
+func listDevicesExec() ([]ADBDevice, error) {
+	out, err := runADB("adb devices", "devices", "-l")
+	if err != nil {
+		return nil, err
+	}
+	return parseDevicesOutput(string(out)), nil
+}
+
+// deviceStates 為 adb devices 會回報的裝置狀態（system/core/adb 的 connection_state_name）
+var deviceStates = map[string]bool{
+	"device": true, "offline": true, "unauthorized": true, "authorizing": true, "connecting": true,
+	"bootloader": true, "recovery": true, "rescue": true, "sideload": true, "host": true, "detached": true,
+}
+
+// parseDevicesOutput 解析 `serial state key:value ...` 格式。
+// 略過標題列、adb 啟動 server 時的 "* daemon ..." 與 "adb server ..." 提示，以及狀態不是已知值的行；
+// Windows 版 adb 的 \r\n 行尾由 Scanner 與 Fields 去除
+func parseDevicesOutput(out string) []ADBDevice {
+	var devs []ADBDevice
+	sc := bufio.NewScanner(bytes.NewReader([]byte(out)))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "*") || strings.HasPrefix(line, "List of devices") ||
+			strings.HasPrefix(line, "adb server") || strings.HasPrefix(line, "adb: ") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 {
+			continue
+		}
+		state, rest := fields[1], fields[2:]
+		if state == "no" && len(rest) > 0 && rest[0] == "permissions" {
+			// "no permissions (user in plugdev group; ...)"：略過括號內的說明
+			state, rest = "no permissions", rest[1:]
+			for i, f := range rest {
+				if strings.HasSuffix(f, ")") {
+					rest = rest[i+1:]
+					break
+				}
+			}
+		} else if !deviceStates[state] {
+			continue
+		}
+		d := ADBDevice{Serial: fields[0], State: state}
+		for _, kv := range rest {
+			k, v, ok := strings.Cut(kv, ":")
+			if !ok {
+				continue
+			}
+			switch k {
+			case "product":
+				d.Product = v
+			case "model":
+				d.Model = v
+			case "device":
+				d.Device = v
+			case "transport_id":
+				d.TransportID = v
+			}
+		}
+		devs = append(devs, d)
+	}
+	return devs
+}
@@ -0,0 +1,65 @@
+package adb
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseDevicesOutput(t *testing.T) {
+	pixel := ADBDevice{Serial: "R58M12345", State: "device", Product: "panther", Model: "Pixel_7", Device: "panther", TransportID: "3"}
+	wifi := ADBDevice{Serial: "192.168.1.20:5555", State: "offline", TransportID: "5"}
+	tests := []struct {
+		name string
+		out  string
+		want []ADBDevice
+	}{
+		{
+			"LF",
+			"List of devices attached\n" +
+				"R58M12345              device usb:1-1 product:panther model:Pixel_7 device:panther transport_id:3\n" +
+				"192.168.1.20:5555      offline transport_id:5\n\n",
+			[]ADBDevice{pixel, wifi},
+		},
+		{
+			"CRLF from Windows adb",
+			"List of devices attached\r\n" +
+				"R58M12345              device usb:1-1 product:panther model:Pixel_7 device:panther transport_id:3\r\n" +
+				"192.168.1.20:5555      offline transport_id:5\r\n\r\n",
+			[]ADBDevice{pixel, wifi},
+		},
+		{
+			"daemon banner when adb starts the server",
+			"* daemon not running; starting now at tcp:5037\n" +
+				"* daemon started successfully\n" +
+				"List of devices attached\n" +
+				"R58M12345              device usb:1-1 product:panther model:Pixel_7 device:panther transport_id:3\n",
+			[]ADBDevice{pixel},
+		},
+		{
+			"daemon banner with CRLF",
+			"* daemon not running; starting now at tcp:5037\r\n* daemon started successfully\r\nList of devices attached\r\n\r\n",
+			nil,
+		},
+		{
+			"server version mismatch notice",
+			"adb server version (40) doesn't match this client (41); killing...\n" +
+				"* daemon started successfully\n" +
+				"List of devices attached\n" +
+				"emulator-5554          unauthorized transport_id:1\n",
+			[]ADBDevice{{Serial: "emulator-5554", State: "unauthorized", TransportID: "1"}},
+		},
+		{
+			"no permissions",
+			"List of devices attached\n" +
+				"0123456789ABCDEF       no permissions (user in plugdev group; are your udev rules wrong?); see [http://developer.android.com/tools/device.html] usb:1-2 transport_id:2\n",
+			[]ADBDevice{{Serial: "0123456789ABCDEF", State: "no permissions", TransportID: "2"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseDevicesOutput(tt.out); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseDevicesOutput:\n got %+v\nwant %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,22 +2,132 @@
 package adb
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"os"
 	"os/exec"
+	"strconv"
+	"strings"
+	"time"
 )
 
-// ScrcpyPort is the TCP port used by scrcpy for both video and control
-// channels. The Android server connects twice to this port: the first
+// ScrcpyPort is the default TCP port used by scrcpy for both video and
+// control channels (see Options.Port). The Android server connects twice to this port: the first
 // connection carries the H.264 stream, the second is the control socket
 // for input events.
 const ScrcpyPort = 27183
 
+// ServerVersion is the version of the bundled scrcpy-server.jar; the server
+// refuses to start when the client passes a different version.
+const ServerVersion = "3.3.2"
+
+// forward 模式下連線重試設定：伺服器啟動需要時間，adb forward 在伺服器
+// listen 前也會接受連線但立即關閉，因此需重試直到收到 dummy byte
+const (
+	forwardConnectAttempts = 100
+	forwardConnectInterval = 100 * time.Millisecond
+)
+
+// ErrServerExited 表示伺服器行程在視訊/控制通道連上前就結束（版本不符、裝置忙碌等）
+var ErrServerExited = errors.New("server exited before connecting")
+
+// Options 控制 scrcpy 伺服器的啟動方式
+type Options struct {
+	// UseForward 改用 adb forward（本機主動連線至裝置），
+	// 供封鎖 adb reverse 的裝置使用
+	UseForward bool
+
+	// DisplayID 指定要鏡像的顯示器（0 為主螢幕）；VideoSource 為 camera 時不使用
+	DisplayID int
+
+	// VideoSource 視訊來源："display"（預設，空字串亦同）或 "camera"（裝置相機，需 Android 12 以上）
+	VideoSource string
+
+	// VideoCodec 視訊編碼："h264"（預設，空字串亦同）或 "h265"
+	VideoCodec string
+
+	// VideoEncoder 指定裝置上的 MediaCodec 編碼器名稱（例如 "OMX.google.h264.encoder"），空字串表示由伺服器挑選；
+	// 可用的名稱可由伺服器的 list_encoders=true 列出
+	VideoEncoder string
+
+	// BitRate 視訊位元率（bps），0 表示使用伺服器預設值
+	BitRate int
+
+	// MaxSize 限制畫面長邊像素，0 表示不限制
+	MaxSize int
+
+	// CaptureOrientation 為 scrcpy 的 capture_orientation 參數（例如 "90"、"@90"、"@"），空字串表示跟隨裝置旋轉。
+	// 前綴 "@" 表示鎖定：裝置旋轉時畫面方向不變
+	CaptureOrientation string
+
+	// NoDelay 視訊 socket 是否啟用 TCP_NODELAY（Go 預設開啟）；關閉可在區網錄影時減少小封包、提高吞吐。
+	// 控制通道一律開啟，避免輸入延遲
+	NoDelay bool
+
+	// ReadBufferSize 視訊 socket 的接收緩衝（SO_RCVBUF，bytes），0 表示使用系統預設
+	ReadBufferSize int
+
+	// Port 本機使用的 TCP 埠（reverse 模式 listen、forward 模式連線），0 表示 ScrcpyPort
+	Port int
+
+	// NoControl 以 control=false 啟動伺服器（僅視訊），不建立控制通道
+	NoControl bool
+
+	// ExtraArgs 原樣附加在伺服器參數最後的 key=value（例如 "power_on=false"），
+	// 需先以 ValidateServerArg 檢查
+	ExtraArgs []string
+
+	// Stderr 接收伺服器行程的 stderr，nil 時輸出到 os.Stderr
+	Stderr io.Writer
+}
+
+// requiredServerArgs 為讀取端依賴的協定參數：只允許設為這裡的值（與伺服器預設相同）
+var requiredServerArgs = map[string]string{
+	"send_device_meta": "true",
+	"send_frame_meta":  "true",
+	"send_dummy_byte":  "true",
+	"send_codec_meta":  "true",
+	"raw_stream":       "false",
+	"video":            "true",
+	"audio":            "false",
+}
+
+// reservedServerArgs 不可由 ExtraArgs 設定：多數由 Options 的其他欄位產生，值為拒絕原因
+var reservedServerArgs = map[string]string{
+	"tunnel_forward":      "set from Options.UseForward",
+	"control":             "set from Options.NoControl",
+	"video_codec":         "set from Options.VideoCodec",
+	"video_source":        "set from Options.VideoSource",
+	"display_id":          "set from Options.DisplayID",
+	"video_encoder":       "set from Options.VideoEncoder",
+	"video_bit_rate":      "set from Options.BitRate",
+	"max_size":            "set from Options.MaxSize",
+	"capture_orientation": "set from Options.CaptureOrientation",
+	"scid":                "would rename the localabstract:scrcpy socket",
+}
+
+// ValidateServerArg 檢查 ExtraArgs 的一個參數：必須是 key=value，且不能改變讀取協定或覆寫 Options 管理的參數
+func ValidateServerArg(arg string) error {
+	key, value, ok := strings.Cut(arg, "=")
+	if !ok || key == "" {
+		return fmt.Errorf("server arg %q: expected key=value", arg)
+	}
+	if want, ok := requiredServerArgs[key]; ok && value != want {
+		return fmt.Errorf("server arg %q: %s must be %s (required by the stream reader)", arg, key, want)
+	}
+	if reason, ok := reservedServerArgs[key]; ok {
+		return fmt.Errorf("server arg %q: %s is reserved (%s)", arg, key, reason)
+	}
+	return nil
+}
+
 // Device 代表一台 Android 裝置
 type Device struct {
 	serial string
+	opts   Options
 }
 
 type cmdReadCloser struct {
@@ -35,66 +145,295 @@ func (c *cmdReadCloser) Close() error {
 }
 
 // NewDevice 連線至 adb，並回傳指定序號的 Device
-func NewDevice(serial string) (*Device, error) {
-	cmd := exec.Command("adb", "start-server")
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return nil, fmt.Errorf("start adb server: %w (%s)", err, string(out))
+func NewDevice(serial string, opts Options) (*Device, error) {
+	if _, err := runADB("start adb server", "start-server"); err != nil {
+		return nil, err
 	}
-	return &Device{serial: serial}, nil
+	return &Device{serial: serial, opts: opts}, nil
+}
+
+// Serial 回傳裝置序號（空字串表示 adb 預設裝置）
+func (d *Device) Serial() string {
+	return d.serial
+}
+
+// Port 回傳本機使用的 TCP 埠（Options.Port，未設定時為 ScrcpyPort）
+func (d *Device) Port() int {
+	if d.opts.Port > 0 {
+		return d.opts.Port
+	}
+	return ScrcpyPort
+}
+
+// Options 回傳建立 Device 時使用的選項
+func (d *Device) Options() Options {
+	return d.opts
 }
 
 // PushServer 將 scrcpy-server.jar 推送到裝置的暫存目錄
 func (d *Device) PushServer(localPath string) error {
-	remotePath := "/data/local/tmp/scrcpy-server.jar"
-	args := []string{}
-	if d.serial != "" {
-		args = append(args, "-s", d.serial)
+	if err := d.Push(localPath, "/data/local/tmp/scrcpy-server.jar"); err != nil {
+		return fmt.Errorf("push server: %w", err)
 	}
-	args = append(args, "push", localPath, remotePath)
-	cmd := exec.Command("adb", args...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("push server: %w (%s)", err, string(out))
+	return nil
+}
+
+// Push 將本機檔案推送到裝置上的 remote 路徑
+func (d *Device) Push(local, remote string) error {
+	_, err := runADB("push "+remote, d.buildADBArgs("push", local, remote)...)
+	return err
+}
+
+// GetSetting 讀取 Android 設定值（adb shell settings get）；namespace 為 system、secure 或 global，
+// 未設定時回傳 "null"
+func (d *Device) GetSetting(namespace, key string) (string, error) {
+	out, err := runADB("settings get "+key, d.buildADBArgs("shell", "settings", "get", namespace, key)...)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// SetSetting 寫入 Android 設定值（adb shell settings put）
+func (d *Device) SetSetting(namespace, key, value string) error {
+	_, err := runADB("settings put "+key, d.buildADBArgs("shell", "settings", "put", namespace, key, value)...)
+	return err
+}
+
+// Shell 執行 adb shell <cmd>，合併的 stdout/stderr 隨產生寫入 out；指令以非 0 結束時回傳 *CommandError
+// （以輸出的最後 shellTailSize bytes 判斷錯誤種類）。ctx 取消時終止 adb。
+// cmd 由裝置上的 sh 解譯，呼叫端需自行過濾 shell 特殊字元
+func (d *Device) Shell(ctx context.Context, cmd string, out io.Writer) error {
+	tail := &tailBuffer{max: shellTailSize}
+	c := exec.CommandContext(ctx, "adb", d.buildADBArgs("shell", cmd)...)
+	c.Stdout = io.MultiWriter(out, tail)
+	c.Stderr = c.Stdout // 同一個 writer：exec 只用一條 pipe，輸出順序與寫入不會交錯
+	if err := c.Run(); err != nil {
+		return newCommandError("shell", tail.b, err)
 	}
 	return nil
 }
 
+const shellTailSize = 512
+
+// tailBuffer 只保留最後 max bytes 的寫入內容
+type tailBuffer struct {
+	b   []byte
+	max int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.b = append(t.b, p...)
+	if over := len(t.b) - t.max; over > 0 {
+		t.b = append(t.b[:0], t.b[over:]...)
+	}
+	return len(p), nil
+}
+
+// Battery 為 dumpsys battery 的電量與充電狀態
+type Battery struct {
+	Level  int    `json:"level"`  // 0-100
+	Status string `json:"status"` // charging | discharging | not_charging | full | unknown
+}
+
+// batteryStatusNames 對應 android.os.BatteryManager.BATTERY_STATUS_*
+var batteryStatusNames = map[string]string{
+	"1": "unknown",
+	"2": "charging",
+	"3": "discharging",
+	"4": "not_charging",
+	"5": "full",
+}
+
+// Battery 執行 adb shell dumpsys battery 取得電量與充電狀態
+func (d *Device) Battery() (Battery, error) {
+	out, err := runADB("dumpsys battery", d.buildADBArgs("shell", "dumpsys", "battery")...)
+	if err != nil {
+		return Battery{}, err
+	}
+	return parseBatteryOutput(string(out))
+}
+
+// BatteryLevel 回傳電量百分比
+func (d *Device) BatteryLevel() (int, error) {
+	b, err := d.Battery()
+	return b.Level, err
+}
+
+// parseBatteryOutput 解析 dumpsys battery 的 "  level: 85"、"  status: 2" 等行
+func parseBatteryOutput(out string) (Battery, error) {
+	b := Battery{Level: -1, Status: "unknown"}
+	for _, line := range strings.Split(out, "\n") {
+		k, v, ok := strings.Cut(strings.TrimSpace(line), ":")
+		if !ok {
+			continue
+		}
+		v = strings.TrimSpace(v)
+		switch k {
+		case "level":
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return Battery{}, fmt.Errorf("dumpsys battery: invalid level %q", v)
+			}
+			b.Level = n
+		case "status":
+			if name, ok := batteryStatusNames[v]; ok {
+				b.Status = name
+			}
+		}
+	}
+	if b.Level < 0 {
+		return Battery{}, fmt.Errorf("dumpsys battery: level not found")
+	}
+	return b, nil
+}
+
+// InstallError 為 adb install 回報的失敗，Reason 為 INSTALL_FAILED_* 等代碼
+type InstallError struct {
+	Reason  string
+	Message string // adb 的完整輸出
+}
+
+func (e *InstallError) Error() string {
+	return fmt.Sprintf("install failed: %s", e.Reason)
+}
+
+// Install 執行 adb install [-r] 安裝 APK；失敗時回傳 *InstallError（若能解析出原因）
+func (d *Device) Install(apkPath string, reinstall bool) error {
+	args := []string{"install"}
+	if reinstall {
+		args = append(args, "-r")
+	}
+	args = append(args, apkPath)
+	out, err := exec.Command("adb", d.buildADBArgs(args...)...).CombinedOutput()
+	return parseInstallOutput(string(out), err)
+}
+
+// parseInstallOutput 解析 adb install 的輸出：成功時含 "Success"，
+// 失敗時為 "Failure [INSTALL_FAILED_XXX: 說明]"（較舊版本無說明）
+func parseInstallOutput(out string, runErr error) error {
+	if i := strings.Index(out, "Failure ["); i >= 0 {
+		reason := out[i+len("Failure ["):]
+		if j := strings.IndexAny(reason, ":]"); j >= 0 {
+			reason = reason[:j]
+		}
+		return &InstallError{Reason: strings.TrimSpace(reason), Message: strings.TrimSpace(out)}
+	}
+	if runErr != nil {
+		return newCommandError("install", []byte(out), runErr)
+	}
+	if !strings.Contains(out, "Success") {
+		return fmt.Errorf("install: unexpected output (%s)", strings.TrimSpace(out))
+	}
+	return nil
+}
+
+// buildADBArgs 在 adb 子指令前加上 -s <serial>（未指定序號時使用 adb 預設裝置）
+func (d *Device) buildADBArgs(args ...string) []string {
+	if d.serial == "" {
+		return args
+	}
+	return append([]string{"-s", d.serial}, args...)
+}
+
 // ServerConn 代表與 scrcpy server 的連線
 type ServerConn struct {
 	VideoStream io.ReadWriteCloser
-	Control     io.ReadWriteCloser
+	Control     io.ReadWriteCloser // Options.NoControl 時為 nil
 }
 
 // StartServer 透過 adb shell 啟動 scrcpy 伺服器並回傳視訊串流和控制通道
+//
+// reverse 模式（預設）：本機先 listen，裝置依序回連兩次，第一條為視訊、第二條為控制。
+// forward 模式（Options.UseForward）：呼叫前需先以 Forward 建立 tcp:<Port()> 轉發，
+// 由本機依序主動連線，同樣第一條為視訊、第二條為控制；伺服器會在視訊連線上
+// 先送出 1 byte dummy，用來確認連線確實抵達伺服器。
+// Options.NoControl 時伺服器只開視訊通道，回傳的 Control 為 nil。
 func (d *Device) StartServer() (*ServerConn, error) {
-	ln, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", ScrcpyPort))
-	if err != nil {
-		return nil, fmt.Errorf("listen: %w", err)
+	var ln net.Listener
+	if !d.opts.UseForward {
+		var err error
+		ln, err = net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", d.Port()))
+		if err != nil {
+			return nil, fmt.Errorf("listen: %w", err)
+		}
+		defer ln.Close()
 	}
-	defer ln.Close()
 
 	args := []string{}
 	if d.serial != "" {
 		args = append(args, "-s", d.serial)
 	}
-	args = append(args, "shell", "CLASSPATH=/data/local/tmp/scrcpy-server.jar", "app_process", "/", "com.genymobile.scrcpy.Server", "3.3.2", "audio=false")
+	args = append(args, "shell", "CLASSPATH=/data/local/tmp/scrcpy-server.jar", "app_process", "/", "com.genymobile.scrcpy.Server", ServerVersion, "audio=false")
+	if d.opts.UseForward {
+		args = append(args, "tunnel_forward=true")
+	}
+	if d.opts.VideoSource == "camera" {
+		args = append(args, "video_source=camera")
+	} else if d.opts.DisplayID != 0 {
+		args = append(args, fmt.Sprintf("display_id=%d", d.opts.DisplayID))
+	}
+	if d.opts.VideoCodec != "" && d.opts.VideoCodec != "h264" {
+		args = append(args, "video_codec="+d.opts.VideoCodec)
+	}
+	if enc := strings.TrimSpace(d.opts.VideoEncoder); enc != "" {
+		args = append(args, "video_encoder="+enc)
+	}
+	if d.opts.BitRate > 0 {
+		args = append(args, fmt.Sprintf("video_bit_rate=%d", d.opts.BitRate))
+	}
+	if d.opts.MaxSize > 0 {
+		args = append(args, fmt.Sprintf("max_size=%d", d.opts.MaxSize))
+	}
+	if d.opts.CaptureOrientation != "" {
+		args = append(args, "capture_orientation="+d.opts.CaptureOrientation)
+	}
+	if d.opts.NoControl {
+		args = append(args, "control=false")
+	}
+	args = append(args, d.opts.ExtraArgs...)
 	cmd := exec.Command("adb", args...)
 	cmd.Stderr = os.Stderr
+	if d.opts.Stderr != nil {
+		cmd.Stderr = d.opts.Stderr
+	}
 	if err := cmd.Start(); err != nil {
-		return nil, fmt.Errorf("start server: %w", err)
+		return nil, newCommandError("start server", nil, err)
+	}
+	// 行程提早結束時關閉 listener，讓 Accept 返回而不是永遠等待
+	exited := make(chan struct{})
+	var waitErr error
+	go func() {
+		waitErr = cmd.Wait()
+		close(exited)
+		if ln != nil {
+			ln.Close()
+		}
+	}()
+
+	if d.opts.UseForward {
+		conn, err := dialServer(d.Port(), !d.opts.NoControl, exited)
+		if err == nil {
+			d.tuneVideoConn(conn.VideoStream)
+		}
+		return conn, err
 	}
-	go cmd.Wait()
 
 	// 等待視訊串流連線
 	videoConn, err := ln.Accept()
 	if err != nil {
-		return nil, fmt.Errorf("accept video stream: %w", err)
+		return nil, acceptError("video stream", err, exited, &waitErr)
+	}
+	d.tuneVideoConn(videoConn)
+	if d.opts.NoControl {
+		return &ServerConn{VideoStream: videoConn}, nil
 	}
 
 	// 等待控制通道連線
 	controlConn, err := ln.Accept()
 	if err != nil {
 		videoConn.Close()
-		return nil, fmt.Errorf("accept control channel: %w", err)
+		return nil, acceptError("control channel", err, exited, &waitErr)
 	}
 
 	return &ServerConn{
@@ -103,30 +442,98 @@ func (d *Device) StartServer() (*ServerConn, error) {
 	}, nil
 }
 
-// Forward 在本地建立與 scrcpy 通道的連線轉發
-func (d *Device) Forward(local string) error {
-	args := []string{}
-	if d.serial != "" {
-		args = append(args, "-s", d.serial)
+// tuneVideoConn 依 Options 設定視訊 socket 的 TCP_NODELAY 與接收緩衝
+func (d *Device) tuneVideoConn(c io.ReadWriteCloser) {
+	tc, ok := c.(*net.TCPConn)
+	if !ok {
+		return
 	}
-	args = append(args, "forward", local, "localabstract:scrcpy")
-	cmd := exec.Command("adb", args...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("forward: %w (%s)", err, string(out))
+	_ = tc.SetNoDelay(d.opts.NoDelay)
+	if d.opts.ReadBufferSize > 0 {
+		_ = tc.SetReadBuffer(d.opts.ReadBufferSize)
 	}
-	return nil
 }
 
-// Reverse 在裝置端建立連線，使其回連至本機指定的埠號
-func (d *Device) Reverse(remote, local string) error {
-	args := []string{}
-	if d.serial != "" {
-		args = append(args, "-s", d.serial)
+// acceptError 在伺服器行程已結束時回傳 ErrServerExited（附上結束狀態），否則回傳原本的 Accept 錯誤
+func acceptError(what string, err error, exited <-chan struct{}, waitErr *error) error {
+	select {
+	case <-exited:
+		return serverExitedError(*waitErr)
+	default:
+		return fmt.Errorf("accept %s: %w", what, err)
 	}
-	args = append(args, "reverse", remote, local)
-	cmd := exec.Command("adb", args...)
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("reverse: %w (%s)", err, string(out))
+}
+
+func serverExitedError(waitErr error) error {
+	if waitErr != nil {
+		return fmt.Errorf("%w: %v", ErrServerExited, waitErr)
 	}
-	return nil
+	return ErrServerExited
+}
+
+// dialServer 於 forward 模式下依序連線 127.0.0.1:port 上的視訊與控制通道（withControl 為 false 時只連視訊）；
+// exited 關閉表示伺服器行程已結束，不再重試
+func dialServer(port int, withControl bool, exited <-chan struct{}) (*ServerConn, error) {
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	var videoConn net.Conn
+	for i := 0; i < forwardConnectAttempts; i++ {
+		select {
+		case <-exited:
+			return nil, ErrServerExited
+		default:
+		}
+		conn, err := net.Dial("tcp", addr)
+		if err == nil {
+			// 伺服器尚未 listen 時，adb 會接受連線後立即關閉，讀不到 dummy byte
+			var dummy [1]byte
+			if _, err = io.ReadFull(conn, dummy[:]); err == nil {
+				videoConn = conn
+				break
+			}
+			conn.Close()
+		}
+		time.Sleep(forwardConnectInterval)
+	}
+	if videoConn == nil {
+		return nil, fmt.Errorf("connect video stream: server not reachable on %s", addr)
+	}
+	if !withControl {
+		return &ServerConn{VideoStream: videoConn}, nil
+	}
+
+	controlConn, err := net.Dial("tcp", addr)
+	if err != nil {
+		videoConn.Close()
+		return nil, fmt.Errorf("connect control channel: %w", err)
+	}
+
+	return &ServerConn{
+		VideoStream: videoConn,
+		Control:     controlConn,
+	}, nil
+}
+
+// Forward 在本地建立與 scrcpy 通道的連線轉發
+func (d *Device) Forward(local string) error {
+	_, err := runADB("forward", d.buildADBArgs("forward", local, "localabstract:scrcpy")...)
+	return err
+}
+
+// Reverse 在裝置端建立連線，使其回連至本機指定的埠號
+func (d *Device) Reverse(remote, local string) error {
+	_, err := runADB("reverse", d.buildADBArgs("reverse", remote, local)...)
+	return err
+}
+
+// RemoveReverse 移除先前建立的 reverse 通道
+func (d *Device) RemoveReverse(remote string) error {
+	_, err := runADB("reverse --remove", d.buildADBArgs("reverse", "--remove", remote)...)
+	return err
+}
+
+// RemoveForward 移除先前建立的 forward 通道
+func (d *Device) RemoveForward(local string) error {
+	_, err := runADB("forward --remove", d.buildADBArgs("forward", "--remove", local)...)
+	return err
 }
@@ -0,0 +1,71 @@
+package adb
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeADB 在 PATH 最前面放一個假的 adb：start-server 成功，其餘指令（啟動 scrcpy server 的 shell）
+// 立即以 exit 1 結束，模擬版本不符、裝置忙碌等啟動失敗
+func fakeADB(t *testing.T) {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake adb is a shell script")
+	}
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = start-server ] && exit 0\necho 'ERROR: server version mismatch' >&2\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "adb"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+}
+
+// freePort 回傳目前沒有人 listen 的本機 TCP 埠
+func freePort(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestStartServerExitedEarly(t *testing.T) {
+	fakeADB(t)
+	for _, forward := range []bool{false, true} {
+		name := "reverse"
+		if forward {
+			name = "forward"
+		}
+		t.Run(name, func(t *testing.T) {
+			d, err := NewDevice("", Options{UseForward: forward, Port: freePort(t), Stderr: io.Discard})
+			if err != nil {
+				t.Fatal(err)
+			}
+			start := time.Now()
+			conn, err := d.StartServer()
+			if conn != nil {
+				t.Fatal("got a connection from a server that exited")
+			}
+			if !errors.Is(err, ErrServerExited) {
+				t.Fatalf("err = %v, want ErrServerExited", err)
+			}
+			// reverse 模式附上行程的結束狀態
+			if !forward && !strings.Contains(err.Error(), "exit status 1") {
+				t.Errorf("err = %q, want the exit status", err)
+			}
+			// 不應等到 forward 模式的重試用盡（100 × 100ms）
+			if d := time.Since(start); d > 5*time.Second {
+				t.Errorf("StartServer took %v to notice the exit", d)
+			}
+		})
+	}
+}
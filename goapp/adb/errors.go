@@ -0,0 +1,71 @@
+// adb 指令失敗時依輸出分類的錯誤，讓呼叫端能以 errors.Is 區分「未授權」「離線」「找不到裝置」等情況
+package adb
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+var (
+	ErrADBNotFound        = errors.New("adb executable not found")
+	ErrDeviceNotFound     = errors.New("device not found")
+	ErrDeviceOffline      = errors.New("device offline")
+	ErrDeviceUnauthorized = errors.New("device unauthorized")
+)
+
+// CommandError 為 adb 指令失敗：Err 為 exec 的錯誤（errors.Unwrap 取得），Output 為 adb 的輸出；
+// Kind 為依輸出判斷出的上述錯誤之一（無法判斷時為 nil），可用 errors.Is 比對
+type CommandError struct {
+	Op     string
+	Output string
+	Err    error
+	Kind   error
+}
+
+func (e *CommandError) Error() string {
+	if e.Output == "" {
+		return fmt.Sprintf("%s: %v", e.Op, e.Err)
+	}
+	return fmt.Sprintf("%s: %v (%s)", e.Op, e.Err, e.Output)
+}
+
+func (e *CommandError) Unwrap() error { return e.Err }
+
+func (e *CommandError) Is(target error) bool { return e.Kind != nil && target == e.Kind }
+
+// newCommandError 建立 CommandError 並依 exec 錯誤與輸出分類
+func newCommandError(op string, out []byte, err error) *CommandError {
+	output := strings.TrimSpace(string(out))
+	return &CommandError{Op: op, Output: output, Err: err, Kind: classifyOutput(output, err)}
+}
+
+// classifyOutput 依 adb 的錯誤訊息判斷失敗原因，例如
+// "error: device unauthorized."、"error: device offline"、"error: device 'xxx' not found"、"error: no devices/emulators found"
+func classifyOutput(out string, err error) error {
+	if errors.Is(err, exec.ErrNotFound) {
+		return ErrADBNotFound
+	}
+	lower := strings.ToLower(out)
+	switch {
+	case strings.Contains(lower, "unauthorized"):
+		return ErrDeviceUnauthorized
+	case strings.Contains(lower, "device offline"):
+		return ErrDeviceOffline
+	case strings.Contains(lower, "no devices/emulators found"),
+		strings.Contains(lower, "device '") && strings.Contains(lower, "' not found"),
+		strings.Contains(lower, "device not found"):
+		return ErrDeviceNotFound
+	}
+	return nil
+}
+
+// runADB 執行 adb 並回傳合併輸出；失敗時回傳 *CommandError
+func runADB(op string, args ...string) ([]byte, error) {
+	out, err := exec.Command("adb", args...).CombinedOutput()
+	if err != nil {
+		return out, newCommandError(op, out, err)
+	}
+	return out, nil
+}
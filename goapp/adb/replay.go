@@ -0,0 +1,141 @@
+// 以錄好的 H.264（Annex-B）檔案模擬 scrcpy 伺服器，供 CI 與壓力測試在沒有實體手機時使用
+package adb
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// FakeDevice 重播錄製的 .h264 檔案，輸出與 scrcpy 伺服器相同的視訊串流格式：
+// 64 bytes 裝置名稱、12 bytes 視訊標頭，接著每個 access unit 前加 12 bytes meta（PTS u64 + size u32）。
+// 檔案播完後從頭循環，PTS 持續遞增。控制通道接受並丟棄所有寫入。
+type FakeDevice struct {
+	path string
+	fps  int
+}
+
+// NewFakeDevice 建立重播指定檔案的假裝置；fps 決定送出 access unit 的間隔與 PTS 步進
+func NewFakeDevice(path string, fps int) *FakeDevice {
+	if fps <= 0 {
+		fps = 30
+	}
+	return &FakeDevice{path: path, fps: fps}
+}
+
+// StartServer 讀入檔案並開始重播，回傳與 Device.StartServer 相同的 ServerConn；
+// withControl 為 false 時不建立控制通道（對應 Options.NoControl）
+func (f *FakeDevice) StartServer(withControl bool) (*ServerConn, error) {
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, fmt.Errorf("read replay file: %w", err)
+	}
+	aus := splitAccessUnits(data)
+	if len(aus) == 0 {
+		return nil, fmt.Errorf("replay file %s: no H.264 access units found", f.path)
+	}
+
+	video := newReplayConn()
+	go f.feed(video.w, aus)
+	conn := &ServerConn{VideoStream: video}
+	if withControl {
+		conn.Control = newReplayConn()
+	}
+	return conn, nil
+}
+
+// feed 依 fps 節奏寫出視訊串流，直到讀取端關閉
+func (f *FakeDevice) feed(w *io.PipeWriter, aus [][]byte) {
+	defer w.Close()
+
+	// 裝置名稱（NUL 結尾）+ 視訊標頭：寬高填 0，由接收端自 SPS 解析
+	var hdr [64 + 12]byte
+	copy(hdr[:63], "replay")
+	binary.BigEndian.PutUint32(hdr[64:68], 0x68323634) // "h264"
+	if _, err := w.Write(hdr[:]); err != nil {
+		return
+	}
+
+	interval := time.Second / time.Duration(f.fps)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	var pts uint64
+	var meta [12]byte
+	for {
+		for _, au := range aus {
+			binary.BigEndian.PutUint64(meta[0:8], pts)
+			binary.BigEndian.PutUint32(meta[8:12], uint32(len(au)))
+			if _, err := w.Write(meta[:]); err != nil {
+				return
+			}
+			if _, err := w.Write(au); err != nil {
+				return
+			}
+			pts += uint64(interval / time.Microsecond)
+			<-t.C
+		}
+	}
+}
+
+// splitAccessUnits 將 Annex-B 串流切成 access unit：SPS/PPS/SEI 等非 VCL NALU 併入其後的第一個 slice。
+// 假設每個畫面只有一個 slice（Android 編碼器的常見輸出）；結尾沒有 slice 的 NALU 會被捨棄
+func splitAccessUnits(data []byte) [][]byte {
+	var starts []int // 每個 NALU 起始碼的位置
+	for i := 0; i+2 < len(data); i++ {
+		if data[i] != 0 || data[i+1] != 0 || data[i+2] != 1 {
+			continue
+		}
+		s := i
+		if s > 0 && data[s-1] == 0 {
+			s-- // 4 bytes 起始碼
+		}
+		starts = append(starts, s)
+		i += 2
+	}
+
+	var aus [][]byte
+	auStart := -1
+	for k, s := range starts {
+		end := len(data)
+		if k+1 < len(starts) {
+			end = starts[k+1]
+		}
+		hdr := s + 3
+		if data[s+2] == 0 {
+			hdr++ // 00 00 00 01
+		}
+		if hdr >= end {
+			continue
+		}
+		if auStart < 0 {
+			auStart = s
+		}
+		if t := data[hdr] & 0x1F; t >= 1 && t <= 5 {
+			aus = append(aus, data[auStart:end])
+			auStart = -1
+		}
+	}
+	return aus
+}
+
+// replayConn 為假裝置的串流端點：讀取來自 pipe，寫入一律丟棄
+type replayConn struct {
+	r *io.PipeReader
+	w *io.PipeWriter
+}
+
+func newReplayConn() *replayConn {
+	r, w := io.Pipe()
+	return &replayConn{r: r, w: w}
+}
+
+func (c *replayConn) Read(p []byte) (int, error)  { return c.r.Read(p) }
+func (c *replayConn) Write(p []byte) (int, error) { return len(p), nil }
+
+// Close 結束讀取端；重播 goroutine 的下一次寫入會失敗並結束
+func (c *replayConn) Close() error {
+	c.r.Close()
+	return c.w.Close()
+}
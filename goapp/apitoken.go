@@ -0,0 +1,23 @@
+// apitoken.go — 高權限端點（上傳檔案、安裝 APK、adb shell、RTMP 推流目的地）的存取權杖。
+// 這些端點只有在設定 -api-token 時才會註冊，請求需帶 Authorization: Bearer <token>。
+
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// requireToken 包裝 handler：Authorization 標頭的 Bearer token 需與 -api-token 相符，否則回應 401
+func requireToken(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || *flagAPIToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(*flagAPIToken)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="scrcpy-go"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized", "missing or invalid bearer token")
+			return
+		}
+		next(w, r)
+	}
+}
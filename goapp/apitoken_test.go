@@ -0,0 +1,72 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequireToken(t *testing.T) {
+	setFlag(t, "api-token", "s3cret")
+	h := requireToken(func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	tests := []struct {
+		auth string
+		want int
+	}{
+		{"", http.StatusUnauthorized},
+		{"s3cret", http.StatusUnauthorized},
+		{"Bearer wrong", http.StatusUnauthorized},
+		{"Basic s3cret", http.StatusUnauthorized},
+		{"Bearer s3cret", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/devices/x/push", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tt.want {
+			t.Errorf("Authorization %q: status %d, want %d", tt.auth, w.Code, tt.want)
+		}
+	}
+}
+
+func TestFileRoutesNeedToken(t *testing.T) {
+	setFlag(t, "enable-files", "true")
+	for _, token := range []string{"", "s3cret"} {
+		setFlag(t, "api-token", token)
+		mux, _ := newMux()
+		for _, path := range []string{"/devices/x/push", "/devices/x/install"} {
+			w := httptest.NewRecorder()
+			mux.ServeHTTP(w, httptest.NewRequest("POST", path, nil))
+			switch {
+			case token == "" && w.Code == http.StatusUnauthorized:
+				t.Errorf("%s registered without -api-token", path)
+			case token != "" && w.Code != http.StatusUnauthorized:
+				t.Errorf("%s without Authorization: status %d, want 401", path, w.Code)
+			}
+		}
+	}
+}
+
+func TestRTMPRouteNeedsToken(t *testing.T) {
+	for _, tt := range []struct {
+		enable, token string
+		want          int
+	}{
+		{"false", "s3cret", http.StatusNotFound},
+		{"true", "", http.StatusNotFound},
+		{"true", "s3cret", http.StatusUnauthorized},
+	} {
+		setFlag(t, "enable-rtmp", tt.enable)
+		setFlag(t, "api-token", tt.token)
+		mux, _ := newMux()
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/devices/x/rtmp", strings.NewReader(`{"url":"rtmp://127.0.0.1/live/x"}`)))
+		if w.Code != tt.want {
+			t.Errorf("-enable-rtmp=%s -api-token=%q: status %d, want %d", tt.enable, tt.token, w.Code, tt.want)
+		}
+	}
+}
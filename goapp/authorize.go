@@ -0,0 +1,97 @@
+// authorize.go — 等待使用者在裝置上允許 USB 偵錯（adb 狀態 unauthorized）。
+// /offer 因裝置未授權失敗時記入 pendingAuth 並記錄 device_needs_authorization；
+// 背景輪詢 adb 裝置清單，狀態轉為 device 後移除並記錄 device_authorized，前端重新送 offer 即可連線，不需重啟服務。
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+const (
+	authPollInterval = 2 * time.Second
+	authPendingMax   = 10 * time.Minute // 超過此時間仍未授權（或已拔除）就不再追蹤
+)
+
+var (
+	pendingMu      sync.Mutex
+	pendingAuth    = make(map[string]time.Time) // 序號 → 開始等待授權的時間
+	pendingPolling bool
+)
+
+// markPendingAuth 記錄等待授權的裝置；serial 為空（adb 預設裝置）時改記錄所有 unauthorized 的裝置
+func markPendingAuth(serial string) {
+	serials := []string{serial}
+	if serial == "" {
+		serials = nil
+		if devs, err := adb.ListDevices(); err == nil {
+			for _, d := range devs {
+				if d.State == "unauthorized" {
+					serials = append(serials, d.Serial)
+				}
+			}
+		}
+	}
+
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	for _, s := range serials {
+		if _, ok := pendingAuth[s]; ok {
+			continue
+		}
+		pendingAuth[s] = time.Now()
+		logger.Warn("device_needs_authorization", "device", deviceKey(s), "hint", "accept the USB debugging prompt on the device")
+	}
+	if len(pendingAuth) > 0 && !pendingPolling {
+		pendingPolling = true
+		goSafe("auth-poller", pollPendingAuth)
+	}
+}
+
+// isPendingAuth 回傳裝置是否正在等待授權
+func isPendingAuth(serial string) bool {
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+	_, ok := pendingAuth[serial]
+	return ok
+}
+
+// pollPendingAuth 定期檢查等待中的裝置，轉為 device 狀態或逾時後移除；清單清空時結束
+func pollPendingAuth() {
+	t := time.NewTicker(authPollInterval)
+	defer t.Stop()
+	for range t.C {
+		devs, err := adb.ListDevices()
+		if err != nil {
+			logger.Warn("auth_poll_failed", "err", err)
+			devs = nil
+		}
+		state := make(map[string]string, len(devs))
+		for _, d := range devs {
+			state[d.Serial] = d.State
+		}
+
+		pendingMu.Lock()
+		for s, since := range pendingAuth {
+			switch {
+			case state[s] == "device":
+				delete(pendingAuth, s)
+				logger.Info("device_authorized", "device", deviceKey(s), "waited", time.Since(since).Round(time.Second))
+			case time.Since(since) > authPendingMax:
+				delete(pendingAuth, s)
+				logger.Warn("device_authorization_timeout", "device", deviceKey(s))
+			}
+		}
+		done := len(pendingAuth) == 0
+		if done {
+			pendingPolling = false
+		}
+		pendingMu.Unlock()
+		if done {
+			return
+		}
+	}
+}
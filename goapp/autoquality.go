@@ -0,0 +1,56 @@
+// autoquality.go — 依 RTP 佇列的丟幀率自動調降位元率。
+// 視訊迴圈每個 streamRateWindow 計算一次丟幀率（佇列滿而丟棄的 AU / 讀到的 AU），持續 dropRateSustain 個區間
+// 超過 dropRateAlertPct 時：開啟 -auto-quality 則以較低位元率重啟 scrcpy server（沿用 restartSession，前端不需重連），
+// 否則只記錄建議值，讓維運者手動呼叫 POST /devices/{id}/quality。
+
+package main
+
+import (
+	"log"
+)
+
+const (
+	dropRateAlertPct     = 10        // 丟幀率門檻（%）
+	dropRateSustain      = 3         // 連續超過門檻的區間數才動作（避免短暫網路抖動觸發）
+	autoQualityMinRate   = 1_000_000 // 調降的下限（bps）
+	scrcpyDefaultBitRate = 8_000_000 // -bit-rate 0 時 scrcpy server 使用的位元率
+)
+
+// nextLowerBitRate 回傳調降後的位元率（目前的 3/4，不低於 autoQualityMinRate）；已在下限時回傳 0
+func nextLowerBitRate(cur int) int {
+	if cur <= 0 {
+		cur = scrcpyDefaultBitRate
+	}
+	if cur <= autoQualityMinRate {
+		return 0
+	}
+	return max(cur*3/4, autoQualityMinRate)
+}
+
+// reduceQualityForDrops 於丟幀率持續偏高時呼叫；回傳 true 表示已觸發重啟（目前的視訊迴圈即將結束）
+func reduceQualityForDrops(sess *deviceSession, pct float64) bool {
+	if sess.dev == nil {
+		return false // -replay 沒有位元率可調
+	}
+	opts := sess.dev.Options()
+	rate := nextLowerBitRate(opts.BitRate)
+	if rate == 0 {
+		sess.log.Warn("drop_rate_high", "pct", pct, "bitRate", opts.BitRate, "action", "none_at_min")
+		return false
+	}
+	if !*flagAutoQuality {
+		sess.log.Warn("drop_rate_high", "pct", pct, "bitRate", opts.BitRate, "recommendedBitRate", rate)
+		return false
+	}
+	sess.log.Warn("drop_rate_high", "pct", pct, "bitRate", opts.BitRate, "action", "reduce", "newBitRate", rate)
+	evAutoQualityDown.Add(1)
+	opts.BitRate = rate
+	// 呼叫端的視訊迴圈隨即返回並呼叫 endSession：先標記，否則前端會在重啟完成前被當成裝置中斷而關閉
+	sess.restarting.Store(true)
+	goSafe("auto-quality", func() {
+		if _, err := restartSession(sess, opts); err != nil {
+			log.Printf("❌ [ADB][%s] 自動調降位元率失敗: %v", sess.id, err)
+		}
+	})
+	return true
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/pion/webrtc/v4"
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+func TestNextLowerBitRate(t *testing.T) {
+	tests := []struct{ cur, want int }{
+		{0, 6_000_000}, // scrcpy 預設 8 Mbps
+		{8_000_000, 6_000_000},
+		{1_200_000, autoQualityMinRate},
+		{autoQualityMinRate, 0},
+		{500_000, 0},
+	}
+	for _, tt := range tests {
+		if got := nextLowerBitRate(tt.cur); got != tt.want {
+			t.Errorf("nextLowerBitRate(%d) = %d, want %d", tt.cur, got, tt.want)
+		}
+	}
+}
+
+// 視訊迴圈在 reduceQualityForDrops 回傳 true 後立即返回並呼叫 endSession：
+// 重啟還在進行，前端不可收到 deviceGone 或被關閉
+func TestAutoQualityRestartKeepsClients(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake adb is a shell script")
+	}
+	// 假的 adb：start-server 成功，其餘指令稍候後失敗，讓背景的 restartSession 晚於 endSession 結束
+	dir := t.TempDir()
+	script := "#!/bin/sh\n[ \"$1\" = start-server ] && exit 0\nsleep 0.3\nexit 1\n"
+	if err := os.WriteFile(filepath.Join(dir, "adb"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	setFlag(t, "auto-quality", "true")
+
+	dev, err := adb.NewDevice("aq-dev", adb.Options{BitRate: 8_000_000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sess := &deviceSession{id: deviceKey("aq-dev"), sid: "aq", dev: dev, log: logger, done: make(chan struct{})}
+	pc, err := webrtc.NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	addClient(newClient(sess.sid, sess.id, pc, nil, nil))
+	stateMu.Lock()
+	old := curSession
+	curSession = sess
+	stateMu.Unlock()
+	t.Cleanup(func() {
+		stateMu.Lock()
+		curSession = old
+		stateMu.Unlock()
+		removeClient(sess.sid, pc)
+	})
+
+	if !reduceQualityForDrops(sess, 30) {
+		t.Fatal("reduceQualityForDrops did not restart")
+	}
+	endSession(sess, "video_closed") // 視訊迴圈結束時的呼叫
+
+	if !sess.restarting.Load() {
+		t.Error("session not marked as restarting before the video loop returned")
+	}
+	stateMu.RLock()
+	cur := curSession
+	stateMu.RUnlock()
+	if cur != sess {
+		t.Error("endSession released a session that is being restarted")
+	}
+	time.Sleep(deviceGoneGrace + 200*time.Millisecond)
+	if s := pc.ConnectionState(); s == webrtc.PeerConnectionStateClosed {
+		t.Error("client PeerConnection closed during the restart")
+	}
+	// 等背景重啟（預期失敗）結束，避免影響其他測試
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stateMu.RLock()
+		cur = curSession
+		stateMu.RUnlock()
+		if cur != sess || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
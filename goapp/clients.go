@@ -0,0 +1,475 @@
+// clients.go — 已連上的前端（PeerConnection）登記表與其連線維護。
+// 同一裝置可有多個前端共用一個 scrcpy session，各自有 track、packetizer 與發送佇列（見 fanout.go）。
+// /offer 建立 PeerConnection 後登記、連線 Closed 時移除；每個前端記錄 ping/pong RTT、RTCP 接收報告與解碼器失步次數，
+// 供 -max-clients-per-device、GET /devices/{id}/clients 與 GET /stats、ICE restart（?sessionId=）與閒置前端回收使用。
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+const (
+	clientPingInterval = 5 * time.Second  // ping 週期
+	clientPongTimeout  = 15 * time.Second // 超過此時間未收到 pong 即關閉連線
+	iceRestartGrace    = 20 * time.Second // Failed 後等待 ICE restart 的時間
+	desyncPLICount     = 3                // desyncWindow 內收到這麼多次 PLI/FIR 視為解碼器失步
+	desyncWindow       = 5 * time.Second
+	clientIdleTimeout  = 30 * time.Second // -client-idle-timeout 預設值
+)
+
+// clientInfo 為單一前端連線
+type clientInfo struct {
+	id         string // 前端 session ID（X-Session-Id）；建立 scrcpy session 的前端與 deviceSession.sid 相同
+	device     string
+	pc         *webrtc.PeerConnection
+	track      rtpWriter      // *webrtc.TrackLocalStaticRTP
+	packetizer rtp.Packetizer // 與 track 一起在 ICE restart 後沿用，序號與時間戳連續
+	ssrc       uint32         // 實際送出的 SSRC（track 寫入時會改寫成 sender 的 SSRC）
+	queue      *rtpQueue      // 視訊迴圈 → 此前端發送 goroutine；移除時關閉
+	transcoder *transcoder    // ?maxWidth：視訊迴圈的 AU 先經 ffmpeg 縮放再進 queue（見 transcode.go）；nil 為原畫質
+	createdAt  time.Time
+	done       chan struct{} // 移除時關閉，結束 ping 迴圈
+
+	keyframesOnly bool // ?keyframesOnly=true：只接收參數集與 IDR（建立後不變）
+
+	// 最近一次寫入 track 的 RTP 序號與時間戳（對照抓包用）
+	lastSeq atomic.Uint32
+	lastTS  atomic.Uint32
+	sentRTP atomic.Bool
+
+	// 以下受 stateMu 保護
+	sending       bool                // PeerConnection 為 Connected：視訊迴圈才會把 AU 交給它
+	needKF        bool                // 等待 IDR，在此之前不送一般幀（新前端、PLI/FIR、恢復連線、server 重啟、解析度改變）
+	paramsPending bool                // 下一個 AU 前先補送快取的參數集，解碼器在 IDR 抵達前就備妥
+	dc            *webrtc.DataChannel // 伺服器 → 前端的訊息與 ping 用通道（優先可靠通道 controlR）；view-only 時為 nil
+	rtt           time.Duration       // 最近一次 ping/pong 來回時間
+	lastPong      time.Time
+	lastRTCP      time.Time   // 最近一次收到 RTCP（從登記時起算）
+	lossAt        []time.Time // desyncWindow 內收到 PLI/FIR 的時間
+	recoveries    int         // 解碼器失步而主動恢復的次數
+	rr            *rtcpStats  // 最近一次 Receiver Report；尚未收到時為 nil
+}
+
+// rtpWriter 為前端的視訊 track（測試以會阻塞的假 track 取代）
+type rtpWriter interface {
+	WriteRTP(p *rtp.Packet) error
+}
+
+// newClient 建立尚未連上的前端：等 PeerConnection 進入 Connected 後才開始接收視訊，並從參數集 + IDR 開始
+func newClient(id, device string, pc *webrtc.PeerConnection, track rtpWriter, pk rtp.Packetizer) *clientInfo {
+	return &clientInfo{
+		id:         id,
+		device:     device,
+		pc:         pc,
+		track:      track,
+		packetizer: pk,
+		queue:      newRTPQueue(*flagRTPQueueSize, *flagKeepKeyframes),
+		createdAt:  time.Now(),
+		lastRTCP:   time.Now(),
+		done:       make(chan struct{}),
+		needKF:     true,
+	}
+}
+
+// rtcpStats 為前端 Receiver Report 中關於我們視訊 SSRC 的接收品質
+type rtcpStats struct {
+	FractionLost float64 `json:"fractionLostPct"` // 上一個回報區間的丟包率（%）
+	TotalLost    uint32  `json:"totalLost"`       // 累計丟包數
+	JitterMs     float64 `json:"jitterMs"`        // 到達間隔抖動（由 90kHz 時間戳單位換算）
+	AgeSec       float64 `json:"ageSec"`          // 距收到回報的秒數（列出時計算）
+	at           time.Time
+}
+
+// clients 以 session ID 為 key（受 stateMu 保護）
+var clients = make(map[string]*clientInfo)
+
+// addClient 登記前端連線並啟動它的 RTP 發送 goroutine
+func addClient(c *clientInfo) {
+	stateMu.Lock()
+	clients[c.id] = c
+	stateMu.Unlock()
+	pace, probe := *flagPace, *flagLatencyProbe
+	goSafe("rtp-sender", func() { startRTPSender(c, pace, probe) })
+	if c.transcoder != nil {
+		goSafe("transcode", c.transcoder.run)
+	}
+}
+
+// removeClient 移除前端連線；僅在登記的仍是同一條 PeerConnection 時移除
+func removeClient(id string, pc *webrtc.PeerConnection) {
+	stateMu.Lock()
+	if c, ok := clients[id]; ok && c.pc == pc {
+		delete(clients, id)
+		close(c.done)
+		c.queue.close()
+		if c.transcoder != nil {
+			c.transcoder.close()
+		}
+		if countClientsLocked(c.device) == 0 {
+			delete(awakeDevices, c.device) // 下一個前端連上時再喚醒一次
+			if saved, ok := showTouchesSaved[c.device]; ok {
+				delete(showTouchesSaved, c.device)
+				goSafe("show-touches-restore", func() { restoreShowTouches(c.device, saved) })
+			}
+		}
+	}
+	stateMu.Unlock()
+	updateActivePeers()
+}
+
+// setClientDC 記錄前端的 DataChannel；伺服器 → 前端的訊息走可靠通道，若前端只開了一條就用那條
+func setClientDC(id string, dc *webrtc.DataChannel) {
+	stateMu.Lock()
+	if c, ok := clients[id]; ok && (c.dc == nil || dc.Label() == "controlR") {
+		c.dc = dc
+		c.lastPong = time.Now() // 從通道開啟起算逾時
+	}
+	stateMu.Unlock()
+}
+
+// clearClientDC 在 DataChannel 關閉時清除
+func clearClientDC(id string, dc *webrtc.DataChannel) {
+	stateMu.Lock()
+	if c, ok := clients[id]; ok && c.dc == dc {
+		c.dc = nil
+	}
+	stateMu.Unlock()
+}
+
+// startClientPing 定期送出 ping；逾時未收到 pong 或 RTCP 靜默過久時關閉 PeerConnection（OnConnectionStateChange 會負責移除）
+func startClientPing(c *clientInfo) {
+	t := time.NewTicker(clientPingInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-t.C:
+		}
+		stateMu.RLock()
+		dc, last, lastRTCP := c.dc, c.lastPong, c.lastRTCP
+		stateMu.RUnlock()
+		if idle := time.Since(lastRTCP); *flagClientIdle > 0 && idle > *flagClientIdle {
+			logger.Warn("client_reaped", "device", c.device, "session", c.id, "idle", idle)
+			evClientsReaped.Add(1)
+			closePeerConn(c.pc)
+			return
+		}
+		if dc == nil {
+			continue // DataChannel 尚未開啟或 view-only
+		}
+		if time.Since(last) > clientPongTimeout {
+			log.Printf("[RTC][%s] 超過 %v 未收到 pong，關閉連線", c.id, clientPongTimeout)
+			closePeerConn(c.pc)
+			return
+		}
+		sendOnDC(dc, map[string]any{"type": "ping", "t": time.Now().UnixMilli()})
+	}
+}
+
+// handlePong 依 pong 帶回的 ping 時間戳（ms）計算 RTT
+func handlePong(id string, t int64) {
+	rtt := time.Since(time.UnixMilli(t))
+	if rtt < 0 {
+		return
+	}
+	stateMu.Lock()
+	if c, ok := clients[id]; ok {
+		c.rtt = rtt
+		c.lastPong = time.Now()
+	}
+	stateMu.Unlock()
+	evClientRTTMs.Set(rtt.Milliseconds())
+}
+
+// handleICERestart 處理帶 sessionId 的 /offer：在既有 PeerConnection 上套用 ICE restart offer 並回傳新的 answer
+func handleICERestart(w http.ResponseWriter, id string, offer webrtc.SessionDescription) {
+	stateMu.RLock()
+	c := clients[id]
+	stateMu.RUnlock()
+	if c == nil {
+		writeError(w, http.StatusNotFound, "session_not_found", "session not found")
+		return
+	}
+	pc := c.pc
+	log.Printf("[RTC][%s] ICE restart（目前狀態 %s）", id, pc.ConnectionState())
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_offer", "set remote error")
+		return
+	}
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "answer_failed", "answer error")
+		return
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		writeError(w, http.StatusInternalServerError, "answer_failed", "set local error")
+		return
+	}
+	<-webrtc.GatheringCompletePromise(pc)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Session-Id", id)
+	_ = json.NewEncoder(w).Encode(pc.LocalDescription())
+}
+
+// clientConnected 在連線（重新）進入 Connected 時開始發送：先補送參數集，再從關鍵幀開始。
+// ICE restart 後沿用原本的 track/packetizer，序號與時間戳連續
+func clientConnected(id string, pc *webrtc.PeerConnection) bool {
+	stateMu.Lock()
+	c, ok := clients[id]
+	ok = ok && c.pc == pc
+	if ok {
+		c.sending = true
+		c.needKF = true
+		c.paramsPending = true
+	}
+	stateMu.Unlock()
+	if ok {
+		updateActivePeers()
+	}
+	return ok
+}
+
+// clientDisconnected 在連線 Disconnected/Failed/Closed 時停止把 AU 交給它（保留登記，供 ICE restart 恢復）
+func clientDisconnected(id string, pc *webrtc.PeerConnection) {
+	stateMu.Lock()
+	if c, ok := clients[id]; ok && c.pc == pc {
+		c.sending = false
+	}
+	stateMu.Unlock()
+	updateActivePeers()
+}
+
+// updateActivePeers 更新正在接收視訊的前端數
+func updateActivePeers() {
+	n := 0
+	stateMu.RLock()
+	for _, c := range clients {
+		if c.sending {
+			n++
+		}
+	}
+	stateMu.RUnlock()
+	evActivePeer.Set(int64(n))
+}
+
+// markClientNeedsKeyframe 讓前端在下一個 IDR 前不再收一般幀；回傳 false 表示它本來就在等待
+func markClientNeedsKeyframe(id string) bool {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	c, ok := clients[id]
+	if !ok || c.needKF {
+		return false
+	}
+	c.needKF = true
+	return true
+}
+
+// notePLI 記錄一次觸發關鍵幀請求的 PLI/FIR，回傳累計次數
+func notePLI() int {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	lastPLI = time.Now()
+	pliCount++
+	return pliCount
+}
+
+// markDeviceNeedsKeyframeLocked 讓裝置的所有前端從下一個 IDR 重新開始，回傳受影響的前端數；呼叫端需持有 stateMu
+func markDeviceNeedsKeyframeLocked(device string) int {
+	n := 0
+	for _, c := range clients {
+		if c.device == device && c.sending {
+			c.needKF = true
+			n++
+		}
+	}
+	return n
+}
+
+// awaitingKeyframeLocked 回傳裝置是否有前端正在等待關鍵幀；呼叫端需持有 stateMu
+func awaitingKeyframeLocked(device string) bool {
+	for _, c := range clients {
+		if c.device == device && c.sending && c.needKF {
+			return true
+		}
+	}
+	return false
+}
+
+// devicePeerConns 回傳裝置所有前端的 PeerConnection
+func devicePeerConns(device string) []*webrtc.PeerConnection {
+	var pcs []*webrtc.PeerConnection
+	stateMu.RLock()
+	for _, c := range clients {
+		if c.device == device {
+			pcs = append(pcs, c.pc)
+		}
+	}
+	stateMu.RUnlock()
+	return pcs
+}
+
+// noteKeyframeLoss 記錄前端送來的 PLI/FIR；desyncWindow 內累積達 desyncPLICount 次時回傳 true 並重新計數
+func noteKeyframeLoss(id string) bool {
+	now := time.Now()
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	c, ok := clients[id]
+	if !ok {
+		return false
+	}
+	kept := c.lossAt[:0]
+	for _, t := range c.lossAt {
+		if now.Sub(t) < desyncWindow {
+			kept = append(kept, t)
+		}
+	}
+	c.lossAt = append(kept, now)
+	if len(c.lossAt) < desyncPLICount {
+		return false
+	}
+	c.lossAt = c.lossAt[:0]
+	return true
+}
+
+// recoverClientDecoder 處理前端解碼器失步：若它正在接收視訊，
+// 於下一個 AU 前補送快取的 SPS/PPS，並請求關鍵幀（與同一裝置其他前端的請求一起去抖動）
+func recoverClientDecoder(sess *deviceSession, id string) {
+	stateMu.Lock()
+	c, ok := clients[id]
+	active := ok && c.sending
+	if active {
+		c.recoveries++
+		c.needKF = true
+		c.paramsPending = true
+	}
+	stateMu.Unlock()
+	if !active {
+		return
+	}
+	sess.log.Warn("client_decoder_desync", "session", id, "window", desyncWindow)
+	evDesyncRecoveries.Add(1)
+	requestKeyframeDebounced(sess, "decoder_desync")
+}
+
+// noteClientRTCP 記錄收到前端的 RTCP
+func noteClientRTCP(id string) {
+	stateMu.Lock()
+	if c, ok := clients[id]; ok {
+		c.lastRTCP = time.Now()
+	}
+	stateMu.Unlock()
+}
+
+// noteReceptionReports 記錄前端 RR/SR 中針對本前端 SSRC 的接收報告（其他 SSRC 忽略）
+func noteReceptionReports(id string, reports []rtcp.ReceptionReport) {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	c, ok := clients[id]
+	if !ok {
+		return
+	}
+	for _, rr := range reports {
+		if c.ssrc != 0 && rr.SSRC != c.ssrc {
+			continue
+		}
+		c.rr = &rtcpStats{
+			FractionLost: float64(rr.FractionLost) * 100 / 256,
+			TotalLost:    rr.TotalLost,
+			JitterMs:     float64(rr.Jitter) * 1000 / 90000,
+			at:           time.Now(),
+		}
+		evRTCPFractionLost.Set(int64(c.rr.FractionLost))
+	}
+}
+
+// senderSSRC 取得 RTPSender 的 SSRC；TrackLocalStaticRTP 送出時以此覆寫 packetizer 的 SSRC
+func senderSSRC(s *webrtc.RTPSender) uint32 {
+	if enc := s.GetParameters().Encodings; len(enc) > 0 {
+		return uint32(enc[0].SSRC)
+	}
+	return 0
+}
+
+// countClientsLocked 回傳指定裝置目前的前端數；呼叫端需持有 stateMu
+func countClientsLocked(device string) int {
+	n := 0
+	for _, c := range clients {
+		if c.device == device {
+			n++
+		}
+	}
+	return n
+}
+
+// clientStats 為 GET /devices/{id}/clients 與 GET /stats 列出的單一前端
+type clientStats struct {
+	ID         string     `json:"id"`
+	AgeSec     float64    `json:"ageSec"`
+	State      string     `json:"state"`
+	RTTMs      float64    `json:"rttMs"` // 0 表示尚未量測到
+	SSRC       uint32     `json:"ssrc"`
+	Recoveries int        `json:"recoveries"`
+	KFOnly     bool       `json:"keyframesOnly"`
+	RTCP       *rtcpStats `json:"rtcp,omitempty"` // 最近一次 Receiver Report；尚未收到時省略
+	Seq        *uint32    `json:"seq,omitempty"`  // 尚未送出任何 RTP 時省略
+	TS         *uint32    `json:"ts,omitempty"`
+}
+
+// clientStatsLocked 列出裝置的前端，連線最久的在前；呼叫端需持有 stateMu
+func clientStatsLocked(device string) []clientStats {
+	entries := []clientStats{}
+	for _, c := range clients {
+		if c.device != device {
+			continue
+		}
+		e := clientStats{
+			ID:         c.id,
+			AgeSec:     time.Since(c.createdAt).Seconds(),
+			RTTMs:      float64(c.rtt.Microseconds()) / 1000,
+			SSRC:       c.ssrc,
+			Recoveries: c.recoveries,
+			KFOnly:     c.keyframesOnly,
+		}
+		if c.pc != nil {
+			e.State = c.pc.ConnectionState().String()
+		}
+		if c.rr != nil {
+			st := *c.rr
+			st.AgeSec = time.Since(st.at).Seconds()
+			e.RTCP = &st
+		}
+		if c.sentRTP.Load() {
+			seq, ts := c.lastSeq.Load(), c.lastTS.Load()
+			e.Seq, e.TS = &seq, &ts
+		}
+		entries = append(entries, e)
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].AgeSec > entries[j].AgeSec })
+	return entries
+}
+
+// === HTTP: GET /devices/{id}/clients handler ===
+// 列出連到指定裝置的前端：session ID、連線時長、PeerConnection 狀態、ping RTT、RTP SSRC、解碼器失步恢復次數與 RTCP 接收報告；
+// 已送出過視訊的前端另附最近送出的 RTP 序號與時間戳，方便對照 Wireshark/rtpdump 抓到的封包
+func handleDeviceClients(w http.ResponseWriter, r *http.Request) {
+	id := pathDeviceID(r)
+
+	stateMu.RLock()
+	entries := clientStatsLocked(id)
+	stateMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+// fakeADBLog 在 PATH 放一個假的 adb：把每次呼叫的參數附加到回傳的記錄檔，settings get 一律輸出 0
+func fakeADBLog(t *testing.T) string {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake adb is a shell script")
+	}
+	dir := t.TempDir()
+	logPath := filepath.Join(dir, "calls.log")
+	script := "#!/bin/sh\necho \"$*\" >> '" + logPath + "'\ncase \"$*\" in *'settings get'*) echo 0;; esac\n"
+	if err := os.WriteFile(filepath.Join(dir, "adb"), []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	return logPath
+}
+
+// adbCalls 回傳假 adb 目前記錄到、包含 substr 的呼叫
+func adbCalls(t *testing.T, logPath, substr string) []string {
+	t.Helper()
+	b, err := os.ReadFile(logPath)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	var calls []string
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.Contains(line, substr) {
+			calls = append(calls, line)
+		}
+	}
+	return calls
+}
+
+func TestShowTouchesRestoredWhenLastClientLeaves(t *testing.T) {
+	logPath := fakeADBLog(t)
+	dev, err := adb.NewDevice("dev1", adb.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const id = "dev1"
+	addClient(newClient("a", id, nil, nil, nil))
+	addClient(newClient("b", id, nil, nil, nil))
+	t.Cleanup(func() {
+		removeClient("a", nil)
+		removeClient("b", nil)
+		stateMu.Lock()
+		delete(showTouchesSaved, id)
+		stateMu.Unlock()
+	})
+
+	setShowTouches(&deviceSession{id: id, dev: dev, log: logger}, true)
+	// restartSession 換上新的 deviceSession：原值沿用，不再重新讀取，也不會還原
+	setShowTouches(&deviceSession{id: id, dev: dev, log: logger}, true)
+	if got := adbCalls(t, logPath, "settings get system show_touches"); len(got) != 1 {
+		t.Fatalf("settings get called %d times, want 1 (value carried across sessions)", len(got))
+	}
+
+	removeClient("a", nil)
+	time.Sleep(50 * time.Millisecond)
+	if got := adbCalls(t, logPath, "show_touches 0"); len(got) != 0 {
+		t.Fatalf("restored while a client is still connected: %q", got)
+	}
+
+	removeClient("b", nil)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(adbCalls(t, logPath, "settings put system show_touches 0")) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("show_touches not restored after the last client left")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	stateMu.RLock()
+	_, still := showTouchesSaved[id]
+	stateMu.RUnlock()
+	if still {
+		t.Error("saved show_touches not cleared")
+	}
+}
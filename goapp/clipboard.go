@@ -0,0 +1,99 @@
+// clipboard.go — 裝置剪貼簿：GET/POST /devices/{id}/clipboard。
+// 裝置主動回報（DeviceMessage.CLIPBOARD）的內容由 readDeviceMessages 記在 deviceSession；
+// 內容有變化時以 {"type":"clipboard","text":...} 推送給該裝置的所有前端（-clipboard-sync=false 關閉，超過 clipboardDCMax 截斷）。
+// SET_CLIPBOARD 帶遞增的 sequence，server 完成後以 ACK_CLIPBOARD 回傳同一個 sequence 供比對。
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// clipboardDCMax 為推送給前端的剪貼簿上限（bytes），遠小於 DataChannel 單一訊息的上限
+const clipboardDCMax = 16 << 10
+
+// clipboardSeq 為 SET_CLIPBOARD 的 sequence（0 保留給「不需要 ack」）
+var clipboardSeq atomic.Uint64
+
+// sendSetClipboard 送出 SET_CLIPBOARD：[type][sequence u64][paste u8][len u32][utf8]，回傳使用的 sequence
+func sendSetClipboard(text string, paste bool) uint64 {
+	seq := clipboardSeq.Add(1)
+	buf := make([]byte, 0, 14+len(text))
+	buf = append(buf, controlMsgSetClipboard)
+	buf = binary.BigEndian.AppendUint64(buf, seq)
+	if paste {
+		buf = append(buf, 1)
+	} else {
+		buf = append(buf, 0)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(text)))
+	buf = append(buf, text...)
+	enqueueControl(buf, *flagCtrlTimeout, false)
+	return seq
+}
+
+// broadcastClipboard 將裝置剪貼簿推送給該裝置的所有前端
+func broadcastClipboard(sess *deviceSession, text string) {
+	truncated := len(text) > clipboardDCMax
+	if truncated {
+		text = text[:clipboardDCMax]
+		for !utf8.ValidString(text) { // 不切在多位元組字元中間
+			text = text[:len(text)-1]
+		}
+	}
+	sendToClients(sess.id, map[string]any{"type": "clipboard", "device": sess.id, "text": text, "truncated": truncated})
+}
+
+// === HTTP: GET /devices/{id}/clipboard handler ===
+// 回傳裝置最近一次回報的剪貼簿內容與最近一次 ACK_CLIPBOARD 的 sequence
+func handleDeviceClipboard(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil {
+		return
+	}
+	stateMu.RLock()
+	resp := map[string]any{
+		"text":   s.clipboard,
+		"ackSeq": s.clipAckSeq,
+	}
+	if !s.clipboardAt.IsZero() {
+		resp["updatedAt"] = s.clipboardAt.Format(time.RFC3339)
+	}
+	stateMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// === HTTP: POST /devices/{id}/clipboard handler ===
+// 設定裝置剪貼簿（paste=true 時一併貼上），回傳 sequence；以 GET 的 ackSeq 確認是否已套用
+func handleDeviceSetClipboard(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil {
+		return
+	}
+	var req struct {
+		Text  string `json:"text"`
+		Paste bool   `json:"paste"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, controlReadBufMax)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if s.control == nil {
+		writeError(w, http.StatusConflict, "view_only", "control channel disabled (view-only)")
+		return
+	}
+	seq := sendSetClipboard(req.Text, req.Paste)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "ok",
+		"seq":    seq,
+	})
+}
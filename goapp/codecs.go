@@ -0,0 +1,163 @@
+// codecs.go — 視訊編碼協商：-codecs 依偏好順序列出可用的編碼（h264、h265），
+// /offer 時從瀏覽器 offer 的 rtpmap 找出第一個雙方都支援的編碼，
+// 以該編碼啟動 scrcpy server，並選用對應的 MediaEngine 註冊、RTP payloader 與 NALU 分類。
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v4"
+)
+
+// codecMimeTypes 為支援的編碼名稱（scrcpy video_codec 參數）→ WebRTC MIME type
+var codecMimeTypes = map[string]string{
+	"h264": webrtc.MimeTypeH264,
+	"h265": webrtc.MimeTypeH265,
+}
+
+// codecPrefs 為 -codecs 解析後的偏好順序（main 啟動時設定，之後唯讀）
+var codecPrefs []string
+
+// parseCodecList 解析逗號分隔的編碼偏好清單
+func parseCodecList(list string) ([]string, error) {
+	var out []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if _, ok := codecMimeTypes[name]; !ok {
+			return nil, fmt.Errorf("未知的編碼 %q（可用 h264、h265）", name)
+		}
+		out = append(out, name)
+	}
+	if len(out) == 0 {
+		return nil, fmt.Errorf("至少需要一種編碼")
+	}
+	return out, nil
+}
+
+// offeredVideoCodecs 從 offer SDP 的 a=rtpmap 行取出編碼名稱（大寫，例如 H264、H265）
+func offeredVideoCodecs(sdp string) map[string]bool {
+	found := make(map[string]bool)
+	for _, line := range strings.Split(sdp, "\n") {
+		rest, ok := strings.CutPrefix(strings.TrimSpace(line), "a=rtpmap:")
+		if !ok {
+			continue
+		}
+		// a=rtpmap:<pt> <name>/<clock>
+		if _, enc, ok := strings.Cut(rest, " "); ok {
+			name, _, _ := strings.Cut(enc, "/")
+			found[strings.ToUpper(name)] = true
+		}
+	}
+	return found
+}
+
+// pickCodec 依 prefs 的順序回傳第一個 offer 也支援的編碼；沒有交集時回傳空字串
+func pickCodec(prefs []string, offered map[string]bool) string {
+	for _, name := range prefs {
+		if offered[strings.ToUpper(name)] {
+			return name
+		}
+	}
+	return ""
+}
+
+// codecParameters 回傳註冊到 MediaEngine 的編碼參數
+func codecParameters(name string) webrtc.RTPCodecParameters {
+	feedback := []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}, {Type: "ccm", Parameter: "fir"}}
+	if name == "h265" {
+		return webrtc.RTPCodecParameters{
+			RTPCodecCapability: webrtc.RTPCodecCapability{
+				MimeType:     webrtc.MimeTypeH265,
+				ClockRate:    90000,
+				RTCPFeedback: feedback,
+			},
+			PayloadType: 116,
+		}
+	}
+	// H.264 packetization-mode=1
+	return webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    90000,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=" + h264ProfileLevelID(),
+			RTCPFeedback: feedback,
+		},
+		PayloadType: 96,
+	}
+}
+
+// newPayloader 回傳編碼對應的 RTP payloader
+func newPayloader(name string) rtp.Payloader {
+	if name == "h265" {
+		return &codecs.H265Payloader{}
+	}
+	return &codecs.H264Payloader{}
+}
+
+// nalKind 為與編碼無關的 NALU 分類
+type nalKind int
+
+const (
+	nalOther nalKind = iota
+	nalVPS           // 僅 H.265
+	nalSPS
+	nalPPS
+	nalIDR // H.264 IDR；H.265 IRAP（BLA/IDR/CRA）
+)
+
+// classifyNALU 依編碼分類 NALU（n 不含起始碼）
+func classifyNALU(n []byte, hevc bool) nalKind {
+	if len(n) == 0 {
+		return nalOther
+	}
+	if !hevc {
+		switch naluType(n) {
+		case 7:
+			return nalSPS
+		case 8:
+			return nalPPS
+		case 5:
+			return nalIDR
+		}
+		return nalOther
+	}
+	switch t := (n[0] >> 1) & 0x3F; {
+	case t == 32:
+		return nalVPS
+	case t == 33:
+		return nalSPS
+	case t == 34:
+		return nalPPS
+	case t >= 16 && t <= 21:
+		return nalIDR
+	}
+	return nalOther
+}
+
+// paramSets 回傳快取的參數集（H.265 為 VPS、SPS、PPS；H.264 為 SPS、PPS），尚未收齊時回傳 nil
+func paramSets() [][]byte {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return paramSetsLocked()
+}
+
+// paramSetsLocked 同 paramSets；呼叫端需持有 stateMu
+func paramSetsLocked() [][]byte {
+	if len(lastSPS) == 0 || len(lastPPS) == 0 {
+		return nil
+	}
+	if videoCodec == "h265" {
+		if len(lastVPS) == 0 {
+			return nil
+		}
+		return [][]byte{lastVPS, lastSPS, lastPPS}
+	}
+	return [][]byte{lastSPS, lastPPS}
+}
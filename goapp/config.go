@@ -0,0 +1,33 @@
+// config.go — GET /config：列出所有命令列參數的實際值（含預設值），方便確認部署中的服務用了哪些調校。
+// 可能含憑證的參數（例如 RTMP 串流金鑰、webhook token）只回報是否設定。
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+)
+
+// secretFlags 的值不輸出
+var secretFlags = map[string]bool{
+	"api-token":   true,
+	"rtmp-url":    true,
+	"webhook-url": true,
+}
+
+// === HTTP: GET /config handler ===
+// 回應 {"<flag 名稱>": "<值>", ...}；Duration 以 Go 的格式表示（例如 "120ms"）
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	cfg := make(map[string]string)
+	flag.VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secretFlags[f.Name] && v != "" {
+			v = "(set)"
+		}
+		cfg[f.Name] = v
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cfg)
+}
@@ -0,0 +1,137 @@
+// control_queue.go — control socket 前的有界佇列與專用寫入 goroutine。
+// DataChannel 的事件處理只負責入列，不會因 control socket 卡住而阻塞；
+// 佇列塞滿時優先丟棄過時的 move，down/up/cancel 等關鍵訊息一律送達。
+// 同一 pointer 尚未寫出的 move 會被新的 move 取代（合併），寫入跟不上 120Hz 的觸控事件時只送最新位置；
+// 合併只發生在佇列有積壓時，寫入即時的情況下不額外延遲。
+
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const controlQueueSize = 64 // 待寫入的控制訊息上限（關鍵訊息可超出）
+
+type controlMsg struct {
+	data       []byte
+	deadline   time.Duration
+	droppable  bool   // move 等可被較新事件取代的訊息
+	hasPointer bool   // 觸控訊息：pointer 有效
+	pointer    uint64 // 觸控訊息所屬的 pointer ID
+}
+
+type controlQueue struct {
+	mu     sync.Mutex
+	items  []controlMsg
+	max    int
+	notify chan struct{} // 容量 1
+}
+
+func newControlQueue(max int) *controlQueue {
+	return &controlQueue{
+		items:  make([]controlMsg, 0, max),
+		max:    max,
+		notify: make(chan struct{}, 1),
+	}
+}
+
+func (q *controlQueue) push(m controlMsg) {
+	q.mu.Lock()
+	if m.droppable && m.hasPointer && q.coalesceLocked(m) {
+		q.mu.Unlock()
+		evCtrlMovesCoalesced.Add(1)
+		return
+	}
+	if len(q.items) >= q.max {
+		victim := -1
+		for i, it := range q.items {
+			if it.droppable {
+				victim = i
+				break
+			}
+		}
+		switch {
+		case victim >= 0:
+			// 淘汰最舊的 move，保留較新的事件
+			q.items = append(q.items[:victim], q.items[victim+1:]...)
+			evCtrlMovesDropped.Add(1)
+		case m.droppable:
+			q.mu.Unlock()
+			evCtrlMovesDropped.Add(1)
+			return
+		}
+		// 佇列全是關鍵訊息：仍然入列（超出上限），確保 down/up 不遺失
+	}
+	q.items = append(q.items, m)
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// coalesceLocked 若同一 pointer 在佇列中的最後一筆訊息是尚未寫出的 move，就以新座標取代它並回傳 true。
+// 中間若有該 pointer 的 down/up/cancel 則不合併，維持事件順序
+func (q *controlQueue) coalesceLocked(m controlMsg) bool {
+	for i := len(q.items) - 1; i >= 0; i-- {
+		it := &q.items[i]
+		if !it.hasPointer || it.pointer != m.pointer {
+			continue
+		}
+		if !it.droppable {
+			return false
+		}
+		it.data, it.deadline = m.data, m.deadline
+		return true
+	}
+	return false
+}
+
+func (q *controlQueue) pop() controlMsg {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			m := q.items[0]
+			q.items[0] = controlMsg{}
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return m
+		}
+		q.mu.Unlock()
+		<-q.notify
+	}
+}
+
+// reset 清空佇列（切換裝置連線時，舊裝置的事件不應送往新裝置）
+func (q *controlQueue) reset() {
+	q.mu.Lock()
+	q.items = q.items[:0]
+	q.mu.Unlock()
+}
+
+var ctrlQueue = newControlQueue(controlQueueSize)
+
+// enqueueControl 將控制訊息交給寫入 goroutine，不阻塞呼叫端
+func enqueueControl(b []byte, deadline time.Duration, droppable bool) {
+	if loadControlConn() == nil || len(b) == 0 {
+		return
+	}
+	ctrlQueue.push(controlMsg{data: b, deadline: deadline, droppable: droppable})
+}
+
+// enqueueTouch 與 enqueueControl 相同，但帶上 pointer ID，讓同一 pointer 積壓的 move 可以合併
+func enqueueTouch(b []byte, deadline time.Duration, pointer uint64, move bool) {
+	if loadControlConn() == nil || len(b) == 0 {
+		return
+	}
+	ctrlQueue.push(controlMsg{data: b, deadline: deadline, droppable: move, hasPointer: true, pointer: pointer})
+}
+
+// startControlWriter 依序把佇列中的訊息寫入 control socket
+func startControlWriter() {
+	for {
+		m := ctrlQueue.pop()
+		writeFull(m.data, m.deadline, true)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+const (
+	testDown = 0 // AMOTION_EVENT_ACTION_DOWN
+	testUp   = 1 // AMOTION_EVENT_ACTION_UP
+	testMove = 2 // AMOTION_EVENT_ACTION_MOVE
+)
+
+// pushTouch 入列一筆觸控訊息；data 為 [action, pointer, seq]，方便比對
+func pushTouch(q *controlQueue, action byte, pointer uint64, seq byte) {
+	q.push(controlMsg{
+		data:       []byte{action, byte(pointer), seq},
+		deadline:   time.Second,
+		droppable:  action == testMove,
+		hasPointer: true,
+		pointer:    pointer,
+	})
+}
+
+// drain 取出佇列中目前所有訊息
+func drain(q *controlQueue) [][]byte {
+	var out [][]byte
+	for {
+		q.mu.Lock()
+		n := len(q.items)
+		q.mu.Unlock()
+		if n == 0 {
+			return out
+		}
+		out = append(out, q.pop().data)
+	}
+}
+
+func checkQueue(t *testing.T, got, want [][]byte) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("queue has %d messages %v, want %d %v", len(got), got, len(want), want)
+	}
+	for i := range want {
+		if !bytes.Equal(got[i], want[i]) {
+			t.Fatalf("message %d = %v, want %v (queue %v)", i, got[i], want[i], got)
+		}
+	}
+}
+
+func TestControlQueueCollapsesQueuedMoves(t *testing.T) {
+	q := newControlQueue(controlQueueSize)
+	for i := 0; i < 100; i++ {
+		pushTouch(q, testMove, 1, byte(i))
+	}
+	// 100 筆積壓的 move 只剩最新的一筆
+	checkQueue(t, drain(q), [][]byte{{testMove, 1, 99}})
+}
+
+func TestControlQueueNeverCoalescesDownUp(t *testing.T) {
+	q := newControlQueue(controlQueueSize)
+	pushTouch(q, testDown, 1, 0)
+	for i := 1; i <= 50; i++ {
+		pushTouch(q, testMove, 1, byte(i))
+	}
+	pushTouch(q, testUp, 1, 51)
+	// 連續點擊：down/up 之間沒有 move，也不可合併或丟失
+	for i := 0; i < 5; i++ {
+		pushTouch(q, testDown, 1, byte(60+2*i))
+		pushTouch(q, testUp, 1, byte(61+2*i))
+	}
+	pushTouch(q, testDown, 1, 70)
+	for i := 71; i <= 90; i++ {
+		pushTouch(q, testMove, 1, byte(i))
+	}
+	pushTouch(q, testUp, 1, 91)
+
+	want := [][]byte{{testDown, 1, 0}, {testMove, 1, 50}, {testUp, 1, 51}}
+	for i := 0; i < 5; i++ {
+		want = append(want, []byte{testDown, 1, byte(60 + 2*i)}, []byte{testUp, 1, byte(61 + 2*i)})
+	}
+	want = append(want, []byte{testDown, 1, 70}, []byte{testMove, 1, 90}, []byte{testUp, 1, 91})
+	checkQueue(t, drain(q), want)
+}
+
+func TestControlQueueCoalescesPerPointer(t *testing.T) {
+	q := newControlQueue(controlQueueSize)
+	pushTouch(q, testDown, 1, 0)
+	pushTouch(q, testDown, 2, 1)
+	for i := 2; i < 40; i += 2 {
+		pushTouch(q, testMove, 1, byte(i))
+		pushTouch(q, testMove, 2, byte(i+1))
+	}
+	pushTouch(q, testUp, 2, 40)
+	pushTouch(q, testMove, 1, 41) // pointer 2 的 up 不影響 pointer 1 的合併
+	checkQueue(t, drain(q), [][]byte{
+		{testDown, 1, 0}, {testDown, 2, 1}, {testMove, 1, 41}, {testMove, 2, 39}, {testUp, 2, 40},
+	})
+}
+
+func TestControlQueueFullKeepsCriticalMessages(t *testing.T) {
+	q := newControlQueue(4)
+	for i := 0; i < 4; i++ {
+		pushTouch(q, testMove, uint64(i), byte(i))
+	}
+	// 佇列已滿：down/up 淘汰最舊的 move，超出上限也照樣入列
+	for i := 0; i < 6; i++ {
+		pushTouch(q, testDown+byte(i%2), 9, byte(10+i))
+	}
+	got := drain(q)
+	var critical int
+	for _, m := range got {
+		if m[0] != testMove {
+			critical++
+		}
+	}
+	if critical != 6 {
+		t.Fatalf("kept %d of 6 down/up messages: %v", critical, got)
+	}
+}
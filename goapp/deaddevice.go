@@ -0,0 +1,105 @@
+// deaddevice.go — 連續連線失敗的裝置標記為 dead。
+// /offer 與重啟 server 時呼叫 connectToDevice，失敗次數依裝置累計，成功即歸零；
+// 達到 -max-connect-failures 後標記為 dead，之後的 /offer 直接回 503、不再嘗試 adb（避免已消失的無線裝置不斷重試洗版 log），
+// 並在 GET /devices 顯示 dead，提醒需要實際檢查裝置。POST /devices/{id}/revive 清除標記後即可重新連線。
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+type connectFailState struct {
+	failures int       // 連續失敗次數
+	deadAt   time.Time // 標記為 dead 的時間；零值表示仍會重試
+	lastErr  string
+}
+
+var (
+	connFailMu     sync.Mutex
+	connectFailure = make(map[string]*connectFailState) // deviceKey → 失敗狀態
+)
+
+// noteConnectResult 記錄一次 connectToDevice 的結果；未授權與不在白名單的錯誤需要人為處理，不計入
+func noteConnectResult(serial string, err error) {
+	key := deviceKey(serial)
+	connFailMu.Lock()
+	defer connFailMu.Unlock()
+	if err == nil {
+		delete(connectFailure, key)
+		return
+	}
+	if errors.Is(err, errSerialNotAllowed) || errors.Is(err, adb.ErrDeviceUnauthorized) {
+		return
+	}
+	st := connectFailure[key]
+	if st == nil {
+		st = &connectFailState{}
+		connectFailure[key] = st
+	}
+	st.failures++
+	st.lastErr = err.Error()
+	if *flagMaxConnFail > 0 && st.failures >= *flagMaxConnFail && st.deadAt.IsZero() {
+		st.deadAt = time.Now()
+		evDevicesMarkedDead.Add(1)
+		logger.Error("device_marked_dead", "device", key, "failures", st.failures, "err", err,
+			"hint", "check the device, then POST /devices/"+key+"/revive")
+	}
+}
+
+// isDeviceDead 回傳裝置是否已標記為 dead
+func isDeviceDead(serial string) bool {
+	connFailMu.Lock()
+	defer connFailMu.Unlock()
+	st := connectFailure[deviceKey(serial)]
+	return st != nil && !st.deadAt.IsZero()
+}
+
+// connectFailures 回傳裝置目前的連續失敗次數
+func connectFailures(serial string) int {
+	connFailMu.Lock()
+	defer connFailMu.Unlock()
+	if st := connectFailure[deviceKey(serial)]; st != nil {
+		return st.failures
+	}
+	return 0
+}
+
+// === HTTP: POST /devices/{id}/revive handler ===
+// 清除 dead 標記與失敗次數，並回傳裝置目前在 adb 的狀態；前端重新送 offer 即會再次嘗試連線
+func handleDeviceRevive(w http.ResponseWriter, r *http.Request) {
+	id := pathDeviceID(r)
+
+	connFailMu.Lock()
+	st := connectFailure[id]
+	delete(connectFailure, id)
+	connFailMu.Unlock()
+
+	resp := map[string]any{
+		"status":  "ok",
+		"id":      id,
+		"wasDead": st != nil && !st.deadAt.IsZero(),
+	}
+	if st != nil {
+		resp["failures"] = st.failures
+		resp["lastError"] = st.lastErr
+	}
+	if devs, err := adb.ListDevices(); err == nil {
+		for _, d := range devs {
+			if deviceKey(d.Serial) == id {
+				resp["adbState"] = d.State
+				break
+			}
+		}
+	}
+	logger.Info("device_revived", "device", id, "wasDead", resp["wasDead"])
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
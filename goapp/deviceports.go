@@ -0,0 +1,69 @@
+// deviceports.go — -device-port：為指定序號固定使用的本機 TCP 埠（adb reverse 的 listen 埠 / adb forward 的本機埠），
+// 方便防火牆只開放確定的埠。可重複指定，例如 -device-port 192.168.1.5:5555=27190 -device-port R58M123=27191；
+// 未列出的裝置從 adb.ScrcpyPort 起找第一個沒有被指定給其他序號的埠。
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+// portMap 為序號（canonicalSerial 後）→ 本機埠；實作 flag.Value 以支援重複指定
+type portMap map[string]int
+
+var devicePorts = portMap{}
+
+func init() {
+	flag.Var(devicePorts, "device-port", "指定序號使用的本機埠，格式 serial=port（可重複指定）；未指定的裝置從 27183 起分配")
+}
+
+func (m portMap) String() string {
+	parts := make([]string, 0, len(m))
+	for serial, port := range m {
+		parts = append(parts, fmt.Sprintf("%s=%d", serial, port))
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+func (m portMap) Set(v string) error {
+	i := strings.LastIndex(v, "=")
+	if i <= 0 {
+		return fmt.Errorf("expected serial=port, got %q", v)
+	}
+	serial := canonicalSerial(strings.TrimSpace(v[:i]))
+	port, err := strconv.Atoi(strings.TrimSpace(v[i+1:]))
+	if err != nil || port < 1 || port > 65535 {
+		return fmt.Errorf("invalid port in %q", v)
+	}
+	for s, p := range m {
+		if p == port && s != serial {
+			return fmt.Errorf("port %d already assigned to %s", port, s)
+		}
+	}
+	m[serial] = port
+	return nil
+}
+
+// portForSerial 回傳序號使用的本機埠：有 -device-port 設定時使用設定值，
+// 否則從 adb.ScrcpyPort 起取第一個未保留給其他序號的埠
+func portForSerial(serial string) int {
+	if p, ok := devicePorts[canonicalSerial(serial)]; ok {
+		return p
+	}
+	reserved := make(map[int]bool, len(devicePorts))
+	for _, p := range devicePorts {
+		reserved[p] = true
+	}
+	port := adb.ScrcpyPort
+	for reserved[port] {
+		port++
+	}
+	return port
+}
@@ -0,0 +1,123 @@
+// fanout.go — 將視訊迴圈讀到的 NALU 組成 AU（newVideoAU），分送給裝置的每個前端。
+// 視訊迴圈只把 AU 放進各前端自己的 rtpQueue（?maxWidth 的前端先經過 transcode.go 的 ffmpeg），由前端各自的發送 goroutine（startRTPSender）寫入 track：
+// WriteRTP 卡住的前端只會塞滿自己的佇列而丟幀，不會拖慢視訊迴圈或同一裝置的其他前端。
+// 等待關鍵幀、補送參數集與 ?keyframesOnly 也依前端各自判斷。
+
+package main
+
+// videoAU 為視訊迴圈解析好的一個 Access Unit
+type videoAU struct {
+	nalus  [][]byte
+	ts     uint32
+	idr    bool
+	hasSPS bool
+	hasPPS bool
+	hasVPS bool      // H.264 沒有 VPS，恆為 true
+	params bool      // 含任何參數集
+	frame  *frameRef // nalus 所切自的 frame；放入前端佇列時 retain
+}
+
+// newVideoAU 依 NALU 類型組出 AU：是否含 IDR、帶了哪些參數集（nalus 不含起始碼）
+func newVideoAU(nalus [][]byte, ts uint32, hevc bool, frame *frameRef) videoAU {
+	au := videoAU{nalus: nalus, ts: ts, hasVPS: !hevc, frame: frame}
+	for _, n := range nalus {
+		switch classifyNALU(n, hevc) {
+		case nalVPS:
+			au.hasVPS, au.params = true, true
+		case nalSPS:
+			au.hasSPS, au.params = true, true
+		case nalPPS:
+			au.hasPPS, au.params = true, true
+		case nalIDR:
+			au.idr = true
+		}
+	}
+	return au
+}
+
+// fanOutResult 彙總一次分送，供視訊迴圈決定是否請求關鍵幀與計算丟幀率
+type fanOutResult struct {
+	sending      int  // 正在接收視訊的前端數
+	waiting      int  // 仍在等待關鍵幀而略過此 AU 的前端數
+	kfOnly       int  // 以 ?keyframesOnly 連線的前端數
+	pushed       int  // 交給前端佇列的 AU 數
+	dropped      int  // 因佇列已滿而丟棄的 AU 數
+	overflow     bool // 有前端丟棄了非關鍵幀（應請求關鍵幀讓它恢復）
+	incompleteKF bool // 有前端從缺少參數集的 IDR 開始（尚未快取到 SPS/PPS）
+}
+
+func (r *fanOutResult) add(dropped, needKF bool) {
+	r.pushed++
+	if dropped {
+		r.dropped++
+	}
+	if needKF {
+		r.overflow = true
+	}
+}
+
+// fanOutAU 把 AU 交給裝置每個正在接收視訊的前端；只放入佇列，不會因前端發送變慢而阻塞
+func fanOutAU(device string, au videoAU) fanOutResult {
+	var res fanOutResult
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	for _, c := range clients {
+		if c.device != device || !c.sending {
+			continue
+		}
+		res.sending++
+		if c.keyframesOnly {
+			res.kfOnly++
+		}
+		// 剛連上或解碼器失步：先送快取的參數集
+		if c.paramsPending {
+			c.paramsPending = false
+			if ps := paramSetsLocked(); ps != nil && !au.hasSPS {
+				res.add(c.push(rtpPayload{nalus: ps, ts: au.ts}))
+			}
+		}
+		var p rtpPayload
+		switch {
+		case c.needKF && !au.idr:
+			res.waiting++
+			continue
+		case c.needKF:
+			// 從 IDR 開始：補上 AU 缺少的參數集（SPS + PPS + IDR + ...）
+			c.needKF = false
+			nalus, ok := completeKeyframeLocked(au)
+			if !ok {
+				res.incompleteKF = true
+			}
+			p = rtpPayload{nalus: nalus, ts: au.ts, idr: true, frame: au.frame}
+		case c.keyframesOnly && !au.idr && !au.params:
+			evFramesKFOnlySkip.Add(1)
+			continue
+		default:
+			p = rtpPayload{nalus: au.nalus, ts: au.ts, idr: au.idr, frame: au.frame}
+		}
+		res.add(c.push(p))
+	}
+	return res
+}
+
+// completeKeyframeLocked 在含 IDR 的 AU 前補上它缺少的快取參數集；快取不齊時原樣回傳並回報 false。
+// 呼叫端需持有 stateMu
+func completeKeyframeLocked(au videoAU) ([][]byte, bool) {
+	if au.hasSPS && au.hasPPS && au.hasVPS {
+		return au.nalus, true
+	}
+	if len(lastSPS) == 0 || len(lastPPS) == 0 || (!au.hasVPS && len(lastVPS) == 0) {
+		return au.nalus, false
+	}
+	complete := make([][]byte, 0, len(au.nalus)+3)
+	if !au.hasVPS {
+		complete = append(complete, lastVPS)
+	}
+	if !au.hasSPS {
+		complete = append(complete, lastSPS)
+	}
+	if !au.hasPPS {
+		complete = append(complete, lastPPS)
+	}
+	return append(complete, au.nalus...), true
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+// recordingTrack 記錄每個 AU 最後一個封包（marker）的時間戳
+type recordingTrack struct {
+	mu  sync.Mutex
+	aus []uint32
+}
+
+func (r *recordingTrack) WriteRTP(p *rtp.Packet) error {
+	if p.Marker {
+		r.mu.Lock()
+		r.aus = append(r.aus, p.Timestamp)
+		r.mu.Unlock()
+	}
+	return nil
+}
+
+func (r *recordingTrack) count() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.aus)
+}
+
+// blockingTrack 模擬網路卡住的前端：WriteRTP 在 release 關閉前一直阻塞
+type blockingTrack struct {
+	release chan struct{}
+	writes  atomic.Int32
+}
+
+func (b *blockingTrack) WriteRTP(*rtp.Packet) error {
+	b.writes.Add(1)
+	<-b.release
+	return nil
+}
+
+// addTestClient 登記一個沒有 PeerConnection 的前端（含發送 goroutine），測試結束時移除
+func addTestClient(t testing.TB, id, device string, track rtpWriter) *clientInfo {
+	t.Helper()
+	pk := rtp.NewPacketizer(1200, 96, 1, newPayloader("h264"), rtp.NewRandomSequencer(), 90000)
+	c := newClient(id, device, nil, track, pk)
+	addClient(c)
+	t.Cleanup(func() { removeClient(id, nil) })
+	return c
+}
+
+func TestFanOutSlowClientDoesNotStallOthers(t *testing.T) {
+	const queueSize, frames = 8, 60
+	setFlag(t, "rtp-queue-size", strconv.Itoa(queueSize))
+
+	fast := &recordingTrack{}
+	slow := &blockingTrack{release: make(chan struct{})}
+	addTestClient(t, "fast", "fanout-dev", fast)
+	addTestClient(t, "slow", "fanout-dev", slow)
+	t.Cleanup(func() { close(slow.release) })
+	for _, id := range []string{"fast", "slow"} {
+		if !clientConnected(id, nil) {
+			t.Fatalf("client %s not registered", id)
+		}
+	}
+
+	idr := [][]byte{{0x67, 0x42, 0x00, 0x1f}, {0x68, 0xce}, {0x65, 0x88, 0x84}}
+	p := [][]byte{{0x41, 0x9a, 0x02}}
+	var dropped int
+	var overflow bool
+	for i := 0; i < frames; i++ {
+		au := videoAU{nalus: p, ts: uint32(i) * 3000, hasVPS: true}
+		if i == 0 {
+			au = videoAU{nalus: idr, ts: 0, idr: true, hasSPS: true, hasPPS: true, hasVPS: true, params: true}
+		}
+		start := time.Now()
+		res := fanOutAU("fanout-dev", au)
+		if d := time.Since(start); d > 100*time.Millisecond {
+			t.Fatalf("AU %d: fanOutAU took %v with a blocked client", i, d)
+		}
+		if res.sending != 2 || res.pushed != 2 {
+			t.Fatalf("AU %d: sending=%d pushed=%d, want 2/2", i, res.sending, res.pushed)
+		}
+		dropped += res.dropped
+		overflow = overflow || res.overflow
+
+		// 正常的前端收到每一個 AU，不受卡住的前端影響
+		deadline := time.Now().Add(2 * time.Second)
+		for fast.count() < i+1 {
+			if time.Now().After(deadline) {
+				t.Fatalf("fast client received %d of %d AUs", fast.count(), i+1)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	if n := slow.writes.Load(); n != 1 {
+		t.Errorf("blocked client WriteRTP calls = %d, want 1 (stuck on the first packet)", n)
+	}
+	// 卡住的前端：一個 AU 在寫入中、queueSize 個在佇列中，其餘丟棄
+	if min := frames - queueSize - 1; dropped < min {
+		t.Errorf("dropped %d AUs for the blocked client, want at least %d", dropped, min)
+	}
+	if !overflow {
+		t.Error("overflow not reported: no keyframe would be requested for the blocked client")
+	}
+	fast.mu.Lock()
+	for i, ts := range fast.aus {
+		if ts != uint32(i)*3000 {
+			t.Errorf("fast client AU %d has ts %d, want %d", i, ts, i*3000)
+			break
+		}
+	}
+	fast.mu.Unlock()
+}
+
+func TestFanOutWaitsForKeyframePerClient(t *testing.T) {
+	tr := &recordingTrack{}
+	c := addTestClient(t, "kf-wait", "fanout-kf", tr)
+	if !clientConnected(c.id, nil) {
+		t.Fatal("client not registered")
+	}
+
+	stateMu.Lock()
+	oldSPS, oldPPS, oldCodec := lastSPS, lastPPS, videoCodec
+	lastSPS, lastPPS, videoCodec = []byte{0x67, 0x42, 0x00, 0x1f}, []byte{0x68, 0xce}, "h264"
+	stateMu.Unlock()
+	t.Cleanup(func() {
+		stateMu.Lock()
+		lastSPS, lastPPS, videoCodec = oldSPS, oldPPS, oldCodec
+		stateMu.Unlock()
+	})
+
+	// 連上後先補送快取的參數集，在 IDR 之前不送一般幀
+	res := fanOutAU("fanout-kf", videoAU{nalus: [][]byte{{0x41, 0x9a}}, ts: 3000, hasVPS: true})
+	if res.waiting != 1 || res.pushed != 1 {
+		t.Fatalf("P frame before IDR: waiting=%d pushed=%d, want 1/1 (parameter sets only)", res.waiting, res.pushed)
+	}
+	res = fanOutAU("fanout-kf", videoAU{nalus: [][]byte{{0x65, 0x88}}, ts: 6000, idr: true, hasSPS: true, hasPPS: true, hasVPS: true, params: true})
+	if res.waiting != 0 || res.pushed != 1 {
+		t.Fatalf("IDR: waiting=%d pushed=%d, want 0/1", res.waiting, res.pushed)
+	}
+	stateMu.RLock()
+	need := c.needKF
+	stateMu.RUnlock()
+	if need {
+		t.Error("needKF still set after the IDR")
+	}
+	if res := fanOutAU("fanout-kf", videoAU{nalus: [][]byte{{0x41, 0x9a}}, ts: 9000, hasVPS: true}); res.pushed != 1 {
+		t.Errorf("P frame after IDR: pushed=%d, want 1", res.pushed)
+	}
+}
@@ -0,0 +1,172 @@
+// files.go — 上傳檔案到裝置：POST /devices/{id}/push、POST /devices/{id}/install。
+// 兩者皆需以 -enable-files 開啟並帶 -api-token 的 Bearer token（見 apitoken.go）。
+// 上傳內容先串流寫入本機暫存檔（大小受 -max-upload-size 限制），再以 adb push / adb install 送到裝置。
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+// deviceForRequest 依路徑參數 {id} 找到目前連線的裝置；找不到時已回應 404
+func deviceForRequest(w http.ResponseWriter, r *http.Request) *deviceSession {
+	id := pathDeviceID(r)
+	stateMu.RLock()
+	s := curSession
+	stateMu.RUnlock()
+	if s == nil || s.id != id {
+		writeError(w, http.StatusNotFound, "device_not_found", "device not found")
+		return nil
+	}
+	return s
+}
+
+// requireADB 確認 session 背後是真正的 adb 裝置（-replay 的假裝置沒有）；否則已回應 409
+func requireADB(w http.ResponseWriter, s *deviceSession) bool {
+	if s.dev == nil {
+		writeError(w, http.StatusConflict, "replay_unsupported", "not supported for replay source")
+		return false
+	}
+	return true
+}
+
+// receiveUpload 讀取 multipart 欄位 "file" 並寫入暫存檔，回傳暫存檔路徑、原始檔名與大小；
+// 呼叫端負責刪除暫存檔。失敗時已回應錯誤
+func receiveUpload(w http.ResponseWriter, r *http.Request) (tmpPath, name string, n int64, ok bool) {
+	r.Body = http.MaxBytesReader(w, r.Body, *flagMaxUploadSize)
+	mr, err := r.MultipartReader()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_upload", "expected multipart/form-data")
+		return "", "", 0, false
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			writeError(w, http.StatusBadRequest, "invalid_upload", `missing "file" field`)
+			return "", "", 0, false
+		}
+		if err != nil {
+			uploadError(w, err)
+			return "", "", 0, false
+		}
+		if part.FormName() != "file" {
+			part.Close()
+			continue
+		}
+
+		name = filepath.Base(part.FileName())
+		if name == "." || name == string(filepath.Separator) {
+			name = "upload"
+		}
+		f, err := os.CreateTemp("", "scrcpy-upload-*")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("create temp file: %v", err))
+			return "", "", 0, false
+		}
+		n, err = io.Copy(f, part)
+		part.Close()
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(f.Name())
+			uploadError(w, err)
+			return "", "", 0, false
+		}
+		return f.Name(), name, n, true
+	}
+}
+
+// uploadError 區分超過大小上限與其他讀取錯誤
+func uploadError(w http.ResponseWriter, err error) {
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		writeError(w, http.StatusRequestEntityTooLarge, "upload_too_large", fmt.Sprintf("file too large (max %d bytes)", tooLarge.Limit))
+		return
+	}
+	writeError(w, http.StatusBadRequest, "invalid_upload", fmt.Sprintf("read upload: %v", err))
+}
+
+// === HTTP: POST /devices/{id}/push handler ===
+// multipart 欄位 "file" 為要上傳的檔案；?remote= 指定裝置上的路徑，預設 /data/local/tmp/<檔名>
+func handleDevicePush(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil || !requireADB(w, s) {
+		return
+	}
+	tmp, name, n, ok := receiveUpload(w, r)
+	if !ok {
+		return
+	}
+	defer os.Remove(tmp)
+
+	remote := r.URL.Query().Get("remote")
+	if remote == "" {
+		remote = path.Join("/data/local/tmp", name)
+	}
+	if err := s.dev.Push(tmp, remote); err != nil {
+		log.Printf("[ADB][%s] push %s 失敗: %v", s.id, remote, err)
+		writeError(w, http.StatusBadGateway, "adb_failed", fmt.Sprintf("push failed: %v", err))
+		return
+	}
+	log.Printf("[ADB][%s] 已推送 %s (%d bytes)", s.id, remote, n)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "ok",
+		"remote": remote,
+		"bytes":  n,
+	})
+}
+
+// === HTTP: POST /devices/{id}/install handler ===
+// multipart 欄位 "file" 為 APK；?reinstall=true 保留資料重新安裝（adb install -r）。
+// 安裝失敗時回應 422，error.reason 為 INSTALL_FAILED_* 原因
+func handleDeviceInstall(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil || !requireADB(w, s) {
+		return
+	}
+	tmp, name, _, ok := receiveUpload(w, r)
+	if !ok {
+		return
+	}
+	defer os.Remove(tmp)
+
+	// adb install 依副檔名判斷檔案類型
+	apk := tmp + ".apk"
+	if err := os.Rename(tmp, apk); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", fmt.Sprintf("rename temp file: %v", err))
+		return
+	}
+	defer os.Remove(apk)
+
+	reinstall := r.URL.Query().Get("reinstall") == "true"
+	err := s.dev.Install(apk, reinstall)
+	var ie *adb.InstallError
+	switch {
+	case errors.As(err, &ie):
+		log.Printf("[ADB][%s] 安裝 %s 失敗: %s", s.id, name, ie.Reason)
+		writeErrorFields(w, http.StatusUnprocessableEntity, "install_failed", ie.Message, map[string]string{"reason": ie.Reason})
+	case err != nil:
+		log.Printf("[ADB][%s] 安裝 %s 失敗: %v", s.id, name, err)
+		writeError(w, http.StatusBadGateway, "adb_failed", err.Error())
+	default:
+		log.Printf("[ADB][%s] 已安裝 %s", s.id, name)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "ok",
+			"apk":    name,
+		})
+	}
+}
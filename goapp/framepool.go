@@ -0,0 +1,62 @@
+// framepool.go — 視訊 frame 緩衝的重複使用。
+// 送出的 NALU 直接切自 frame（不複製），之後由各前端的 RTP 發送端與 RTMP 推流非同步使用，
+// 因此 frame 以引用計數管理：視訊迴圈持有一個引用，每個保留 NALU 的佇列各自 retain，用完 release，最後一個 release 時放回 pool。
+// 無法得知何時用完的使用者（Subscribe 的訂閱者）改拿 cloneNALUs 的複本；參數集快取本來就是複本。
+// 漏掉 release 只會讓 frame 交給 GC 而不重複使用；提早 release 才會讓內容被下一個 frame 覆寫。
+
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// framePool 保存 *frameRef；容量會隨放回的最大 frame 成長
+var framePool sync.Pool
+
+// frameRef 為一個可重複使用的 frame 緩衝與其引用數
+type frameRef struct {
+	buf  []byte
+	refs atomic.Int32
+}
+
+// getFrame 取得長度為 n 的 frame（引用數為 1），內容未初始化
+func getFrame(n int) *frameRef {
+	f, ok := framePool.Get().(*frameRef)
+	if !ok || cap(f.buf) < n {
+		// 太小的緩衝直接丟棄，讓 pool 逐漸只剩最大尺寸
+		f = &frameRef{buf: make([]byte, n)}
+	}
+	f.buf = f.buf[:n]
+	f.refs.Store(1)
+	return f
+}
+
+// retain 增加一個引用；nil 表示不需歸還的 NALU（參數集快取、複本）
+func (f *frameRef) retain() {
+	if f != nil {
+		f.refs.Add(1)
+	}
+}
+
+// release 釋放一個引用，最後一個引用釋放時放回 pool
+func (f *frameRef) release() {
+	if f != nil && f.refs.Add(-1) == 0 {
+		framePool.Put(f)
+	}
+}
+
+// cloneNALUs 將 NALU 複製到一塊新的連續緩衝，給無法得知何時用完的使用者
+func cloneNALUs(nalus [][]byte) [][]byte {
+	size := 0
+	for _, n := range nalus {
+		size += len(n)
+	}
+	buf := make([]byte, 0, size)
+	out := make([][]byte, len(nalus))
+	for i, n := range nalus {
+		buf = append(buf, n...)
+		out[i] = buf[len(buf)-len(n) : len(buf) : len(buf)]
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"testing"
+
+	"github.com/pion/rtp"
+)
+
+// discardTrack 丟棄所有 RTP 封包
+type discardTrack struct{}
+
+func (discardTrack) WriteRTP(*rtp.Packet) error { return nil }
+
+func TestFrameRefReleasedByEveryQueue(t *testing.T) {
+	f := getFrame(16)
+	a, b := newRTPQueue(1, true), newRTPQueue(1, true)
+	for _, q := range []*rtpQueue{a, b} {
+		q.push(rtpPayload{nalus: [][]byte{f.buf}, frame: f})
+	}
+	if n := f.refs.Load(); n != 3 {
+		t.Fatalf("refs after queueing on two clients = %d, want 3 (video loop + 2 queues)", n)
+	}
+
+	// 佇列已滿：丟棄的 AU 不持有引用
+	if dropped, _ := a.push(rtpPayload{nalus: [][]byte{f.buf}, frame: f}); !dropped {
+		t.Fatal("push on a full queue was not dropped")
+	}
+	if n := f.refs.Load(); n != 3 {
+		t.Fatalf("refs after a dropped push = %d, want 3", n)
+	}
+
+	// IDR 淘汰佇列中的舊 AU 時釋放它的引用
+	b.push(rtpPayload{nalus: [][]byte{{0x65}}, idr: true})
+	if n := f.refs.Load(); n != 2 {
+		t.Fatalf("refs after eviction = %d, want 2", n)
+	}
+
+	f.release() // 視訊迴圈處理完這個 frame
+	p, _ := a.pop()
+	p.frame.release() // 發送端寫完
+	if n := f.refs.Load(); n != 0 {
+		t.Fatalf("refs after every holder released = %d, want 0", n)
+	}
+}
+
+func TestCloneNALUs(t *testing.T) {
+	frame := []byte{0x67, 1, 2, 0x68, 3, 0x65, 4, 5, 6}
+	nalus := [][]byte{frame[0:3], frame[3:5], frame[5:]}
+	clone := cloneNALUs(nalus)
+	for i := range frame {
+		frame[i] = 0xff // frame 被下一個 AU 覆寫
+	}
+	want := [][]byte{{0x67, 1, 2}, {0x68, 3}, {0x65, 4, 5, 6}}
+	for i := range want {
+		if !bytes.Equal(clone[i], want[i]) {
+			t.Fatalf("clone[%d] = % x, want % x", i, clone[i], want[i])
+		}
+	}
+	// 每個 NALU 的容量到自己結尾為止，append 不會蓋到下一個
+	if cap(clone[0]) != len(clone[0]) {
+		t.Errorf("cap(clone[0]) = %d, want %d", cap(clone[0]), len(clone[0]))
+	}
+}
+
+// BenchmarkVideoLoopFrame 量測視訊迴圈每個 frame（一個前端接收 RTP）的配置；
+// frame 緩衝重複使用時 B/op 遠小於 frame 大小（約 5KB 一般幀、每 30 幀一個 30KB IDR）
+func BenchmarkVideoLoopFrame(b *testing.B) {
+	log.SetOutput(io.Discard)
+	b.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	sc := []byte{0, 0, 0, 1}
+	idr := append(append(append(append(append([]byte(nil), sc...), testSPS(1280, 720)...), sc...), 0x68, 0xce, 0x38, 0x80),
+		append(append([]byte(nil), sc...), append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x5a}, 30<<10)...)...)...)
+	p := append(append([]byte(nil), sc...), append([]byte{0x41, 0x9a}, bytes.Repeat([]byte{0x3c}, 5<<10)...)...)
+
+	stream := make([]byte, 64, 64+12+b.N*(12+len(p)))
+	stream = binary.BigEndian.AppendUint32(stream, 0x68323634) // h264
+	stream = binary.BigEndian.AppendUint32(stream, 1280)
+	stream = binary.BigEndian.AppendUint32(stream, 720)
+	for i := 0; i < b.N; i++ {
+		payload := p
+		if i%30 == 0 {
+			payload = idr
+		}
+		stream = append(stream, frameBytes(uint64(i)*33333, payload)...)
+	}
+
+	c := addTestClient(b, "bench", "bench-dev", discardTrack{})
+	clientConnected(c.id, nil)
+	sess := &deviceSession{
+		id:    "bench-dev",
+		sid:   "bench",
+		log:   slog.New(slog.NewTextHandler(io.Discard, nil)),
+		video: io.NopCloser(bytes.NewReader(stream)),
+		done:  make(chan struct{}),
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	startVideoLoop(sess) // 讀到串流結尾時返回
+}
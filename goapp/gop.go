@@ -0,0 +1,71 @@
+// gop.go — 觀察裝置實際產生的關鍵幀間隔（GOP）。
+// 以 EWMA 平滑 IDR 之間的幀數與時間，輸出到 expvar（gop_frames、ms_since_idr）與 GET /devices、GET /stats 的 stream 欄位；
+// 送出 RESET_VIDEO 後遲遲等不到 IDR、或自然的關鍵幀間隔遠大於 scrcpy 預設值時記錄警告，
+// 用來解釋「掉包後一直無法恢復」的連線（裝置忽略了關鍵幀請求）。
+
+package main
+
+import (
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	gopSmoothing         = 0.25             // EWMA 權重
+	keyframeIntervalWarn = 15 * time.Second // scrcpy server 預設每 10s 一個 I-frame，超過此值視為異常
+	keyframeRequestWarn  = 5 * time.Second  // RESET_VIDEO 送出後超過此時間仍無 IDR 視為被忽略
+)
+
+// lastResetVideoAt 為最近一次成功送出 RESET_VIDEO 的時間（UnixNano；0 為尚未送過）
+var lastResetVideoAt atomic.Int64
+
+// gopTracker 由視訊迴圈獨佔使用
+type gopTracker struct {
+	lastIDR       time.Time
+	frames        int     // 上一個 IDR 之後的幀數
+	avgFrames     float64 // 平滑後的 GOP 幀數
+	avgInterval   float64 // 平滑後的關鍵幀間隔（秒）
+	warnedRequest bool    // 本次等待中已警告過 RESET_VIDEO 被忽略
+}
+
+// frame 於每個 AU 呼叫一次
+func (g *gopTracker) frame(sess *deviceSession, lg *slog.Logger, idr bool) {
+	now := time.Now()
+	g.frames++
+	if !idr {
+		if g.lastIDR.IsZero() {
+			return
+		}
+		evMsSinceIDR.Set(now.Sub(g.lastIDR).Milliseconds())
+		// 請求關鍵幀之後仍在等待
+		if req := lastResetVideoAt.Load(); req > g.lastIDR.UnixNano() && !g.warnedRequest {
+			if waited := now.Sub(time.Unix(0, req)); waited > keyframeRequestWarn {
+				g.warnedRequest = true
+				lg.Warn("keyframe_request_ignored", "waited", waited, "sinceIDR", now.Sub(g.lastIDR))
+			}
+		}
+		return
+	}
+
+	if !g.lastIDR.IsZero() {
+		interval := now.Sub(g.lastIDR)
+		if g.avgFrames == 0 {
+			g.avgFrames, g.avgInterval = float64(g.frames), interval.Seconds()
+		} else {
+			g.avgFrames += gopSmoothing * (float64(g.frames) - g.avgFrames)
+			g.avgInterval += gopSmoothing * (interval.Seconds() - g.avgInterval)
+		}
+		lg.Debug("gop", "frames", g.frames, "interval", interval, "avgFrames", g.avgFrames)
+		if interval > keyframeIntervalWarn {
+			lg.Warn("keyframe_interval_long", "interval", interval, "frames", g.frames)
+		}
+		evGOPFrames.Set(int64(g.avgFrames + 0.5))
+	}
+	g.lastIDR, g.frames, g.warnedRequest = now, 0, false
+	evMsSinceIDR.Set(0)
+
+	stateMu.Lock()
+	sess.gopFrames, sess.keyframeInterval, sess.lastIDRAt = g.avgFrames, g.avgInterval, now
+	stateMu.Unlock()
+}
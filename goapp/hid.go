@@ -0,0 +1,279 @@
+// hid.go — OTG/HID 模式：透過 scrcpy UHID 控制訊息在裝置上建立虛擬 HID 鍵盤與滑鼠。
+// 輸入事件以 HID report 送出，不經過 Android InputManager，因此在鎖定畫面也能操作。
+// 報告描述元與 report 格式對齊官方 app/src/hid/hid_keyboard.c、hid_mouse.c。
+
+package main
+
+import (
+	"encoding/binary"
+	"log"
+	"strconv"
+	"sync"
+)
+
+const (
+	hidIDKeyboard = 1 // SC_HID_ID_KEYBOARD
+	hidIDMouse    = 2 // SC_HID_ID_MOUSE
+
+	hidKeyboardMaxKeys = 6    // 同時按住的一般鍵上限（BIOS boot protocol）
+	hidKeyboardKeys    = 0x66 // 描述元宣告的按鍵 usage 範圍
+	hidErrorRollOver   = 0x01
+)
+
+// 標準 boot keyboard 描述元：1 byte modifiers + 1 byte reserved + 6 bytes keys，另有 5 個 LED 輸出
+var hidKeyboardReportDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x06, // Usage (Keyboard)
+	0xA1, 0x01, // Collection (Application)
+	0x05, 0x07, //   Usage Page (Key Codes)
+	0x19, 0xE0, //   Usage Minimum (224)
+	0x29, 0xE7, //   Usage Maximum (231)
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, 0x01, //   Logical Maximum (1)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x08, //   Report Count (8)
+	0x81, 0x02, //   Input (Data, Variable, Absolute): modifiers
+	0x75, 0x08, //   Report Size (8)
+	0x95, 0x01, //   Report Count (1)
+	0x81, 0x01, //   Input (Constant): reserved
+	0x05, 0x08, //   Usage Page (LEDs)
+	0x19, 0x01, //   Usage Minimum (1)
+	0x29, 0x05, //   Usage Maximum (5)
+	0x75, 0x01, //   Report Size (1)
+	0x95, 0x05, //   Report Count (5)
+	0x91, 0x02, //   Output (Data, Variable, Absolute): LEDs
+	0x75, 0x03, //   Report Size (3)
+	0x95, 0x01, //   Report Count (1)
+	0x91, 0x01, //   Output (Constant): padding
+	0x05, 0x07, //   Usage Page (Key Codes)
+	0x19, 0x00, //   Usage Minimum (0)
+	0x29, hidKeyboardKeys - 1, // Usage Maximum
+	0x15, 0x00, //   Logical Minimum (0)
+	0x25, hidKeyboardKeys - 1, // Logical Maximum
+	0x75, 0x08, //   Report Size (8)
+	0x95, hidKeyboardMaxKeys, // Report Count (6)
+	0x81, 0x00, //   Input (Data, Array): keys
+	0xC0, // End Collection
+}
+
+// 相對座標滑鼠描述元：buttons(5 bits) + X + Y + Wheel + AC Pan
+var hidMouseReportDesc = []byte{
+	0x05, 0x01, // Usage Page (Generic Desktop)
+	0x09, 0x02, // Usage (Mouse)
+	0xA1, 0x01, // Collection (Application)
+	0x09, 0x01, //   Usage (Pointer)
+	0xA1, 0x00, //   Collection (Physical)
+	0x05, 0x09, //     Usage Page (Buttons)
+	0x19, 0x01, //     Usage Minimum (1)
+	0x29, 0x05, //     Usage Maximum (5)
+	0x15, 0x00, //     Logical Minimum (0)
+	0x25, 0x01, //     Logical Maximum (1)
+	0x95, 0x05, //     Report Count (5)
+	0x75, 0x01, //     Report Size (1)
+	0x81, 0x02, //     Input (Data, Variable, Absolute): 5 buttons
+	0x95, 0x01, //     Report Count (1)
+	0x75, 0x03, //     Report Size (3)
+	0x81, 0x01, //     Input (Constant): padding
+	0x05, 0x01, //     Usage Page (Generic Desktop)
+	0x09, 0x30, //     Usage (X)
+	0x09, 0x31, //     Usage (Y)
+	0x09, 0x38, //     Usage (Wheel)
+	0x15, 0x81, //     Logical Minimum (-127)
+	0x25, 0x7F, //     Logical Maximum (127)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x03, //     Report Count (3)
+	0x81, 0x06, //     Input (Data, Variable, Relative): X, Y, Wheel
+	0x05, 0x0C, //     Usage Page (Consumer)
+	0x0A, 0x38, 0x02, // Usage (AC Pan)
+	0x15, 0x81, //     Logical Minimum (-127)
+	0x25, 0x7F, //     Logical Maximum (127)
+	0x75, 0x08, //     Report Size (8)
+	0x95, 0x01, //     Report Count (1)
+	0x81, 0x06, //     Input (Data, Variable, Relative): AC Pan
+	0xC0, //   End Collection
+	0xC0, // End Collection
+}
+
+// 瀏覽器 KeyboardEvent.code → HID usage
+var hidUsageByCode = map[string]byte{
+	"Enter": 0x28, "Escape": 0x29, "Backspace": 0x2A, "Tab": 0x2B, "Space": 0x2C,
+	"Minus": 0x2D, "Equal": 0x2E, "BracketLeft": 0x2F, "BracketRight": 0x30, "Backslash": 0x31,
+	"Semicolon": 0x33, "Quote": 0x34, "Backquote": 0x35, "Comma": 0x36, "Period": 0x37,
+	"Slash": 0x38, "CapsLock": 0x39,
+	"PrintScreen": 0x46, "ScrollLock": 0x47, "Pause": 0x48, "Insert": 0x49, "Home": 0x4A,
+	"PageUp": 0x4B, "Delete": 0x4C, "End": 0x4D, "PageDown": 0x4E,
+	"ArrowRight": 0x4F, "ArrowLeft": 0x50, "ArrowDown": 0x51, "ArrowUp": 0x52,
+	"NumLock": 0x53, "ContextMenu": 0x65,
+}
+
+// 修飾鍵 → modifiers bit
+var hidModifierByCode = map[string]byte{
+	"ControlLeft": 1 << 0, "ShiftLeft": 1 << 1, "AltLeft": 1 << 2, "MetaLeft": 1 << 3,
+	"ControlRight": 1 << 4, "ShiftRight": 1 << 5, "AltRight": 1 << 6, "MetaRight": 1 << 7,
+}
+
+func init() {
+	for c := byte('A'); c <= 'Z'; c++ {
+		hidUsageByCode["Key"+string(rune(c))] = 0x04 + (c - 'A')
+	}
+	for d := byte('1'); d <= '9'; d++ {
+		hidUsageByCode["Digit"+string(rune(d))] = 0x1E + (d - '1')
+	}
+	hidUsageByCode["Digit0"] = 0x27
+	for i := byte(0); i < 12; i++ {
+		hidUsageByCode["F"+strconv.Itoa(int(i)+1)] = 0x3A + i
+	}
+}
+
+// HID 狀態（鍵盤按住的鍵、滑鼠上一個位置）
+var (
+	hidMu       sync.Mutex
+	hidMods     byte
+	hidKeys     []byte
+	hidMouseX   int32
+	hidMouseY   int32
+	hidMouseSet bool
+)
+
+// createHIDDevice 送出 UHID_CREATE：[type][id u16][vendor u16][product u16][name len u8 + name][desc len u16 + desc]
+func createHIDDevice(id uint16, desc []byte) {
+	buf := make([]byte, 0, 10+len(desc))
+	buf = append(buf, controlMsgUHIDCreate)
+	buf = binary.BigEndian.AppendUint16(buf, id)
+	buf = binary.BigEndian.AppendUint16(buf, 0) // vendor
+	buf = binary.BigEndian.AppendUint16(buf, 0) // product
+	buf = append(buf, 0)                        // name：空字串（由 server 決定預設名稱）
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(desc)))
+	buf = append(buf, desc...)
+	enqueueControl(buf, *flagCtrlTimeout, false)
+	log.Printf("[HID] UHID_CREATE id=%d desc=%dB", id, len(desc))
+}
+
+// createHIDKeyboard 在裝置上建立虛擬 HID 鍵盤
+func createHIDKeyboard() { createHIDDevice(hidIDKeyboard, hidKeyboardReportDesc) }
+
+// createHIDMouse 在裝置上建立虛擬 HID 滑鼠（相對座標）
+func createHIDMouse() { createHIDDevice(hidIDMouse, hidMouseReportDesc) }
+
+// sendHIDInput 送出 UHID_INPUT：[type][id u16][size u16][data]
+func sendHIDInput(id uint16, data []byte) {
+	buf := make([]byte, 0, 5+len(data))
+	buf = append(buf, controlMsgUHIDInput)
+	buf = binary.BigEndian.AppendUint16(buf, id)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(len(data)))
+	buf = append(buf, data...)
+	enqueueControl(buf, *flagCtrlTimeout, false)
+}
+
+// destroyHIDDevices 移除先前建立的 HID 裝置並清除狀態
+func destroyHIDDevices() {
+	for _, id := range []uint16{hidIDKeyboard, hidIDMouse} {
+		buf := []byte{controlMsgUHIDDestroy, 0, 0}
+		binary.BigEndian.PutUint16(buf[1:], id)
+		writeFull(buf, *flagCtrlTimeout, true)
+	}
+	hidMu.Lock()
+	hidMods, hidKeys, hidMouseSet = 0, nil, false
+	hidMu.Unlock()
+	log.Println("[HID] UHID_DESTROY keyboard/mouse")
+}
+
+// handleHIDKey 依 keydown/keyup 更新鍵盤狀態並送出完整 report（8 bytes）
+func handleHIDKey(ev touchEvent) {
+	down := ev.Type == "keydown"
+
+	hidMu.Lock()
+	if m, ok := hidModifierByCode[ev.Code]; ok {
+		if down {
+			hidMods |= m
+		} else {
+			hidMods &^= m
+		}
+	} else if u, ok := hidUsageByCode[ev.Code]; ok {
+		idx := -1
+		for i, k := range hidKeys {
+			if k == u {
+				idx = i
+				break
+			}
+		}
+		if down && idx < 0 {
+			hidKeys = append(hidKeys, u)
+		} else if !down && idx >= 0 {
+			hidKeys = append(hidKeys[:idx], hidKeys[idx+1:]...)
+		}
+	} else {
+		hidMu.Unlock()
+		log.Printf("[HID] 未支援的按鍵 code=%q，忽略", ev.Code)
+		return
+	}
+
+	report := make([]byte, 2+hidKeyboardMaxKeys)
+	report[0] = hidMods
+	if len(hidKeys) > hidKeyboardMaxKeys {
+		// 超過 6 鍵：依規範全部填 ErrorRollOver
+		for i := 2; i < len(report); i++ {
+			report[i] = hidErrorRollOver
+		}
+	} else {
+		copy(report[2:], hidKeys)
+	}
+	hidMu.Unlock()
+
+	sendHIDInput(hidIDKeyboard, report)
+}
+
+// handleHIDMouse 將前端的絕對座標轉為相對位移，送出滑鼠 report（5 bytes）；
+// 單一 report 位移上限 ±127，超過時拆成多筆
+func handleHIDMouse(ev touchEvent) {
+	hidMu.Lock()
+	var dx, dy int32
+	if hidMouseSet {
+		dx, dy = ev.X-hidMouseX, ev.Y-hidMouseY
+	}
+	hidMouseX, hidMouseY, hidMouseSet = ev.X, ev.Y, true
+	hidMu.Unlock()
+
+	buttons := byte(ev.Buttons & 0x1F) // DOM buttons 位元順序與 HID 相同（左/右/中/上一頁/下一頁）
+	if ev.Type == "up" || ev.Type == "cancel" {
+		buttons = 0
+	}
+	for {
+		sx, sy := clampI8(dx), clampI8(dy)
+		sendHIDInput(hidIDMouse, []byte{buttons, byte(sx), byte(sy), 0, 0})
+		dx -= int32(sx)
+		dy -= int32(sy)
+		if dx == 0 && dy == 0 {
+			return
+		}
+	}
+}
+
+func clampI8(v int32) int8 {
+	if v > 127 {
+		return 127
+	}
+	if v < -127 {
+		return -127
+	}
+	return int8(v)
+}
+
+// hidOutputMessage 將 UHID_OUTPUT 轉為送給前端的 DataChannel 訊息：
+// {"type":"hidOutput","id":<HID id>,"report":[bytes]}；鍵盤的 LED report 另附解碼後的 "leds"
+func hidOutputMessage(id uint16, report []byte) map[string]any {
+	data := make([]int, len(report)) // []byte 會被 JSON 編成 base64，前端較難使用
+	for i, b := range report {
+		data[i] = int(b)
+	}
+	msg := map[string]any{"type": "hidOutput", "id": id, "report": data}
+	if id == hidIDKeyboard && len(report) > 0 {
+		// 描述元的 LED usage 1..5 依序對應 bit 0..4（NumLock、CapsLock、ScrollLock、Compose、Kana）
+		msg["leds"] = map[string]bool{
+			"numLock":    report[0]&0x01 != 0,
+			"capsLock":   report[0]&0x02 != 0,
+			"scrollLock": report[0]&0x04 != 0,
+		}
+	}
+	return msg
+}
@@ -0,0 +1,26 @@
+// httperr.go — API 錯誤回應的統一格式：{"error":{"code":"...","message":"..."}}。
+// code 為穩定、可供程式判斷的代碼（例如 device_not_found、invalid_offer）；message 給人看，內容可能調整。
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// writeError 以 JSON 錯誤格式回應
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorFields(w, status, code, message, nil)
+}
+
+// writeErrorFields 同 writeError，另在 error 物件中附加欄位（例如安裝失敗的 reason）
+func writeErrorFields(w http.ResponseWriter, status int, code, message string, fields map[string]string) {
+	body := map[string]string{"code": code, "message": message}
+	for k, v := range fields {
+		body[k] = v
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]any{"error": body})
+}
@@ -0,0 +1,125 @@
+// keys.go — POST /devices/{id}/keys：依序注入一串 Android keycode（例如喚醒、輸入 PIN、Enter），
+// 供自動化準備裝置使用。每個按鍵以 INJECT_KEYCODE 送出，可指定按下/放開與送出後的等待時間。
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	controlMsgInjectKeycode = 0 // TYPE_INJECT_KEYCODE
+
+	keySeqMax      = 64               // 單次請求的按鍵數上限
+	keyDelayMax    = 10 * time.Second // 單一按鍵後的等待上限
+	keycodeMax     = 316              // AKEYCODE_MACRO_4（Android 14 的最大值）
+	keyActionDown  = 0                // AKEY_EVENT_ACTION_DOWN
+	keyActionUp    = 1                // AKEY_EVENT_ACTION_UP
+	keycodeWakeup  = 224              // AKEYCODE_WAKEUP：螢幕關閉時喚醒，已開啟時沒有作用
+	keyBodyMaxSize = 16 << 10
+)
+
+// encodeKeycodeEvent 產生 INJECT_KEYCODE：[type][action u8][keycode i32][repeat i32][metastate i32]
+func encodeKeycodeEvent(action byte, keycode int32) []byte {
+	buf := make([]byte, 0, 14)
+	buf = append(buf, controlMsgInjectKeycode, action)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(keycode))
+	buf = binary.BigEndian.AppendUint32(buf, 0) // repeat
+	buf = binary.BigEndian.AppendUint32(buf, 0) // metastate
+	return buf
+}
+
+type keyStep struct {
+	Keycode int32  `json:"keycode"` // Android KeyEvent.KEYCODE_*
+	Action  string `json:"action"`  // "press"（預設，按下後放開）| "down" | "up"
+	DelayMs int    `json:"delayMs"` // 送出後等待的時間
+}
+
+// validateKeySteps 檢查按鍵序列，回傳第一個錯誤
+func validateKeySteps(steps []keyStep) error {
+	if len(steps) == 0 {
+		return fmt.Errorf("empty key sequence")
+	}
+	if len(steps) > keySeqMax {
+		return fmt.Errorf("too many keys (max %d)", keySeqMax)
+	}
+	for i, st := range steps {
+		if st.Keycode <= 0 || st.Keycode > keycodeMax {
+			return fmt.Errorf("step %d: invalid keycode %d", i, st.Keycode)
+		}
+		switch st.Action {
+		case "", "press", "down", "up":
+		default:
+			return fmt.Errorf("step %d: invalid action %q", i, st.Action)
+		}
+		if st.DelayMs < 0 || time.Duration(st.DelayMs)*time.Millisecond > keyDelayMax {
+			return fmt.Errorf("step %d: delayMs must be between 0 and %d", i, keyDelayMax.Milliseconds())
+		}
+	}
+	return nil
+}
+
+// === HTTP: POST /devices/{id}/keys handler ===
+// body 為 [{keycode, action, delayMs}, ...]，依序送出；全部送出（含等待）後才回應。
+// 裝置中斷連線或請求取消時中止，回傳已送出的數量
+func handleDeviceKeys(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil {
+		return
+	}
+	var steps []keyStep
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, keyBodyMaxSize)).Decode(&steps); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if err := validateKeySteps(steps); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if s.control == nil {
+		writeError(w, http.StatusConflict, "view_only", "control channel disabled (view-only)")
+		return
+	}
+
+	sent := 0
+	for _, st := range steps {
+		switch st.Action {
+		case "down":
+			enqueueControl(encodeKeycodeEvent(keyActionDown, st.Keycode), *flagCtrlTimeout, false)
+		case "up":
+			enqueueControl(encodeKeycodeEvent(keyActionUp, st.Keycode), *flagCtrlTimeout, false)
+		default:
+			enqueueControl(encodeKeycodeEvent(keyActionDown, st.Keycode), *flagCtrlTimeout, false)
+			enqueueControl(encodeKeycodeEvent(keyActionUp, st.Keycode), *flagCtrlTimeout, false)
+		}
+		sent++
+		if st.DelayMs > 0 {
+			select {
+			case <-time.After(time.Duration(st.DelayMs) * time.Millisecond):
+			case <-s.done:
+			case <-r.Context().Done():
+			}
+		}
+		select {
+		case <-s.done:
+			s.log.Warn("keys_aborted", "sent", sent, "total", len(steps), "reason", "session closed")
+			writeError(w, http.StatusConflict, "device_disconnected", fmt.Sprintf("device disconnected after %d of %d keys", sent, len(steps)))
+			return
+		case <-r.Context().Done():
+			s.log.Warn("keys_aborted", "sent", sent, "total", len(steps), "reason", "request canceled")
+			return
+		default:
+		}
+	}
+	s.log.Info("keys_sent", "count", sent)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "ok",
+		"sent":   sent,
+	})
+}
@@ -0,0 +1,109 @@
+// logger.go — 結構化日誌（log/slog）。
+// -log-format 選擇輸出格式：plain（沿用 log 套件原本的行格式，欄位附在行尾）、text（key=value）、json；
+// 每筆含 level、event 以及 device / session 欄位。text/json 模式下既有的 log.Printf 也經由同一 handler 輸出（level=INFO）。
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+)
+
+var (
+	logger    = slog.Default()
+	logLevel  = new(slog.LevelVar) // text/json handler 的輸出門檻
+	logFormat = "plain"
+)
+
+// initLogger 依格式建立全域 logger；必須在 flag.Parse 之後、開始輸出日誌之前呼叫
+func initLogger(format string) error {
+	opts := &slog.HandlerOptions{Level: logLevel, ReplaceAttr: renameMsgToEvent}
+	switch format {
+	case "plain":
+		logger = slog.Default()
+	case "text":
+		logger = slog.New(slog.NewTextHandler(os.Stderr, opts))
+		slog.SetDefault(logger)
+	case "json":
+		logger = slog.New(slog.NewJSONHandler(os.Stderr, opts))
+		slog.SetDefault(logger)
+	default:
+		return fmt.Errorf("未知的 log 格式 %q（可用 plain、text、json）", format)
+	}
+	logFormat = format
+	return nil
+}
+
+// SetLogLevel 調整輸出門檻：debug、info、warn、error
+func SetLogLevel(name string) error {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(name)); err != nil {
+		return fmt.Errorf("未知的 log 等級 %q（可用 debug、info、warn、error）", name)
+	}
+	logLevel.Set(l)
+	if logFormat == "plain" {
+		// plain 模式由 slog 預設 handler 轉交給 log 套件，門檻另外設定
+		slog.SetLogLoggerLevel(l)
+	}
+	return nil
+}
+
+// renameMsgToEvent 將 slog 的 msg 欄位改名為 event（訊息本身即事件名稱）
+func renameMsgToEvent(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) == 0 && a.Key == slog.MessageKey {
+		a.Key = "event"
+	}
+	return a
+}
+
+// newSessionID 產生短的隨機 session ID，用於串起同一次連線的日誌
+func newSessionID() string {
+	var b [4]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// teeHandler 將同一筆紀錄交給多個 handler（例如 stderr 與裝置的 logRing）
+type teeHandler []slog.Handler
+
+func (t teeHandler) Enabled(ctx context.Context, l slog.Level) bool {
+	for _, h := range t {
+		if h.Enabled(ctx, l) {
+			return true
+		}
+	}
+	return false
+}
+
+func (t teeHandler) Handle(ctx context.Context, r slog.Record) error {
+	var first error
+	for _, h := range t {
+		if !h.Enabled(ctx, r.Level) {
+			continue
+		}
+		if err := h.Handle(ctx, r.Clone()); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (t teeHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (t teeHandler) WithGroup(name string) slog.Handler {
+	out := make(teeHandler, len(t))
+	for i, h := range t {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
@@ -0,0 +1,114 @@
+// logring.go — 每台裝置最近 N 行日誌的環狀緩衝：GET /devices/{id}/logs。
+// 裝置 session 的結構化日誌與 scrcpy server 的 stderr 都會寫入；以裝置 ID 為 key，
+// 重新連線或中斷後仍保留，方便事後追查單一裝置的間歇性問題。
+
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+const logRingLines = 500 // 每台裝置保留的行數
+
+// logRing 為固定行數的環狀緩衝
+type logRing struct {
+	mu    sync.Mutex
+	lines []string
+	next  int
+	full  bool
+}
+
+func newLogRing(n int) *logRing {
+	return &logRing{lines: make([]string, n)}
+}
+
+func (l *logRing) add(line string) {
+	l.mu.Lock()
+	l.lines[l.next] = line
+	l.next++
+	if l.next == len(l.lines) {
+		l.next, l.full = 0, true
+	}
+	l.mu.Unlock()
+}
+
+// Lines 依時間順序回傳目前保留的行
+func (l *logRing) Lines() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.full {
+		return append([]string(nil), l.lines[:l.next]...)
+	}
+	out := make([]string, 0, len(l.lines))
+	out = append(out, l.lines[l.next:]...)
+	return append(out, l.lines[:l.next]...)
+}
+
+// writer 回傳依換行切行寫入緩衝的 io.Writer，每行加上 prefix
+func (l *logRing) writer(prefix string) io.Writer {
+	return &ringWriter{ring: l, prefix: prefix}
+}
+
+type ringWriter struct {
+	mu      sync.Mutex
+	ring    *logRing
+	prefix  string
+	partial []byte // 尚未遇到換行的尾端
+}
+
+func (w *ringWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		w.ring.add(w.prefix + strings.TrimRight(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+	if len(w.partial) == 0 {
+		w.partial = nil
+	}
+	return len(p), nil
+}
+
+// deviceLogs 以裝置 ID 為 key（受 stateMu 保護）
+var deviceLogs = make(map[string]*logRing)
+
+// deviceLogRing 取得（或建立）裝置的日誌緩衝
+func deviceLogRing(id string) *logRing {
+	stateMu.Lock()
+	defer stateMu.Unlock()
+	l, ok := deviceLogs[id]
+	if !ok {
+		l = newLogRing(logRingLines)
+		deviceLogs[id] = l
+	}
+	return l
+}
+
+// === HTTP: GET /devices/{id}/logs handler ===
+// 以純文字回傳裝置最近的日誌（含 scrcpy server stderr）
+func handleDeviceLogs(w http.ResponseWriter, r *http.Request) {
+	id := pathDeviceID(r)
+	stateMu.RLock()
+	l := deviceLogs[id]
+	stateMu.RUnlock()
+	if l == nil {
+		writeError(w, http.StatusNotFound, "device_not_found", "no logs for device")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	var b strings.Builder
+	for _, line := range l.Lines() {
+		b.WriteString(line)
+		b.WriteByte('\n')
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
@@ -8,23 +8,30 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
-	"expvar"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
 	"math"
 	"net"
 	"net/http"
 	_ "net/http/pprof" // 啟用 /debug/pprof
+	"net/netip"
+	"os"
 	"runtime"
 	"runtime/debug"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
-	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v4"
 
 	"github.com/yourname/scrcpy-go/adb"
@@ -33,44 +40,64 @@ import (
 const (
 	controlMsgResetVideo   = 17                // TYPE_RESET_VIDEO
 	controlMsgGetClipboard = 8                 // TYPE_GET_CLIPBOARD
+	controlMsgInjectScroll = 3                 // TYPE_INJECT_SCROLL_EVENT
+	controlMsgBackOrScreen = 4                 // TYPE_BACK_OR_SCREEN_ON
+	controlMsgExpandNotif  = 5                 // TYPE_EXPAND_NOTIFICATION_PANEL
+	controlMsgExpandSets   = 6                 // TYPE_EXPAND_SETTINGS_PANEL
+	controlMsgCollapse     = 7                 // TYPE_COLLAPSE_PANELS
+	controlMsgSetClipboard = 9                 // TYPE_SET_CLIPBOARD
+	controlMsgUHIDCreate   = 12                // TYPE_UHID_CREATE
+	controlMsgUHIDInput    = 13                // TYPE_UHID_INPUT
+	controlMsgUHIDDestroy  = 14                // TYPE_UHID_DESTROY
+	controlMsgKbdSettings  = 15                // TYPE_OPEN_HARD_KEYBOARD_SETTINGS（scrcpy 2.4 起）
 	ptsPerSecond           = uint64(1_000_000) // scrcpy PTS 單位：微秒
 )
 
 // ---- 可調偵錯閾值 ----
 const (
 	criticalWriteTimeout = 120 * time.Millisecond
+	ctrlPartialRetries   = 2                     // 控制訊息部分寫出後逾時，延長 deadline 重試剩餘部分的次數
 	warnCtrlWriteOver    = 30 * time.Millisecond // 控制通道單次寫入超過此值就告警
 	warnFrameMetaOver    = 20 * time.Millisecond // 讀 frame meta >20ms
 	warnFrameReadOver    = 50 * time.Millisecond // 讀 frame data >50ms
 	statsLogEvery        = 100                   // 每 100 幀打印統計
-	keyframeTick         = 5 * time.Second       // 週期性請求關鍵幀
+	streamRateWindow     = 2 * time.Second       // /devices 回報 FPS 與位元率的統計區間
+	keyframeTick         = 5 * time.Second       // ?keyframesOnly 前端週期性請求關鍵幀的間隔
+	rtpQueueSize         = 30                    // 讀取迴圈 → RTP 發送端的佇列長度（AU 數）
+	screenSizeTolerance  = 2                     // 前端回報尺寸與裝置視訊尺寸的容許誤差（px）
+	spsDumpMax           = 64                    // 無法解析的 SPS 在日誌中最多印出的 bytes
 
 	// control 心跳與讀回監控
 	controlHealthTick      = 5 * time.Second  // 每 5s 檢查一次讀回
 	controlStaleAfter      = 15 * time.Second // 超過 15s 無讀回就送 GET_CLIPBOARD 心跳
 	controlReadBufMax      = 1 << 20          // 讀回緩衝上限（1MB，足夠容納剪貼簿）
-	deviceMsgTypeClipboard = 0                // 目前僅解析 clipboard
+	deviceMsgTypeClipboard = 0                // [len u32][utf8]
+	deviceMsgTypeAckClip   = 1                // [sequence u64]：回應帶 sequence 的 SET_CLIPBOARD
+	deviceMsgTypeUHIDOut   = 2                // [id u16][size u16][data]：HID 輸出（例如鍵盤 LED）
+
+	batteryRefresh   = time.Minute            // 電量快取的更新週期（避免頻繁執行 dumpsys）
+	keyframeDebounce = 300 * time.Millisecond // 同一裝置在此間隔內的關鍵幀請求合併為一次
+	deviceGoneGrace  = time.Second            // 送出 deviceGone 後等待多久才關閉前端的 PeerConnection
 )
 
 // === 全域狀態 ===
 var (
-	videoTrack   *webrtc.TrackLocalStaticRTP
-	peerConn     *webrtc.PeerConnection
-	packetizer   rtp.Packetizer
-	needKeyframe bool // 新用戶/PLI 時需要 SPS/PPS + IDR
-
-	// H.264 參數集快取
-	lastSPS []byte
-	lastPPS []byte
+	// 參數集快取（lastVPS 僅 H.265）；videoCodec 為目前串流的編碼（h264 / h265）
+	lastSPS    []byte
+	lastPPS    []byte
+	lastVPS    []byte
+	videoCodec string
 
 	stateMu sync.RWMutex
 
 	startTime     time.Time // 速率統計
-	controlConn   io.ReadWriter
-	controlMu     sync.Mutex
-	keyframeMu    sync.Mutex // 關鍵幀處理互斥鎖
-	lastCtrlRead  time.Time  // 最近一次從 control socket 讀到裝置訊息
-	lastCtrlWrite time.Time  // 最近一次成功寫入 control
+	lastCtrlRead  time.Time // 最近一次從 control socket 讀到裝置訊息
+	lastCtrlWrite time.Time // 最近一次成功寫入 control
+
+	// 目前裝置的 control 連線：一律以 loadControlConn 讀取；
+	// controlMu 序列化 socket 寫入與連線的替換（setControlConnLocked）
+	controlConn atomic.Pointer[io.ReadWriter]
+	controlMu   sync.Mutex
 
 	// 觀測 PLI/FIR 與 AU 序號
 	lastPLI       time.Time
@@ -83,48 +110,131 @@ var (
 	pts0     uint64
 	rtpTS0   uint32
 
-	// 目前「視訊解析度」（僅作後備；主要用前端傳入的 screenW/H）
-	videoW uint16
-	videoH uint16
+	// server 重啟後沿用同一條 track 時，新的 PTS 基準從上一個 AU 的時間戳加上經過時間接續（避免時間戳倒退讓解碼器停住）
+	tsContinue bool
+	lastAUTS   uint32
+	lastAUAt   time.Time
 
 	// ADB 目標設備
 	adbTarget string
 
+	// 目前的裝置連線（受 stateMu 保護）
+	curSession *deviceSession
+
 	// 指標按鍵狀態（用於 mouse action_button 計算）
 	pointerMu      sync.Mutex
 	pointerButtons = make(map[uint64]uint32)
 )
 
-// ====== 指標（expvar）======
+// ====== 命令列參數 ======
 var (
-	evFramesRead         = expvar.NewInt("frames_read")
-	evBytesRead          = expvar.NewInt("bytes_read")
-	evPLICount           = expvar.NewInt("pli_count")
-	evKeyframeRequests   = expvar.NewInt("keyframe_requests")
-	evCtrlWritesOK       = expvar.NewInt("control_writes_ok")
-	evCtrlWritesErr      = expvar.NewInt("control_writes_err")
-	evCtrlReadsOK        = expvar.NewInt("control_reads_ok")
-	evCtrlReadsErr       = expvar.NewInt("control_reads_err")
-	evCtrlReadClipboardB = expvar.NewInt("control_read_clipboard_bytes")
-	evNALU_SPS           = expvar.NewInt("nalu_sps")
-	evNALU_PPS           = expvar.NewInt("nalu_pps")
-	evNALU_IDR           = expvar.NewInt("nalu_idr")
-	evNALU_Others        = expvar.NewInt("nalu_others")
-	evRTCP_PLI           = expvar.NewInt("rtcp_pli")
-	evRTCP_FIR           = expvar.NewInt("rtcp_fir")
-	evVideoW             = expvar.NewInt("video_w")
-	evVideoH             = expvar.NewInt("video_h")
-	evLastCtrlWriteMS    = expvar.NewInt("last_control_write_ms")
-	evLastFrameMetaMS    = expvar.NewInt("last_frame_meta_ms")
-	evLastFrameReadMS    = expvar.NewInt("last_frame_read_ms")
-	evAuSeq              = expvar.NewInt("au_seq")
-	evFramesSinceKF      = expvar.NewInt("frames_since_kf")
-	evRTPPacketsSent     = expvar.NewInt("rtp_packets_sent")
-	evRTPWriteErrors     = expvar.NewInt("rtp_write_errors")
-	evPendingPointers    = expvar.NewInt("pending_pointers")
-	evActivePeer         = expvar.NewInt("active_peer") // 0/1
-	evLastCtrlReadMsAgo  = expvar.NewInt("last_control_read_ms_ago")
-	evHeartbeatSent      = expvar.NewInt("control_heartbeat_sent")
+	flagForward       = flag.Bool("forward", false, "改用 adb forward 連線（裝置封鎖 adb reverse 時使用）")
+	flagDisplayID     = flag.Int("display-id", 0, "要鏡像的顯示器 ID（0 為主螢幕）")
+	flagMaxFrameSize  = flag.Int("max-frame-size", 8<<20, "單一 frame 大小上限（bytes），超過視為串流錯位")
+	flagBitRate       = flag.Int("bit-rate", 0, "視訊位元率（bps），0 為 scrcpy 預設")
+	flagMaxSize       = flag.Int("max-size", 0, "畫面長邊像素上限，0 為不限制")
+	flagOTG           = flag.Bool("otg", false, "以 UHID 虛擬鍵盤/滑鼠注入輸入（鎖定畫面也可操作）")
+	flagKeepKeyframes = flag.Bool("keep-keyframes", true, "發送佇列滿時淘汰舊的非關鍵幀以保住 IDR（false 則直接丟棄新到的 AU）")
+	flagWakeOnConnect = flag.Bool("wake-on-connect", false, "第一個前端連上時喚醒裝置螢幕（KEYCODE_WAKEUP）")
+	flagLogFormat     = flag.String("log-format", "plain", "日誌格式：plain、text（key=value）或 json")
+	flagLogLevel      = flag.String("log-level", "info", "日誌等級：debug、info、warn、error")
+	flagViewOnly      = flag.Bool("view-only", false, "僅視訊：伺服器以 control=false 啟動，前端無法注入輸入")
+	flagMaxUploadSize = flag.Int64("max-upload-size", 512<<20, "POST /devices/{id}/push 上傳檔案大小上限（bytes）")
+	flagH264Profile   = flag.String("h264-profile", "42e01f", "SDP 的 H.264 profile-level-id（6 位十六進位）；auto 依裝置最近的 SPS 決定")
+	flagDebugRoutes   = flag.Bool("debug-endpoints", true, "提供 /debug/pprof、/debug/vars、/debug/stack（對外部署請設為 false）")
+	flagLANOnly       = flag.Bool("lan-only", false, "封閉區網：只收集私有/本機位址的 IPv4 UDP host candidate")
+	flagPace          = flag.Bool("pace", false, "依 PTS 間隔平均送出 AU，減少爆量輸出造成的播放抖動（略增延遲）")
+	flagAllowSerials  = flag.String("allow-serials", "", "只連線這些 adb 序號（逗號分隔，USB 序號或 IP:port）；空字串為不限制")
+	flagDenySerials   = flag.String("deny-serials", "", "不連線這些 adb 序號（逗號分隔），優先於 -allow-serials")
+	flagCtrlTimeout   = flag.Duration("ctrl-write-timeout", criticalWriteTimeout, "觸控/按鍵等輸入訊息寫入 control socket 的逾時（高延遲連線可調大）")
+	flagCtrlBgTimeout = flag.Duration("ctrl-bg-timeout", 5*time.Second, "RESET_VIDEO（關鍵幀請求）與 GET_CLIPBOARD 心跳寫入 control socket 的逾時")
+	flagReplay        = flag.String("replay", "", "以錄好的 .h264（Annex-B）檔案取代實體裝置循環播放（測試用，不需要 adb）")
+	flagReplayFPS     = flag.Int("replay-fps", 30, "-replay 的播放幀率")
+	flagLatencyProbe  = flag.Bool("latency-probe", false, "每送出一個 AU 就在 DataChannel 送 frameMarker（seq、送出時間、RTP 時間戳），供前端量測端到端延遲")
+	flagRestartADB    = flag.Bool("restart-adb", false, "啟動時先重新啟動 adb server（adb kill-server + start-server）")
+	flagRTPMTU        = flag.Int("rtp-mtu", 1200, "RTP 封包大小上限（bytes，400–1400）；VPN 等 MTU 較小的網路可調小以避免 IP 分片")
+	flagVideoSource   = flag.String("video-source", "display", "視訊來源：display（螢幕）或 camera（裝置相機，Android 12 以上）")
+	flagTCPNoDelay    = flag.Bool("tcp-nodelay", true, "視訊 socket 啟用 TCP_NODELAY；區網錄影重視吞吐時可設為 false")
+	flagReadBuffer    = flag.Int("read-buffer", 0, "視訊 socket 的接收緩衝大小（bytes），0 為系統預設")
+	flagIdlePause     = flag.Bool("idle-pause", false, "裝置沒有任何前端時只排空視訊串流，不解析也不送 RTP；有前端連上後請求關鍵幀恢復")
+	flagRTMPURL       = flag.String("rtmp-url", "", "以 ffmpeg 將目前連線裝置的視訊轉推到 RTMP/RTSP（例如 rtmp://127.0.0.1/live/phone），需要 PATH 中有 ffmpeg")
+	flagEnableRTMP    = flag.Bool("enable-rtmp", false, "提供 POST /devices/{id}/rtmp 執行期設定各裝置的推流目的地（伺服器會連線到請求指定的 URL，需同時設定 -api-token，預設關閉）")
+	flagEnableShell   = flag.Bool("enable-shell", false, "提供 POST /devices/{id}/shell 執行 adb shell 指令（權限等同裝置 shell，需同時設定 -api-token，預設關閉）")
+	flagShellAllow    = flag.String("shell-allow", "getprop,input,wm,dumpsys", "-enable-shell 允許的指令名稱（逗號分隔，比對指令的第一個字）")
+	flagAutoQuality   = flag.Bool("auto-quality", false, "RTP 丟幀率持續偏高時自動以較低位元率重啟 scrcpy server（關閉時只記錄建議位元率）")
+	flagCodecs        = flag.String("codecs", "h264", "視訊編碼偏好順序（逗號分隔，可用 h264、h265）；/offer 時選第一個瀏覽器也支援的")
+	flagWebhookURL    = flag.String("webhook-url", "", "裝置 session 開始/結束時 POST JSON 事件到此 URL（device_connected / device_disconnected）")
+	flagRTPQueueSize  = flag.Int("rtp-queue-size", rtpQueueSize, "讀取迴圈 → RTP 發送端的佇列長度（AU 數）；網路抖動大時可調大，以延遲換取少丟幀")
+	flagWarnCtrlWrite = flag.Duration("warn-ctrl-write", warnCtrlWriteOver, "控制通道單次寫入超過此時間就記錄警告")
+	flagWarnFrameMeta = flag.Duration("warn-frame-meta", warnFrameMetaOver, "讀取 frame meta 超過此時間就記錄警告")
+	flagWarnFrameRead = flag.Duration("warn-frame-read", warnFrameReadOver, "讀取 frame 資料超過此時間就記錄警告")
+	flagLockOrient    = flag.String("lock-orientation", "", "scrcpy capture_orientation：0、90、180、270、flip0…flip270，加上 @ 前綴則鎖定方向（例如 @90），單獨 @ 鎖定在啟動時的方向；空字串跟隨裝置旋轉")
+	flagVideoEncoder  = flag.String("video-encoder", "", "指定裝置上的視訊編碼器（例如 OMX.google.h264.encoder），預設編碼器輸出異常時使用，需與協商出的編碼（-codecs）相符；空字串由 scrcpy server 挑選")
+	flagClientIdle    = flag.Duration("client-idle-timeout", clientIdleTimeout, "前端超過此時間沒有送任何 RTCP 就關閉其連線（0 為停用）")
+	flagStallRestart  = flag.Duration("stall-restart", 0, "超過此時間沒有收到任何視訊 frame 就自動重啟 scrcpy server（0 為停用，例如 10s）")
+	flagClipSync      = flag.Bool("clipboard-sync", true, "裝置剪貼簿變更時推送給前端（{\"type\":\"clipboard\"}）；基於隱私可設為 false")
+	flagDropNALU      = flag.String("drop-nalu", "", "送出前移除的 NALU 種類（逗號分隔，可用 sei、aud、filler）；預設全部保留")
+	flagMaxConnFail   = flag.Int("max-connect-failures", 0, "同一裝置連續連線失敗達此次數就標記為 dead、不再嘗試，直到 POST /devices/{id}/revive（0 為不限制）")
+	flagEnableFiles   = flag.Bool("enable-files", false, "提供 POST /devices/{id}/push 與 /install 上傳檔案、安裝 APK（需同時設定 -api-token，預設關閉）")
+	flagAPIToken      = flag.String("api-token", "", "-enable-files、-enable-shell、-enable-rtmp 等高權限端點要求的 Bearer token；未設定時這些端點不會開啟")
+	flagTranscode     = flag.Bool("transcode", false, "允許前端以 /offer?maxWidth=N 要求縮小的畫面：每個這樣的前端各開一個 ffmpeg 解碼、縮放並以 libx264 重新編碼（1080p 約占一個 CPU 核心），需要 PATH 中有 ffmpeg（預設關閉）")
+	flagMaxClients    = flag.Int("max-clients-per-device", 0, "每台裝置同時連線的前端上限，超過時 /offer 回 429（0 為不限制）")
+)
+
+// ====== 指標（expvar 全域彙總 + 目前裝置各自一份，見 metrics.go）======
+var (
+	evFramesRead         = newMetric("frames_read")
+	evBytesRead          = newMetric("bytes_read")
+	evPLICount           = newMetric("pli_count")
+	evKeyframeRequests   = newMetric("keyframe_requests")
+	evKeyframeDebounced  = newMetric("keyframe_requests_debounced")
+	evCtrlWritesOK       = newMetric("control_writes_ok")
+	evCtrlWritesErr      = newMetric("control_writes_err")
+	evCtrlWriteTimeouts  = newMetric("control_write_timeouts") // 寫入逾時（調整 -ctrl-write-timeout / -ctrl-bg-timeout 參考）
+	evCtrlWriteRetries   = newMetric("control_write_retries")  // 部分寫出後逾時、重試剩餘部分的次數
+	evCtrlReadsOK        = newMetric("control_reads_ok")
+	evCtrlReadsErr       = newMetric("control_reads_err")
+	evCtrlReadClipboardB = newMetric("control_read_clipboard_bytes")
+	evNALU_SPS           = newMetric("nalu_sps")
+	evNALU_PPS           = newMetric("nalu_pps")
+	evNALU_IDR           = newMetric("nalu_idr")
+	evNALU_Others        = newMetric("nalu_others")
+	evRTCP_PLI           = newMetric("rtcp_pli")
+	evRTCP_FIR           = newMetric("rtcp_fir")
+	evRTCPFractionLost   = newMetric("rtcp_fraction_lost") // 最近一次 Receiver Report 的丟包率（%）
+	evVideoW             = newMetric("video_w")
+	evVideoH             = newMetric("video_h")
+	evLastCtrlWriteMS    = newMetric("last_control_write_ms")
+	evLastFrameMetaMS    = newMetric("last_frame_meta_ms")
+	evLastFrameReadMS    = newMetric("last_frame_read_ms")
+	evAuSeq              = newMetric("au_seq")
+	evFramesSinceKF      = newMetric("frames_since_kf")
+	evRTPPacketsSent     = newMetric("rtp_packets_sent")
+	evRTPWriteErrors     = newMetric("rtp_write_errors")
+	evFramesMalformed    = newMetric("frames_malformed")
+	evFramesDropped      = newMetric("frames_dropped_on_send")
+	evFramesEvictedKF    = newMetric("frames_evicted_for_keyframe")
+	evPendingPointers    = newMetric("pending_pointers")
+	evActivePeer         = newMetric("active_peer") // 正在接收視訊的前端數
+	evLastCtrlReadMsAgo  = newMetric("last_control_read_ms_ago")
+	evHeartbeatSent      = newMetric("control_heartbeat_sent")
+	evCtrlMovesDropped   = newMetric("control_moves_dropped")
+	evCtrlMovesCoalesced = newMetric("control_moves_coalesced")
+	evFramesIdleSkipped  = newMetric("frames_idle_skipped")
+	evGOPFrames          = newMetric("gop_frames") // 平滑後的 IDR 間隔幀數
+	evMsSinceIDR         = newMetric("ms_since_idr")
+	evDropRatePct        = newMetric("frames_drop_rate_pct") // 最近一個 streamRateWindow 的丟幀率（%）
+	evAutoQualityDown    = newMetric("auto_quality_reductions")
+	evDesyncRecoveries   = newMetric("decoder_desync_recoveries")
+	evRTMPFramesDropped  = newMetric("rtmp_frames_dropped")
+	evClientsReaped      = newMetric("clients_reaped")      // 因 RTCP 靜默而關閉的前端
+	evWatchdogRestarts   = newMetric("watchdog_restarts")   // -stall-restart 自動重啟次數
+	evFramesKFOnlySkip   = newMetric("frames_kf_only_skip") // ?keyframesOnly 前端略過的一般幀
+	evSubFramesDropped   = newMetric("sub_frames_dropped")  // 行程內 AU 訂閱者跟不上而丟棄的 AU
+	evRTMPRestarts       = newMetric("rtmp_restarts")
+	evTranscodeRestarts  = newMetric("transcode_restarts") // ?maxWidth 前端的 ffmpeg 重新啟動次數
+	evClientRTTMs        = newMetric("client_rtt_ms")
+	evDevicesMarkedDead  = newMetric("devices_marked_dead") // 連續連線失敗達 -max-connect-failures 的次數
 )
 
 // ====== 工具：安全啟動 goroutine，避免 panic 默默死掉 ======
@@ -180,46 +290,78 @@ func freeLocalSlot(remote uint64) {
 	}
 }
 
-// 寫入控制 socket：**一定寫完整個封包**，並可選設置 write deadline（避免長時間阻塞）
-func writeFull(b []byte, deadline time.Duration, setDeadline bool) {
-	if controlConn == nil || len(b) == 0 {
+// loadControlConn 回傳目前的 control 連線；沒有裝置連線或 view-only 時為 nil
+func loadControlConn() io.ReadWriter {
+	if p := controlConn.Load(); p != nil {
+		return *p
+	}
+	return nil
+}
+
+// setControlConnLocked 替換目前的 control 連線（nil 為清除）；呼叫端需持有 controlMu
+func setControlConnLocked(c io.ReadWriter) {
+	if c == nil {
+		controlConn.Store(nil)
 		return
 	}
+	controlConn.Store(&c)
+}
+
+// 寫入控制 socket：**一定寫完整個封包**，並可選設置 write deadline（避免長時間阻塞）。
+// 逾時前已寫出部分 bytes 時，半個訊息會讓 server 之後的解析全部錯位，因此延長 deadline 重試剩餘部分（最多 ctrlPartialRetries 次）；
+// 完全沒寫出時直接回傳逾時，訊息乾淨地丟棄。EINTR 由 Go runtime 自行重試，不會出現在這裡
+func writeFull(b []byte, deadline time.Duration, setDeadline bool) error {
+	if len(b) == 0 {
+		return nil
+	}
 	start := time.Now()
 	controlMu.Lock()
 	defer controlMu.Unlock()
+	conn := loadControlConn()
+	if conn == nil {
+		return nil
+	}
 
-	// 嘗試設置 write deadline（若底層支援）
-	if setDeadline {
-		if c, ok := controlConn.(interface{ SetWriteDeadline(time.Time) error }); ok {
-			_ = c.SetWriteDeadline(time.Now().Add(deadline))
-		}
+	// 嘗試設置 write deadline（若底層支援）；結束時清掉（避免影響其他操作）
+	dl, canDeadline := conn.(interface{ SetWriteDeadline(time.Time) error })
+	if setDeadline && canDeadline {
+		_ = dl.SetWriteDeadline(time.Now().Add(deadline))
+		defer dl.SetWriteDeadline(time.Time{})
 	}
 
-	total := 0
+	total, retries := 0, 0
 	for total < len(b) {
-		n, err := controlConn.Write(b[total:])
+		n, err := conn.Write(b[total:])
 		total += n
 		if err != nil {
+			var ne net.Error
+			timeout := errors.As(err, &ne) && ne.Timeout()
+			if timeout && total > 0 && retries < ctrlPartialRetries {
+				retries++
+				evCtrlWriteRetries.Add(1)
+				log.Printf("[CTRL] write timeout after %d/%d bytes，重試剩餘部分 (%d/%d)", total, len(b), retries, ctrlPartialRetries)
+				if setDeadline && canDeadline {
+					_ = dl.SetWriteDeadline(time.Now().Add(deadline))
+				}
+				continue
+			}
 			evCtrlWritesErr.Add(1)
+			if timeout {
+				evCtrlWriteTimeouts.Add(1)
+			}
 			log.Printf("[CTRL] write error after %d/%d bytes (elapsed=%v, deadline=%v): %v",
 				total, len(b), time.Since(start), setDeadline, err)
-			return
+			return err
 		}
 	}
 	elapsed := time.Since(start)
 	lastCtrlWrite = time.Now()
 	evLastCtrlWriteMS.Set(elapsed.Milliseconds())
 	evCtrlWritesOK.Add(1)
-	if elapsed > warnCtrlWriteOver {
+	if elapsed > *flagWarnCtrlWrite {
 		log.Printf("[CTRL] write 慢 (%v) deadline=%v size=%d", elapsed, setDeadline, len(b))
 	}
-	// 若曾設置 deadline，寫完後清掉（避免影響其他操作）
-	if setDeadline {
-		if c, ok := controlConn.(interface{ SetWriteDeadline(time.Time) error }); ok {
-			_ = c.SetWriteDeadline(time.Time{})
-		}
-	}
+	return nil
 }
 
 // ====== 前端事件（JSON）→ 官方線路格式（32 bytes）======
@@ -233,44 +375,88 @@ type touchEvent struct {
 	Pressure    float64 `json:"pressure"`    // 0..1
 	Buttons     uint32  `json:"buttons"`     // mouse buttons bitmask；touch 一律 0
 	PointerType string  `json:"pointerType"` // "mouse" | "touch" | "pen"
+	Code        string  `json:"code"`        // keydown/keyup：KeyboardEvent.code
+	T           int64   `json:"t"`           // pong：原 ping 的時間戳（ms）
+	HScroll     float64 `json:"hscroll"`     // scroll：水平捲動行數（向右為正）
+	VScroll     float64 `json:"vscroll"`     // scroll：垂直捲動行數（向上為正）
+	On          bool    `json:"on"`          // showTouches：開啟/關閉觸控位置顯示
+}
+
+// toDeviceSpace 將前端座標換算到裝置視訊尺寸 dw×dh 並夾在畫面內，回傳座標與實際使用的尺寸。
+// scrcpy server 會默默丟棄 screen size 與目前視訊尺寸不符的觸控，因此：
+// 前端尺寸與裝置相符（容許誤差內）或未提供時直接沿用裝置尺寸；不符時依比例縮放；裝置尺寸未知時才採用前端尺寸。
+// 裝置剛旋轉時前端在收到新 SPS 前仍以舊方向回報座標，方向（寬>高）不一致時先以 rotateToOrientation 轉到裝置目前的方向
+func toDeviceSpace(x, y int32, cw, ch, dw, dh uint16) (int32, int32, uint16, uint16) {
+	if cw > 0 && ch > 0 && dw > 0 && dh > 0 && cw != ch && dw != dh && (cw > ch) != (dw > dh) {
+		x, y, cw, ch = rotateToOrientation(x, y, cw, ch)
+	}
+	if dw == 0 || dh == 0 {
+		dw, dh = cw, ch
+	} else if cw > 0 && ch > 0 && (absDiffU16(cw, dw) > screenSizeTolerance || absDiffU16(ch, dh) > screenSizeTolerance) {
+		x = int32(int64(x) * int64(dw) / int64(cw))
+		y = int32(int64(y) * int64(dh) / int64(ch))
+	}
+	if x < 0 {
+		x = 0
+	}
+	if y < 0 {
+		y = 0
+	}
+	if dw > 0 && dh > 0 {
+		if x > int32(dw)-1 {
+			x = int32(dw) - 1
+		}
+		if y > int32(dh)-1 {
+			y = int32(dh) - 1
+		}
+	}
+	return x, y, dw, dh
+}
+
+// rotateToOrientation 將 cw×ch 畫面上的座標轉到轉向後的 ch×cw 畫面，回傳新座標與尺寸。
+// scrcpy 只送出新的解析度、不告知旋轉方向，因此假設最常見的情況：直向為自然方向，橫向為 ROTATION_90（逆時針轉，直向的右緣成為上緣）；
+// 直向→橫向為 (x, y) → (y, w-1-x)，橫向→直向為其反轉換 (x, y) → (h-1-y, x)
+func rotateToOrientation(x, y int32, cw, ch uint16) (int32, int32, uint16, uint16) {
+	if cw < ch {
+		return y, int32(cw) - 1 - x, ch, cw
+	}
+	return int32(ch) - 1 - y, x, ch, cw
+}
+
+func absDiffU16(a, b uint16) uint16 {
+	if a > b {
+		return a - b
+	}
+	return b - a
 }
 
-func handleTouchEvent(ev touchEvent) {
+func handleTouchEvent(sess *deviceSession, ev touchEvent) {
 	defer func() {
 		pointerMu.Lock()
 		evPendingPointers.Set(int64(len(pointerButtons)))
 		pointerMu.Unlock()
 	}()
 
-	if controlConn == nil {
+	if loadControlConn() == nil {
 		return
 	}
 
-	// 取映射用的畫面寬高（前端沒帶就用後備）
-	stateMu.RLock()
-	fallbackW, fallbackH := videoW, videoH
-	stateMu.RUnlock()
-	sw := ev.ScreenW
-	sh := ev.ScreenH
-	if sw == 0 || sh == 0 {
-		sw, sh = fallbackW, fallbackH
+	devW, devH := sess.videoSize()
+	buf, pointerID, ok := encodeTouchEvent(ev, devW, devH)
+	if !ok {
+		return
 	}
 
-	// 夾住座標
-	if ev.X < 0 {
-		ev.X = 0
-	}
-	if ev.Y < 0 {
-		ev.Y = 0
-	}
-	if sw > 0 && sh > 0 {
-		if ev.X > int32(sw)-1 {
-			ev.X = int32(sw) - 1
-		}
-		if ev.Y > int32(sh)-1 {
-			ev.Y = int32(sh) - 1
-		}
-	}
+	// 交給 control 寫入 goroutine：socket 卡住時不阻塞 DataChannel；積壓時合併同一 pointer 的 move，佇列塞滿時可丟棄過時的 move
+	enqueueTouch(buf, *flagCtrlTimeout, pointerID, buf[1] == 2 /*move*/)
+}
+
+// encodeTouchEvent 將前端 pointer 事件編碼為 INJECT_TOUCH_EVENT（32 bytes），devW×devH 為目前的裝置視訊尺寸。
+// 會更新觸控 slot 與按鍵狀態（pointerButtons）；事件應略過時（hover move、超過指數、未知的 pointer）回傳 ok=false
+func encodeTouchEvent(ev touchEvent, devW, devH uint16) (buf []byte, pointerID uint64, ok bool) {
+	// 換算到裝置視訊尺寸並夾住座標（不信任前端回報的 screenW/H）
+	var sw, sh uint16
+	ev.X, ev.Y, sw, sh = toDeviceSpace(ev.X, ev.Y, ev.ScreenW, ev.ScreenH, devW, devH)
 
 	// 轉 action
 	var action uint8
@@ -288,12 +474,11 @@ func handleTouchEvent(ev touchEvent) {
 	}
 
 	// ★ 計算送出的 pointerID
-	var pointerID uint64
 	if ev.PointerType != "touch" {
 		// mouse/pen → 永遠使用 0，且忽略 hover move（無按鍵）
 		pointerID = 0
 		if action == 2 /*move*/ && ev.Buttons == 0 {
-			return
+			return nil, 0, false
 		}
 	} else {
 		// touch → 對 remote ID 映射到 1..10（slot 0..9 對應 1..10；0 保留給滑鼠/pen）
@@ -305,7 +490,7 @@ func handleTouchEvent(ev touchEvent) {
 			} else {
 				touchMu.Unlock()
 				log.Printf("[CTRL][TOUCH] 丟棄 down（超過 %d 指） id=%d", maxPointers, ev.ID)
-				return
+				return nil, 0, false
 			}
 		case 1, 3: // up/cancel
 			if s, ok := getLocalSlot(ev.ID); ok {
@@ -313,14 +498,14 @@ func handleTouchEvent(ev touchEvent) {
 				freeLocalSlot(ev.ID)
 			} else {
 				touchMu.Unlock()
-				return
+				return nil, 0, false
 			}
 		default: // move
 			if s, ok := getLocalSlot(ev.ID); ok {
 				pointerID = uint64(s + 1)
 			} else {
 				touchMu.Unlock()
-				return
+				return nil, 0, false
 			}
 		}
 		touchMu.Unlock()
@@ -376,7 +561,7 @@ func handleTouchEvent(ev touchEvent) {
 	// [22:24]: pressure (u16 fixed-point)
 	// [24:28]: actionButton (i32)
 	// [28:32]: buttons (i32)
-	buf := make([]byte, 32)
+	buf = make([]byte, 32)
 	buf[0] = 2
 	buf[1] = action
 	binary.BigEndian.PutUint64(buf[2:], pointerID)
@@ -387,9 +572,46 @@ func handleTouchEvent(ev touchEvent) {
 	binary.BigEndian.PutUint16(buf[22:], p)
 	binary.BigEndian.PutUint32(buf[24:], actionButton)
 	binary.BigEndian.PutUint32(buf[28:], nowButtons)
+	return buf, pointerID, true
+}
+
+// floatToI16FP 對齊官方 sc_float_to_i16fp：[-1, 1] → i16 定點（乘 2^15 後向零截斷，1.0 夾到 0x7fff）
+func floatToI16FP(f float64) int16 {
+	if math.IsNaN(f) {
+		return 0
+	}
+	f = math.Max(-1, math.Min(1, f))
+	i := int32(f * 0x8000)
+	if i > 0x7fff {
+		i = 0x7fff
+	}
+	return int16(i)
+}
+
+// encodeScrollEvent 編碼 INJECT_SCROLL_EVENT：
+// [type=3][x i32][y i32][w u16][h u16][hscroll i16fp][vscroll i16fp][buttons i32]，共 21 bytes。
+// hscroll/vscroll 以「行」為單位、接受 [-16, 16]（可為小數，例如高解析度觸控板），先除以 16 正規化再轉定點
+func encodeScrollEvent(x, y int32, w, h uint16, hscroll, vscroll float64, buttons uint32) []byte {
+	buf := make([]byte, 21)
+	buf[0] = controlMsgInjectScroll
+	binary.BigEndian.PutUint32(buf[1:], uint32(x))
+	binary.BigEndian.PutUint32(buf[5:], uint32(y))
+	binary.BigEndian.PutUint16(buf[9:], w)
+	binary.BigEndian.PutUint16(buf[11:], h)
+	binary.BigEndian.PutUint16(buf[13:], uint16(floatToI16FP(hscroll/16)))
+	binary.BigEndian.PutUint16(buf[15:], uint16(floatToI16FP(vscroll/16)))
+	binary.BigEndian.PutUint32(buf[17:], buttons)
+	return buf
+}
 
-	// 像官方：事件到就直接寫 socket（不合併、不延遲）
-	writeFull(buf, criticalWriteTimeout, true)
+// handleScrollEvent 將前端滾輪事件轉為 INJECT_SCROLL_EVENT（座標同觸控換算到裝置視訊尺寸）
+func handleScrollEvent(sess *deviceSession, ev touchEvent) {
+	if loadControlConn() == nil {
+		return
+	}
+	devW, devH := sess.videoSize()
+	x, y, sw, sh := toDeviceSpace(ev.X, ev.Y, ev.ScreenW, ev.ScreenH, devW, devH)
+	enqueueControl(encodeScrollEvent(x, y, sw, sh, ev.HScroll, ev.VScroll, ev.Buttons), *flagCtrlTimeout, false)
 }
 
 // ========= 伺服器入口 =========
@@ -397,6 +619,51 @@ func handleTouchEvent(ev touchEvent) {
 func main() {
 	// 進階 log 格式（含毫秒與檔名:行號）
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
+	flag.Parse()
+	if err := initLogger(*flagLogFormat); err != nil {
+		log.Fatal(err)
+	}
+	if err := SetLogLevel(*flagLogLevel); err != nil {
+		log.Fatal(err)
+	}
+	if p := *flagH264Profile; p != "auto" {
+		if _, err := hex.DecodeString(p); err != nil || len(p) != 6 {
+			log.Fatalf("-h264-profile 必須為 auto 或 6 位十六進位（目前 %q）", p)
+		}
+	}
+	if *flagCtrlTimeout <= 0 || *flagCtrlBgTimeout <= 0 {
+		log.Fatalf("-ctrl-write-timeout 與 -ctrl-bg-timeout 必須大於 0")
+	}
+	if v := *flagVideoSource; v != "display" && v != "camera" {
+		log.Fatalf("-video-source 必須為 display 或 camera（目前 %q）", v)
+	}
+	if *flagRTPMTU < 400 || *flagRTPMTU > 1400 {
+		log.Fatalf("-rtp-mtu 必須介於 400 與 1400 之間（目前 %d）", *flagRTPMTU)
+	}
+	if *flagRTPQueueSize <= 0 {
+		log.Fatalf("-rtp-queue-size 必須大於 0（目前 %d）", *flagRTPQueueSize)
+	}
+	if *flagMaxFrameSize <= 0 {
+		log.Fatalf("-max-frame-size 必須大於 0（目前 %d）", *flagMaxFrameSize)
+	}
+	if err := validateOrientation(*flagLockOrient); err != nil {
+		log.Fatalf("-lock-orientation: %v", err)
+	}
+	initSerialFilters(*flagAllowSerials, *flagDenySerials)
+	initShellAllow(*flagShellAllow)
+	if err := initNALUFilter(*flagDropNALU); err != nil {
+		log.Fatalf("-drop-nalu: %v", err)
+	}
+	prefs, err := parseCodecList(*flagCodecs)
+	if err != nil {
+		log.Fatalf("-codecs: %v", err)
+	}
+	codecPrefs = prefs
+	if *flagRTMPURL != "" {
+		if err := startRTMP(rtmpAnyDevice, *flagRTMPURL); err != nil {
+			log.Fatalf("-rtmp-url: %v", err)
+		}
+	}
 	// 暫時開啟日誌以便偵錯
 	// log.SetOutput(io.Discard)
 
@@ -405,8 +672,19 @@ func main() {
 
 	log.Println("🚀 啟動 scrcpy WebRTC 服務...")
 
+	if *flagRestartADB && *flagReplay == "" {
+		if devs, err := restartADB(); err != nil {
+			log.Printf("[ADB] 重新啟動 adb server 失敗: %v", err)
+		} else {
+			log.Printf("[ADB] adb server 已重新啟動，找到 %d 台裝置", len(devs))
+		}
+	}
+
+	// control socket 專用寫入 goroutine
+	goSafe("control-writer", startControlWriter)
+
 	// 初始化 HTTP 路由與服務
-	initHTTP()
+	initHTTP(NewServer())
 
 	log.Println("✅ HTTP 服務已啟動，請開啟瀏覽器訪問 http://127.0.0.1:8080")
 	log.Println("💡 ADB 連線將在前端觸發時建立")
@@ -415,58 +693,454 @@ func main() {
 	select {}
 }
 
-// initHTTP 設定 HTTP 路由與啟動 server
-func initHTTP() {
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+// initHTTP 以 Server 的路由啟動 HTTP server
+func initHTTP(s *Server) {
+	goSafe("http-server", func() {
+		addr := ":8080"
+		log.Println("[HTTP] 服務啟動:", addr, "（/ , /offer , /metrics , /stats"+s.debugRoutes+"）")
+		srv := &http.Server{Addr: addr, Handler: s.Handler()}
+		log.Fatal(srv.ListenAndServe())
+	})
+}
+
+// newMux 建立所有 HTTP 路由；debugRoutes 為已開啟的偵錯端點（啟動日誌用）
+func newMux() (mux *http.ServeMux, debugRoutes string) {
+	mux = http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		if r.URL.Path == "/" {
 			http.ServeFile(w, r, "index.html")
 			return
 		}
 		http.FileServer(http.Dir(".")).ServeHTTP(w, r)
 	})
-	http.HandleFunc("/offer", handleOffer)
-	http.HandleFunc("/set-adb-target", handleSetAdbTarget)
-	http.HandleFunc("/debug/stack", func(w http.ResponseWriter, r *http.Request) {
-		buf := make([]byte, 1<<20)
-		n := runtime.Stack(buf, true)
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		_, _ = w.Write(buf[:n])
-	})
+	mux.HandleFunc("/offer", handleOffer)
+	mux.HandleFunc("/set-adb-target", handleSetAdbTarget)
+	mux.HandleFunc("GET /devices", handleDevices)
+	mux.HandleFunc("POST /adb/restart", handleADBRestart)
+	mux.HandleFunc("GET /metrics", handleMetrics)
+	mux.HandleFunc("GET /stats", handleStats)
+	mux.HandleFunc("GET /config", handleConfig)
+	mux.HandleFunc("GET /version", handleVersion)
+	mux.HandleFunc("POST /devices/{id}/disconnect", handleDeviceDisconnect)
+	mux.HandleFunc("POST /devices/{id}/quality", handleDeviceQuality)
+	mux.HandleFunc("GET /devices/{id}/clients", handleDeviceClients)
+	mux.HandleFunc("GET /devices/{id}/clipboard", handleDeviceClipboard)
+	mux.HandleFunc("POST /devices/{id}/clipboard", handleDeviceSetClipboard)
+	mux.HandleFunc("GET /devices/{id}/logs", handleDeviceLogs)
+	mux.HandleFunc("POST /devices/{id}/keys", handleDeviceKeys)
+	mux.HandleFunc("POST /devices/{id}/orientation", handleDeviceOrientation)
+	mux.HandleFunc("POST /devices/{id}/restart", handleDeviceRestart)
+	mux.HandleFunc("POST /devices/{id}/revive", handleDeviceRevive)
+	if *flagEnableFiles {
+		if *flagAPIToken == "" {
+			log.Printf("[HTTP] -enable-files 需要 -api-token，未開啟 /devices/{id}/push、/devices/{id}/install")
+		} else {
+			mux.HandleFunc("POST /devices/{id}/push", requireToken(handleDevicePush))
+			mux.HandleFunc("POST /devices/{id}/install", requireToken(handleDeviceInstall))
+			log.Printf("[HTTP] 已開啟 /devices/{id}/push、/devices/{id}/install（需要 Bearer token）")
+		}
+	}
+	if *flagEnableRTMP {
+		if *flagAPIToken == "" {
+			log.Printf("[HTTP] -enable-rtmp 需要 -api-token，未開啟 /devices/{id}/rtmp")
+		} else {
+			mux.HandleFunc("POST /devices/{id}/rtmp", requireToken(handleDeviceRTMP))
+			log.Printf("[HTTP] 已開啟 /devices/{id}/rtmp（需要 Bearer token）")
+		}
+	}
+	if *flagEnableShell {
+		if *flagAPIToken == "" {
+			log.Printf("[HTTP] -enable-shell 需要 -api-token，未開啟 /devices/{id}/shell")
+		} else {
+			mux.HandleFunc("POST /devices/{id}/shell", requireToken(handleDeviceShell))
+			log.Printf("[HTTP] 已開啟 /devices/{id}/shell（需要 Bearer token），允許的指令: %s", *flagShellAllow)
+		}
+	}
+	// 偵錯端點會洩漏內部狀態，且完整 stack dump 成本高；對外部署時以 -debug-endpoints=false 關閉
+	if *flagDebugRoutes {
+		// net/http/pprof 與 expvar 於 import 時註冊在 DefaultServeMux
+		mux.Handle("/debug/pprof/", http.DefaultServeMux)
+		mux.Handle("/debug/vars", http.DefaultServeMux)
+		mux.HandleFunc("/debug/stack", func(w http.ResponseWriter, r *http.Request) {
+			buf := make([]byte, 1<<20)
+			n := runtime.Stack(buf, true)
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write(buf[:n])
+		})
+		debugRoutes = " , /debug/pprof , /debug/vars , /debug/stack"
+	}
+	return mux, debugRoutes
+}
 
-	goSafe("http-server", func() {
-		addr := ":8080"
-		log.Println("[HTTP] 服務啟動:", addr, "（/ , /offer , /debug/pprof , /debug/vars , /debug/stack）")
-		srv := &http.Server{Addr: addr}
-		log.Fatal(srv.ListenAndServe())
+// deviceSession 保存單一裝置連線所持有的資源，方便中斷連線時一次釋放
+type deviceSession struct {
+	id        string // 裝置識別：adb 序號；未指定目標時為 "default"
+	sid       string // 連線 session ID（日誌用；重啟 server 時沿用）
+	log       *slog.Logger
+	dev       *adb.Device
+	video     io.ReadCloser
+	control   io.ReadWriter
+	createdAt time.Time
+	metrics   *deviceMetrics // 此裝置自己的計數器（/metrics 以 device 標籤輸出）
+
+	// 裝置剪貼簿（受 stateMu 保護）
+	clipboard   string
+	clipboardAt time.Time
+	clipAckSeq  uint64 // 最近一次 ACK_CLIPBOARD 的 sequence
+
+	// 最近一次讀到的電量（受 stateMu 保護；由 battery 迴圈更新，尚未讀到時為 nil）
+	battery *adb.Battery
+
+	// 關鍵幀請求去抖動（受 stateMu 保護）：最近一次送出 RESET_VIDEO 的時間、是否已排定視窗結束時補送
+	lastKeyframeReq  time.Time
+	keyframeTrailing bool
+
+	// 串流資訊（受 stateMu 保護；由視訊迴圈更新）
+	codec            string
+	fps              float64
+	kbps             float64
+	gopFrames        float64   // 平滑後的 IDR 間隔幀數（見 gop.go）
+	keyframeInterval float64   // 平滑後的 IDR 間隔秒數
+	lastIDRAt        time.Time // 尚未收到 IDR 時為零值
+	videoW, videoH   uint16    // 目前視訊解析度（觸控座標換算的後備；主要用前端傳入的 screenW/H）
+
+	lastFrameAt atomic.Int64 // 最近一次讀到 frame 的時間（UnixNano；0 為尚未收到），見 watchdog.go
+	restarting  atomic.Bool  // 已交給 restartSession：視訊迴圈結束不視為裝置中斷（見 endSession）
+
+	done      chan struct{} // 關閉後通知背景迴圈（control-health）結束
+	closeOnce sync.Once
+}
+
+// deviceKey 將 adb 序號轉為對外使用的裝置 ID
+func deviceKey(serial string) string {
+	if *flagReplay != "" {
+		return "replay"
+	}
+	if serial == "" {
+		return "default"
+	}
+	return canonicalSerial(serial)
+}
+
+// canonicalSerial 正規化無線 adb 的 IP:port 序號：IPv6 以壓縮、小寫並加中括號的形式表示
+// （例如 [FE80:0::1]:5555 → [fe80::1]:5555），讓同一台裝置不論寫法都對應到相同 ID；其他序號原樣回傳
+func canonicalSerial(serial string) string {
+	host, port, err := net.SplitHostPort(serial)
+	if err != nil {
+		return serial
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return serial
+	}
+	return net.JoinHostPort(addr.String(), port)
+}
+
+// pathDeviceID 取出路徑參數 {id} 並正規化。IPv6 序號的中括號、冒號可直接放在路徑中，
+// zone（%wlan0）的 % 需編碼為 %25；PathValue 會先解碼
+func pathDeviceID(r *http.Request) string {
+	return canonicalSerial(r.PathValue("id"))
+}
+
+// Close 關閉 video/control 串流並移除 reverse/forward 通道；可重複呼叫
+func (s *deviceSession) Close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		// 同一裝置的計數器跨 session 共用：已由新的 session 接手時不動
+		stateMu.RLock()
+		replaced := curSession != nil && curSession != s && curSession.id == s.id
+		stateMu.RUnlock()
+		if !replaced {
+			curDevMetrics.CompareAndSwap(s.metrics, nil)
+			s.metrics.resetGauges()
+		}
+		if s.video != nil {
+			s.video.Close()
+		}
+		if c, ok := s.control.(io.Closer); ok {
+			c.Close()
+		}
+		if s.dev != nil {
+			if s.dev.Options().UseForward {
+				if err := s.dev.RemoveForward(fmt.Sprintf("tcp:%d", s.dev.Port())); err != nil {
+					s.log.Warn("adb_remove_forward_failed", "err", err)
+				}
+			} else if err := s.dev.RemoveReverse("localabstract:scrcpy"); err != nil {
+				s.log.Warn("adb_remove_reverse_failed", "err", err)
+			}
+		}
+		s.log.Info("session_closed")
+		w, h := s.videoSize()
+		notifyWebhook("device_disconnected", s, w, h)
 	})
 }
 
-// connectToDevice 連線到 Android 裝置並啟動 scrcpy server，回傳 video/control streams
-func connectToDevice() (io.ReadCloser, io.ReadWriter, error) {
-	dev, err := adb.NewDevice(adbTarget)
+// videoSize 回傳裝置目前的視訊解析度；s 為 nil（裝置已中斷）或尚未讀到視訊標頭時為 0
+func (s *deviceSession) videoSize() (w, h uint16) {
+	if s == nil {
+		return 0, 0
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return s.videoW, s.videoH
+}
+
+// setVideoSizeLocked 更新裝置的視訊解析度與 video_w/video_h；呼叫端需持有 stateMu
+func (s *deviceSession) setVideoSizeLocked(w, h uint16) {
+	s.videoW, s.videoH = w, h
+	evVideoW.setFor(s.metrics, int64(w))
+	evVideoH.setFor(s.metrics, int64(h))
+}
+
+// deviceOptions 由命令列參數組出啟動 scrcpy server 的預設選項
+func deviceOptions() adb.Options {
+	return adb.Options{
+		UseForward:         *flagForward,
+		DisplayID:          *flagDisplayID,
+		VideoSource:        *flagVideoSource,
+		BitRate:            *flagBitRate,
+		MaxSize:            *flagMaxSize,
+		NoControl:          *flagViewOnly,
+		NoDelay:            *flagTCPNoDelay,
+		ReadBufferSize:     *flagReadBuffer,
+		VideoEncoder:       *flagVideoEncoder,
+		ExtraArgs:          serverArgs,
+		CaptureOrientation: *flagLockOrient,
+	}
+}
+
+// connectToDevice 連線到 Android 裝置並啟動 scrcpy server，回傳包含 video/control streams 的 session
+func connectToDevice(serial string, opts adb.Options) (*deviceSession, error) {
+	id := deviceKey(serial)
+	if *flagReplay != "" {
+		return connectReplay(id, opts)
+	}
+	if err := checkSerial(serial); err != nil {
+		logger.Warn("device_skipped", "device", id, "err", err)
+		return nil, fmt.Errorf("[ADB] %w", err)
+	}
+	ring := deviceLogRing(id)
+	opts.Stderr = io.MultiWriter(os.Stderr, ring.writer("[server] "))
+	opts.Port = portForSerial(serial)
+	dev, err := adb.NewDevice(serial, opts)
 	if err != nil {
-		return nil, nil, fmt.Errorf("[ADB] NewDevice(%s): %w", adbTarget, err)
+		return nil, fmt.Errorf("[ADB] NewDevice(%s): %w", serial, err)
 	}
-	if err := dev.Reverse("localabstract:scrcpy", fmt.Sprintf("tcp:%d", adb.ScrcpyPort)); err != nil {
-		return nil, nil, fmt.Errorf("[ADB] reverse: %w", err)
+	if opts.UseForward {
+		if err := dev.Forward(fmt.Sprintf("tcp:%d", dev.Port())); err != nil {
+			return nil, fmt.Errorf("[ADB] forward: %w", err)
+		}
+	} else {
+		if err := dev.Reverse("localabstract:scrcpy", fmt.Sprintf("tcp:%d", dev.Port())); err != nil {
+			return nil, fmt.Errorf("[ADB] reverse: %w", err)
+		}
 	}
 	if err := dev.PushServer("./assets/scrcpy-server"); err != nil {
-		return nil, nil, fmt.Errorf("[ADB] push server: %w", err)
+		return nil, fmt.Errorf("[ADB] push server: %w", err)
 	}
 	conn, err := dev.StartServer()
 	if err != nil {
-		return nil, nil, fmt.Errorf("[ADB] start server: %w", err)
+		return nil, fmt.Errorf("[ADB] start server: %w", err)
+	}
+	// 裝置日誌同時寫入全域 logger 與該裝置的環狀緩衝
+	sid := newSessionID()
+	ringHandler := slog.NewTextHandler(ring.writer(""), &slog.HandlerOptions{Level: logLevel, ReplaceAttr: renameMsgToEvent})
+	lg := slog.New(teeHandler{logger.Handler(), ringHandler}).With("device", id, "session", sid)
+	lg.Info("server_connected", "forward", opts.UseForward, "source", opts.VideoSource, "bitRate", opts.BitRate, "maxSize", opts.MaxSize)
+	return &deviceSession{
+		id:        id,
+		sid:       sid,
+		log:       lg,
+		dev:       dev,
+		video:     conn.VideoStream,
+		control:   conn.Control,
+		createdAt: time.Now(),
+		metrics:   deviceMetricsFor(id),
+		done:      make(chan struct{}),
+	}, nil
+}
+
+// connectReplay 以 -replay 的錄影檔建立假裝置 session：沒有 adb 裝置（dev 為 nil），控制通道的寫入一律丟棄
+func connectReplay(id string, opts adb.Options) (*deviceSession, error) {
+	conn, err := adb.NewFakeDevice(*flagReplay, *flagReplayFPS).StartServer(!opts.NoControl)
+	if err != nil {
+		return nil, fmt.Errorf("[ADB] replay: %w", err)
+	}
+	ring := deviceLogRing(id)
+	sid := newSessionID()
+	ringHandler := slog.NewTextHandler(ring.writer(""), &slog.HandlerOptions{Level: logLevel, ReplaceAttr: renameMsgToEvent})
+	lg := slog.New(teeHandler{logger.Handler(), ringHandler}).With("device", id, "session", sid)
+	lg.Info("replay_started", "file", *flagReplay, "fps", *flagReplayFPS)
+	sess := &deviceSession{
+		id:        id,
+		sid:       sid,
+		log:       lg,
+		video:     conn.VideoStream,
+		createdAt: time.Now(),
+		metrics:   deviceMetricsFor(id),
+		done:      make(chan struct{}),
+	}
+	if conn.Control != nil {
+		sess.control = conn.Control
+	}
+	return sess, nil
+}
+
+// startSession 將 session 設為目前的控制連線，並啟動 control 讀回、健康檢查與視訊迴圈
+func startSession(sess *deviceSession) {
+	curDevMetrics.Store(sess.metrics)
+
+	// 設定全域控制連線（清掉尚未寫出的舊裝置事件）
+	ctrlQueue.reset()
+	controlMu.Lock()
+	setControlConnLocked(sess.control)
+	controlMu.Unlock()
+
+	// view-only：伺服器未開控制通道
+	if sess.control != nil {
+		// OTG 模式：在裝置上建立虛擬 HID 鍵盤/滑鼠
+		if *flagOTG {
+			createHIDKeyboard()
+			createHIDMouse()
+		}
+
+		// 啟動控制通道處理
+		goSafe("control-reader", func() {
+			defer func() {
+				if c, ok := sess.control.(io.Closer); ok {
+					c.Close()
+				}
+			}()
+			readDeviceMessages(sess.control, sess)
+			endSession(sess, "control_closed")
+		})
+
+		// 啟動控制健康檢查
+		goSafe("control-health", func() { startControlHealthLoop(sess.done) })
+	}
+
+	// 週期性讀取電量、視訊卡住時自動重啟（-replay 沒有 adb 裝置）
+	if sess.dev != nil {
+		goSafe("battery", func() { startBatteryLoop(sess) })
+		if *flagStallRestart > 0 {
+			goSafe("stall-watchdog", func() { startStallWatchdog(sess) })
+		}
+	}
+
+	// 啟動視訊處理
+	goSafe("video-loop", func() {
+		defer sess.video.Close()
+		startVideoLoop(sess)
+		endSession(sess, "video_closed")
+	})
+}
+
+// restartSession 以新選項重新啟動 scrcpy server（scrcpy 無法在串流中途變更位元率），
+// 保留既有的 PeerConnection/track，並要求新串流從 SPS/PPS + IDR 開始，前端不需重新協商
+func restartSession(old *deviceSession, opts adb.Options) (*deviceSession, error) {
+	old.log.Info("server_restart", "bitRate", opts.BitRate, "maxSize", opts.MaxSize)
+	old.restarting.Store(true)
+
+	controlMu.Lock()
+	if loadControlConn() == old.control {
+		setControlConnLocked(nil)
+	}
+	controlMu.Unlock()
+	old.Close()
+
+	sess, err := connectToDevice(old.dev.Serial(), opts)
+	noteConnectResult(old.dev.Serial(), err)
+	if err == nil {
+		// 對前端而言仍是同一次連線
+		sess.sid, sess.log = old.sid, old.log
+	}
+	stateMu.Lock()
+	replaced := curSession != old // 重啟期間裝置已中斷或被新的 /offer 取代
+	if !replaced {
+		curSession = sess // 失敗時為 nil
+		if err == nil {
+			markDeviceNeedsKeyframeLocked(old.id)
+			havePTS0 = false
+			tsContinue = true
+		}
+	}
+	stateMu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if replaced {
+		// 不啟動：沒有人能再透過 curSession 找到並關閉它
+		sess.Close()
+		return nil, errSessionReplaced
+	}
+
+	startSession(sess)
+	return sess, nil
+}
+
+// writeRestartError 回應 restartSession 的錯誤：重啟期間 session 已被取代時為 409，其餘為 adb 失敗
+func writeRestartError(w http.ResponseWriter, id string, err error) {
+	log.Printf("❌ [ADB][%s] 重新啟動失敗: %v", id, err)
+	if errors.Is(err, errSessionReplaced) {
+		writeError(w, http.StatusConflict, "session_replaced", err.Error())
+		return
+	}
+	writeError(w, http.StatusInternalServerError, "adb_failed", fmt.Sprintf("restart failed: %v", err))
+}
+
+// errSessionReplaced 表示 server 重啟期間 session 已結束或被取代，重新啟動的 server 已關閉
+var errSessionReplaced = errors.New("session ended or replaced during restart")
+
+// sessionForDevice 回傳裝置目前的 session；server 重啟後為新的 session，裝置已中斷時回傳 nil。
+// 前端的事件處理（RTCP、DataChannel、連線狀態）以此在事件當下取得 session，不沿用 /offer 時建立的那一個
+func sessionForDevice(id string) *deviceSession {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	if curSession != nil && curSession.id == id {
+		return curSession
+	}
+	return nil
+}
+
+// closePeerConn 關閉 PeerConnection；其 rtcp-reader 與 DataChannel 會隨之結束
+func closePeerConn(pc *webrtc.PeerConnection) {
+	if err := pc.Close(); err != nil {
+		log.Printf("[RTC] close PeerConnection: %v", err)
+	}
+}
+
+// startBatteryLoop 立即讀一次電量，之後每 batteryRefresh 更新快取；session 結束時返回
+func startBatteryLoop(sess *deviceSession) {
+	t := time.NewTicker(batteryRefresh)
+	defer t.Stop()
+	for {
+		if b, err := sess.dev.Battery(); err != nil {
+			sess.log.Warn("battery_read_failed", "err", err)
+		} else {
+			stateMu.Lock()
+			sess.battery = &b
+			stateMu.Unlock()
+			sess.log.Debug("battery", "level", b.Level, "status", b.Status)
+		}
+		select {
+		case <-sess.done:
+			return
+		case <-t.C:
+		}
 	}
-	log.Println("[ADB] 已連上 scrcpy server")
-	return conn.VideoStream, conn.Control, nil
 }
 
-// startControlHealthLoop 週期性檢查 control 讀回，必要時發送 GET_CLIPBOARD 心跳
-func startControlHealthLoop() {
+// startControlHealthLoop 週期性檢查 control 讀回，必要時發送 GET_CLIPBOARD 心跳；done 關閉時結束
+func startControlHealthLoop(done <-chan struct{}) {
 	t := time.NewTicker(controlHealthTick)
 	defer t.Stop()
-	for range t.C {
-		if controlConn == nil {
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+		}
+		if loadControlConn() == nil {
 			continue
 		}
 		ms := time.Since(lastCtrlRead).Milliseconds()
@@ -483,212 +1157,360 @@ func startControlHealthLoop() {
 	}
 }
 
+// sanitizeDeviceName 取 NUL 之前的內容（沒有 NUL 時名稱剛好填滿 64 bytes，保留全部），
+// 修正非法 UTF-8（含截斷在 64 bytes 邊界的多位元組字元）並移除不可列印字元
+func sanitizeDeviceName(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	name := strings.Map(func(r rune) rune {
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}, strings.ToValidUTF8(string(b), ""))
+	return strings.TrimSpace(name)
+}
+
+// deviceHasViewers 回傳裝置是否有觀看者：clients 登記表中的前端、RTMP 推流、行程內訂閱者（subscribe.go）或 OnFrame 回呼（server.go）
+func deviceHasViewers(id string) bool {
+	stateMu.RLock()
+	n := countClientsLocked(id)
+	stateMu.RUnlock()
+	return n > 0 || rtmpActive(id) || auSubscribed(id) || frameHooked()
+}
+
+// idleGate 為 -idle-pause 的暫停狀態（只由視訊迴圈使用）
+type idleGate struct {
+	paused bool
+}
+
+// update 依裝置目前有無觀看者更新狀態，回傳是否暫停，以及狀態是否與上一個 frame 不同
+func (g *idleGate) update(id string) (paused, changed bool) {
+	paused = !deviceHasViewers(id)
+	changed = paused != g.paused
+	g.paused = paused
+	return paused, changed
+}
+
+// codecName 將 scrcpy 視訊標頭的 codec ID（FourCC）轉為名稱
+func codecName(id uint32) string {
+	switch id {
+	case 0x68323634:
+		return "h264"
+	case 0x68323635:
+		return "h265"
+	case 0x00617631:
+		return "av1"
+	default:
+		return fmt.Sprintf("0x%08x", id)
+	}
+}
+
 // startVideoLoop 處理視訊 header 與接收幀迴圈
-func startVideoLoop(videoStream io.ReadCloser) {
+func startVideoLoop(sess *deviceSession) {
+	videoStream, lg := sess.video, sess.log
 	// 跳過裝置名稱 (64 bytes, NUL 結尾)
 	nameBuf := make([]byte, 64)
 	if _, err := io.ReadFull(videoStream, nameBuf); err != nil {
-		log.Fatal("[VIDEO] read device name:", err)
+		// 只結束這台裝置的 session，不影響整個服務
+		lg.Error("video_read_device_name_failed", "err", err)
+		sess.Close()
+		return
 	}
-	deviceName := string(bytes.TrimRight(nameBuf, "\x00"))
-	log.Printf("[VIDEO] 裝置名稱: %s", deviceName)
+	deviceName := sanitizeDeviceName(nameBuf)
+	lg.Info("video_device_name", "name", deviceName)
 
 	// 視訊標頭 (12 bytes)：[codecID(u32)][w(u32)][h(u32)]
 	vHeader := make([]byte, 12)
 	if _, err := io.ReadFull(videoStream, vHeader); err != nil {
-		log.Fatal("[VIDEO] read video header:", err)
+		lg.Error("video_read_header_failed", "err", err)
+		sess.Close()
+		return
 	}
-	codecID := binary.BigEndian.Uint32(vHeader[0:4]) // 0=H264, 1=H265, 2=AV1（依版本可能不同）
+	codecID := binary.BigEndian.Uint32(vHeader[0:4]) // FourCC："h264" / "h265" / "\0av1"
 	w0 := binary.BigEndian.Uint32(vHeader[4:8])
 	h0 := binary.BigEndian.Uint32(vHeader[8:12])
 
 	stateMu.Lock()
-	videoW, videoH = uint16(w0), uint16(h0) // 後備觸控映射空間
+	sess.setVideoSizeLocked(uint16(w0), uint16(h0)) // 後備觸控映射空間
 	stateMu.Unlock()
-	evVideoW.Set(int64(videoW))
-	evVideoH.Set(int64(videoH))
 
-	log.Printf("[VIDEO] 編碼ID: %d, 初始解析度: %dx%d", codecID, w0, h0)
+	lg.Info("video_header", "codec", codecName(codecID), "w", w0, "h", h0)
+	hevc := codecName(codecID) == "h265"
+	stateMu.Lock()
+	sess.codec = codecName(codecID)
+	if videoCodec != sess.codec {
+		// 換了編碼：舊的參數集不能用在新串流
+		lastVPS, lastSPS, lastPPS = nil, nil, nil
+		videoCodec = sess.codec
+	}
+	stateMu.Unlock()
+	notifyWebhook("device_connected", sess, uint16(w0), uint16(h0))
 
 	// 視訊流已準備就緒，現在可以安全地請求關鍵幀
 	log.Println("[VIDEO] 視訊流初始化完成，請求初始關鍵幀...")
 	go func() {
 		time.Sleep(500 * time.Millisecond) // 短暫延遲確保一切就緒
-		requestKeyframe()
-		evKeyframeRequests.Add(1)
+		requestKeyframeDebounced(sess, "stream_start")
 	}()
 
 	// 接收幀迴圈（多數版本：meta 12 bytes：[PTS(u64)] + [size(u32)]）
 	meta := make([]byte, 12)
+	maxFrameSize := uint32(*flagMaxFrameSize)
 	startTime = time.Now()
 	var frameCount int
 	var totalBytes int64
+	// 滾動速率：每 streamRateWindow 依 frame/bytes 差值更新 sess.fps / sess.kbps
+	rateStart := time.Now()
+	var rateFrames int
+	var rateBytes int64
+	var ratePushed, rateDropped int // 區間內交給前端佇列與因佇列已滿丟棄的 AU 數
+	dropStreak := 0                 // 丟幀率連續超過門檻的區間數
+	var idle idleGate               // -idle-pause 的暫停狀態
+	var gop gopTracker
+	var lastKFOnlyReq time.Time // ?keyframesOnly 前端的上一次週期性關鍵幀請求
 
 	for {
 		// frame meta
 		t0 := time.Now()
 		if _, err := io.ReadFull(videoStream, meta); err != nil {
-			log.Println("[VIDEO] read frame meta:", err)
+			lg.Warn("video_read_meta_failed", "err", err)
 			break
 		}
 		metaElapsed := time.Since(t0)
 		evLastFrameMetaMS.Set(metaElapsed.Milliseconds())
-		if metaElapsed > warnFrameMetaOver {
-			log.Printf("[VIDEO] 讀 meta 偏慢: %v", metaElapsed)
+		if metaElapsed > *flagWarnFrameMeta {
+			lg.Warn("video_meta_slow", "elapsed", metaElapsed)
 		}
 
 		pts := binary.BigEndian.Uint64(meta[0:8])
 		frameSize := binary.BigEndian.Uint32(meta[8:12])
 
+		// 檢查 frame 大小：0 直接略過；超過上限視為串流錯位，重新同步
+		var framePrefix []byte
+		if frameSize == 0 {
+			lg.Warn("video_frame_empty", "pts", pts)
+			evFramesMalformed.Add(1)
+			continue
+		}
+		if frameSize > maxFrameSize {
+			lg.Warn("video_frame_oversized", "size", frameSize, "max", maxFrameSize)
+			evFramesMalformed.Add(1)
+			requestKeyframeDebounced(sess, "frame_oversized")
+			var err error
+			pts, frameSize, framePrefix, err = resyncFrame(videoStream, maxFrameSize)
+			if err != nil {
+				lg.Error("video_resync_failed", "err", err)
+				break
+			}
+			lg.Info("video_resynced", "pts", pts, "size", frameSize)
+		}
+
 		// 初始化 PTS 基準
 		if !havePTS0 {
 			pts0 = pts
 			rtpTS0 = 0
+			if tsContinue && !lastAUAt.IsZero() {
+				rtpTS0 = lastAUTS + rtpTSFromPTS(uint64(time.Since(lastAUAt).Microseconds()), 0)
+				lg.Info("rtp_ts_continued", "from", lastAUTS, "base", rtpTS0)
+			}
+			tsContinue = false
 			havePTS0 = true
 		}
 		curTS := rtpTS0 + rtpTSFromPTS(pts, pts0)
+		lastAUTS, lastAUAt = curTS, time.Now()
 
 		// frame data
 		t1 := time.Now()
-		frame := make([]byte, frameSize)
-		if _, err := io.ReadFull(videoStream, frame); err != nil {
-			log.Println("[VIDEO] read frame:", err)
+		ref := getFrame(int(frameSize)) // 見 framepool.go：NALU 不複製，引用計數歸零時放回 pool
+		frame := ref.buf
+		copy(frame, framePrefix)
+		if _, err := io.ReadFull(videoStream, frame[len(framePrefix):]); err != nil {
+			lg.Warn("video_read_frame_failed", "err", err)
 			break
 		}
 		readElapsed := time.Since(t1)
+		sess.lastFrameAt.Store(time.Now().UnixNano())
 		evLastFrameReadMS.Set(readElapsed.Milliseconds())
-		if readElapsed > warnFrameReadOver {
-			log.Printf("[VIDEO] 讀 frame 偏慢: %v (size=%d)", readElapsed, frameSize)
+		if readElapsed > *flagWarnFrameRead {
+			lg.Warn("video_frame_slow", "elapsed", readElapsed, "size", frameSize)
+		}
+
+		// -idle-pause：沒有觀看者時只排空 frame（scrcpy 協定沒有暫停訊息）
+		if *flagIdlePause {
+			paused, changed := idle.update(sess.id)
+			if changed {
+				if paused {
+					lg.Info("video_idle_paused")
+				} else {
+					lg.Info("video_idle_resumed")
+					stateMu.Lock()
+					markDeviceNeedsKeyframeLocked(sess.id)
+					stateMu.Unlock()
+					requestKeyframeDebounced(sess, "idle_resumed")
+				}
+			}
+			if paused {
+				evFramesIdleSkipped.Add(1)
+				ref.release()
+				continue
+			}
 		}
 
-		// 解析 Annex-B → NALUs，並快取 SPS/PPS、偵測是否含 IDR
-		nalus := splitAnnexBNALUs(frame)
+		// 解析 Annex-B → NALUs，並快取 VPS/SPS/PPS、偵測是否含 IDR
+		nalus := filterNALUs(splitAnnexBNALUs(frame), hevc)
+		au := newVideoAU(nalus, curTS, hevc, ref)
 
-		idrInThisAU := false
-		var gotNewSPS bool
-		var spsCnt, ppsCnt, idrCnt, othersCnt int
+		var gotNewSPS, resized bool
+		var vpsCnt, spsCnt, ppsCnt, idrCnt, othersCnt int
 
 		for _, n := range nalus {
-			switch naluType(n) {
-			case 7: // SPS
+			switch classifyNALU(n, hevc) {
+			case nalVPS:
+				vpsCnt++
+				stateMu.Lock()
+				lastVPS = append([]byte(nil), n...)
+				stateMu.Unlock()
+			case nalSPS:
 				spsCnt++
 				stateMu.Lock()
 				if !bytes.Equal(lastSPS, n) {
-					if w, h, ok := parseH264SPSDimensions(n); ok {
-						videoW, videoH = w, h
-						gotNewSPS = true
-						evVideoW.Set(int64(videoW))
-						evVideoH.Set(int64(videoH))
-						log.Printf("[AU] 更新 SPS 並套用解析度 %dx%d 給觸控映射(後備)", w, h)
+					var w, h uint16
+					ok := false
+					if !hevc {
+						w, h, ok = parseH264SPSDimensions(n)
 					}
+					if !ok {
+						// 解析器不支援的 SPS（例如部分 High profile 的 scaling list）：
+						// 退回視訊標頭的解析度，避免觸控映射沿用過時或為 0 的尺寸
+						lg.Debug("video_sps_unparsed", "len", len(n), "sps", hex.EncodeToString(n[:min(len(n), spsDumpMax)]))
+						w, h = uint16(w0), uint16(h0)
+					}
+					if w != sess.videoW || h != sess.videoH {
+						resized = true
+						if (w > h) != (sess.videoW > sess.videoH) && sess.videoW != 0 {
+							lg.Info("video_orientation_changed", "landscape", w > h)
+						}
+					}
+					sess.setVideoSizeLocked(w, h)
+					gotNewSPS = true
+					lg.Info("video_sps_updated", "w", w, "h", h, "parsed", ok)
 				}
 				lastSPS = append([]byte(nil), n...)
 				stateMu.Unlock()
-			case 8: // PPS
+			case nalPPS:
 				ppsCnt++
 				stateMu.Lock()
 				if !bytes.Equal(lastPPS, n) {
-					log.Printf("[AU] 更新 PPS (len=%d)", len(n))
+					lg.Debug("video_pps_updated", "len", len(n))
 				}
 				lastPPS = append([]byte(nil), n...)
 				stateMu.Unlock()
-			case 5: // IDR
+			case nalIDR:
 				idrCnt++
-				idrInThisAU = true
 			default:
 				othersCnt++
 			}
 		}
+		if resized {
+			w, h := sess.videoSize()
+			sendToClients(sess.id, map[string]any{"type": "resolution", "w": w, "h": h})
+		}
+
 		evNALU_SPS.Add(int64(spsCnt))
 		evNALU_PPS.Add(int64(ppsCnt))
 		evNALU_IDR.Add(int64(idrCnt))
 		evNALU_Others.Add(int64(othersCnt))
 
-		// 狀態
-		stateMu.RLock()
-		vt := videoTrack
-		pk := packetizer
-		waitKF := needKeyframe
-		stateMu.RUnlock()
+		gop.frame(sess, lg, au.idr)
+		rtmpFeed(sess.id, nalus, au.idr, ref)
+		publishAU(sess.id, rtpPayload{nalus: nalus, ts: curTS, idr: au.idr})
+		runFrameHooks(sess.id, nalus, curTS, au.idr)
 
-		// 推進 WebRTC
-		if vt != nil && pk != nil {
-			// 若剛換解析度，只是標記需要關鍵幀，不立即發送 SPS/PPS
-			if gotNewSPS {
-				log.Printf("[AU] 偵測到新 SPS，標記需要關鍵幀")
-				stateMu.Lock()
-				needKeyframe = true
-				stateMu.Unlock()
-				requestKeyframe()
-				evKeyframeRequests.Add(1)
-				waitKF = true // 更新本地狀態
+		// 若剛換解析度，所有前端都從下一個 IDR 重新開始（不立即發送 SPS/PPS）
+		if gotNewSPS {
+			stateMu.Lock()
+			n := markDeviceNeedsKeyframeLocked(sess.id)
+			stateMu.Unlock()
+			if n > 0 {
+				lg.Info("keyframe_needed", "reason", "new_sps")
+				requestKeyframeDebounced(sess, "new_sps")
 			}
+		}
 
-			if waitKF {
-				keyframeMu.Lock() // 確保關鍵幀處理不被 RTCP 中斷
-				framesSinceKF++
-				evFramesSinceKF.Set(int64(framesSinceKF))
-
-				if !idrInThisAU {
-					// 等待 IDR 期間，每 30 幀重新請求一次關鍵幀
-					if framesSinceKF%30 == 0 {
-						log.Printf("[KF] 等待 IDR 中... 已過 %d 幀；再次請求關鍵幀", framesSinceKF)
-						requestKeyframe()
-						evKeyframeRequests.Add(1)
-					}
-					keyframeMu.Unlock()
-					goto stats // 跳過發送，繼續等待 IDR
-				}
-
-				// 收到 IDR，發送完整的 Access Unit (SPS + PPS + IDR + ...)
-				log.Println("[KF] 偵測到 IDR，發送完整 Access Unit")
-				stateMu.Lock()
-				needKeyframe = false
-				framesSinceKF = 0
-				stateMu.Unlock()
-				evFramesSinceKF.Set(0)
-
-				// 檢查當前 AU 是否已包含 SPS/PPS
-				hasSPSInAU := spsCnt > 0
-				hasPPSInAU := ppsCnt > 0
-
-				if !hasSPSInAU || !hasPPSInAU {
-					// 當前 AU 缺少參數集，需要添加
-					stateMu.RLock()
-					sps := lastSPS
-					pps := lastPPS
-					stateMu.RUnlock()
-
-					if len(sps) > 0 && len(pps) > 0 {
-						completeAU := make([][]byte, 0, len(nalus)+2)
-						if !hasSPSInAU {
-							completeAU = append(completeAU, sps)
-						}
-						if !hasPPSInAU {
-							completeAU = append(completeAU, pps)
-						}
-						completeAU = append(completeAU, nalus...)
-						sendNALUAccessUnitAtTS(completeAU, curTS)
-					} else {
-						log.Printf("[KF] 警告：無有效 SPS/PPS，直接發送 IDR AU")
-						sendNALUAccessUnitAtTS(nalus, curTS)
-					}
-				} else {
-					// AU 已包含完整參數集，直接發送
-					log.Printf("[KF] AU 已包含 SPS/PPS，直接發送")
-					sendNALUAccessUnitAtTS(nalus, curTS)
-				}
-				keyframeMu.Unlock()
-			} else {
-				sendNALUAccessUnitAtTS(nalus, curTS)
+		// 推進 WebRTC：分送到各前端的發送佇列（見 fanout.go）
+		res := fanOutAU(sess.id, au)
+		ratePushed += res.pushed
+		rateDropped += res.dropped
+		if res.overflow {
+			// 丟了非關鍵幀的前端要等下一個 IDR 才會恢復畫面
+			lg.Warn("rtp_queue_full", "ts", curTS)
+			requestKeyframeDebounced(sess, "rtp_queue_full")
+		}
+		if res.incompleteKF {
+			lg.Warn("keyframe_without_parameter_sets")
+		}
+		switch {
+		case au.idr:
+			stateMu.Lock()
+			waited := framesSinceKF > 0
+			framesSinceKF = 0
+			stateMu.Unlock()
+			evFramesSinceKF.Set(0)
+			if waited {
+				lg.Debug("keyframe_received")
+			}
+		case res.waiting > 0:
+			stateMu.Lock()
+			framesSinceKF++
+			n := framesSinceKF
+			stateMu.Unlock()
+			evFramesSinceKF.Set(int64(n))
+			// 等待 IDR 期間，每 30 幀重新請求一次關鍵幀
+			if n%30 == 0 {
+				lg.Info("keyframe_rerequest", "framesSinceKF", n)
+				requestKeyframeDebounced(sess, "rerequest")
+			}
+		case res.sending > 0 && res.kfOnly == res.sending && !au.params:
+			// 前端都以 ?keyframesOnly=true 連線：定期請求關鍵幀讓畫面持續更新
+			if time.Since(lastKFOnlyReq) >= keyframeTick {
+				lastKFOnlyReq = time.Now()
+				requestKeyframeDebounced(sess, "keyframes_only_tick")
 			}
 		}
+		ref.release() // 之後只剩各佇列的引用
 
-	stats:
 		frameCount++
 		totalBytes += int64(frameSize)
 		evFramesRead.Add(1)
 		evBytesRead.Add(int64(frameSize))
+		rateFrames++
+		rateBytes += int64(frameSize)
+		if d := time.Since(rateStart); d >= streamRateWindow {
+			stateMu.Lock()
+			sess.fps = float64(rateFrames) / d.Seconds()
+			sess.kbps = float64(rateBytes) * 8 / 1000 / d.Seconds()
+			stateMu.Unlock()
+
+			dropPct := 0.0
+			if ratePushed > 0 {
+				dropPct = float64(rateDropped) * 100 / float64(ratePushed)
+			}
+			evDropRatePct.Set(int64(dropPct))
+			if dropPct > dropRateAlertPct {
+				dropStreak++
+			} else {
+				dropStreak = 0
+			}
+			if dropStreak >= dropRateSustain {
+				dropStreak = 0
+				if reduceQualityForDrops(sess, dropPct) {
+					return // server 重啟中，新的視訊迴圈會接手
+				}
+			}
+			rateStart, rateFrames, rateBytes, ratePushed, rateDropped = time.Now(), 0, 0, 0, 0
+		}
 
 		if frameCount%statsLogEvery == 0 {
 			elapsed := time.Since(startTime).Seconds()
@@ -697,8 +1519,8 @@ func startVideoLoop(videoStream io.ReadCloser) {
 			lp := lastPLI
 			pc := pliCount
 			stateMu.RUnlock()
-			log.Printf("[STATS] 影格: %d, 速率: %.2f MB/s, PLI 累計: %d (last=%s), AUseq=%d",
-				frameCount, bytesPerSecond/(1024*1024), pc, lp.Format(time.RFC3339), auSeq)
+			lg.Info("video_stats", "frames", frameCount, "mbps", bytesPerSecond/(1024*1024),
+				"pli", pc, "lastPLI", lp.Format(time.RFC3339), "auSeq", auSeq)
 		}
 
 		// 下一 AU 序號
@@ -712,7 +1534,7 @@ func startVideoLoop(videoStream io.ReadCloser) {
 // === HTTP: /set-adb-target handler ===
 func handleSetAdbTarget(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed")
 		return
 	}
 
@@ -720,9 +1542,16 @@ func handleSetAdbTarget(w http.ResponseWriter, r *http.Request) {
 		Target string `json:"target"`
 	}
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-		http.Error(w, "Invalid JSON", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
 		return
 	}
+	if req.Target != "" {
+		if err := checkSerial(req.Target); err != nil {
+			log.Printf("[ADB] 拒絕設定目標 %s: %v", req.Target, err)
+			writeError(w, http.StatusForbidden, "serial_not_allowed", err.Error())
+			return
+		}
+	}
 
 	stateMu.Lock()
 	adbTarget = req.Target
@@ -737,88 +1566,419 @@ func handleSetAdbTarget(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// === HTTP: GET /devices handler ===
+// 列出 adb 可見的裝置，並標示目前是否已建立連線
+func handleDevices(w http.ResponseWriter, r *http.Request) {
+	devs, err := adb.ListDevices()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "adb_failed", fmt.Sprintf("list devices failed: %v", err))
+		return
+	}
+
+	// 串流資訊與電量來自裝置自己的 session；沒有 session 的裝置省略，不回報 0
+	streamOf := func(s *deviceSession) (*streamInfo, *adb.Battery) {
+		stateMu.RLock()
+		defer stateMu.RUnlock()
+		return s.streamInfoLocked(), s.battery
+	}
+
+	type deviceEntry struct {
+		adb.ADBDevice
+		Connected bool         `json:"connected"`
+		Stream    *streamInfo  `json:"stream,omitempty"`  // 僅已連線的裝置
+		Battery   *adb.Battery `json:"battery,omitempty"` // 僅已連線的裝置，每 batteryRefresh 更新
+		// 本行程啟動後連線過的裝置：累計計數（跨 session 保留，見 metrics.go）
+		Counters map[string]int64 `json:"counters,omitempty"`
+		// 曾因未授權連線失敗、仍在等待使用者允許 USB 偵錯
+		PendingAuth bool `json:"pendingAuth,omitempty"`
+		// 連續連線失敗次數；達 -max-connect-failures 時 Dead 為 true，需 POST /devices/{id}/revive 才會再嘗試
+		ConnectFailures int  `json:"connectFailures,omitempty"`
+		Dead            bool `json:"dead,omitempty"`
+	}
+	entries := make([]deviceEntry, 0, len(devs))
+	for _, d := range devs {
+		key := deviceKey(d.Serial)
+		e := deviceEntry{ADBDevice: d, PendingAuth: isPendingAuth(d.Serial)}
+		if s := sessionForDevice(key); s != nil {
+			e.Connected = true
+			e.Stream, e.Battery = streamOf(s)
+		}
+		e.Counters = lookupDeviceMetrics(key).counters()
+		e.ConnectFailures, e.Dead = connectFailures(d.Serial), isDeviceDead(d.Serial)
+		entries = append(entries, e)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(entries)
+}
+
+// === HTTP: POST /devices/{id}/disconnect handler ===
+// 中斷指定裝置的連線（關閉串流、移除 reverse、關閉 PeerConnection），不影響 HTTP 服務本身
+func handleDeviceDisconnect(w http.ResponseWriter, r *http.Request) {
+	id := pathDeviceID(r)
+	if !disconnectDevice(id) {
+		writeError(w, http.StatusNotFound, "device_not_found", "device not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+		"id":     id,
+	})
+}
+
+// disconnectDevice 中斷裝置目前的連線並關閉它的前端；裝置沒有連線時回傳 false
+func disconnectDevice(id string) bool {
+	stateMu.Lock()
+	s := curSession
+	if s == nil || s.id != id {
+		stateMu.Unlock()
+		return false
+	}
+	curSession = nil
+	stateMu.Unlock()
+
+	dropSession(s)
+	log.Printf("[ADB][%s] 已依請求中斷連線", id)
+	return true
+}
+
+// endSession 在 scrcpy server 自行結束串流時（裝置休眠、拔線、server 結束）立即釋放 session：
+// 通知該裝置的所有前端（{"type":"deviceGone"}），deviceGoneGrace 後再關閉 PeerConnection，
+// 讓訊息有時間送達，前端可顯示「裝置已中斷」而不是停在最後一幀。scrcpy 沒有「session 結束」的 DeviceMessage，
+// server 結束時會關閉視訊與控制 socket，因此以任一條讀到 EOF/錯誤為準。
+// 已由本服務主動關閉的 session（中斷連線）與正在重啟 server 的 session 不處理
+func endSession(sess *deviceSession, reason string) {
+	select {
+	case <-sess.done:
+		return
+	default:
+	}
+	if sess.restarting.Load() {
+		return // restartSession 會關閉它並沿用既有的前端
+	}
+	stateMu.Lock()
+	current := curSession == sess
+	if current {
+		curSession = nil
+	}
+	stateMu.Unlock()
+	sess.log.Info("session_ended_by_device", "reason", reason)
+	if !current {
+		sess.Close()
+		return
+	}
+	sendToClients(sess.id, map[string]any{"type": "deviceGone", "device": sess.id, "reason": reason})
+	pcs := devicePeerConns(sess.id)
+	releaseSession(sess)
+	goSafe("device-gone", func() {
+		time.Sleep(deviceGoneGrace)
+		for _, pc := range pcs {
+			closePeerConn(pc)
+		}
+	})
+}
+
+// dropSession 釋放已從 curSession 移除的裝置連線並關閉該裝置的所有前端
+func dropSession(s *deviceSession) {
+	releaseSession(s)
+	for _, pc := range devicePeerConns(s.id) {
+		closePeerConn(pc)
+	}
+}
+
+// releaseSession 移除 HID 裝置、清除控制連線並關閉 session（不動前端）
+func releaseSession(s *deviceSession) {
+	if *flagOTG && loadControlConn() == s.control {
+		destroyHIDDevices()
+	}
+
+	controlMu.Lock()
+	if loadControlConn() == s.control {
+		setControlConnLocked(nil)
+	}
+	controlMu.Unlock()
+
+	s.Close()
+}
+
+// restartADB 重新啟動 adb server 並重新列出裝置
+func restartADB() ([]adb.ADBDevice, error) {
+	if err := adb.RestartServer(); err != nil {
+		return nil, err
+	}
+	return adb.ListDevices()
+}
+
+// === HTTP: POST /adb/restart handler ===
+// 重新啟動 adb server（會中斷目前的裝置連線），回傳重新列出的裝置
+func handleADBRestart(w http.ResponseWriter, r *http.Request) {
+	if *flagReplay != "" {
+		writeError(w, http.StatusConflict, "replay_unsupported", "not supported for replay source")
+		return
+	}
+	stateMu.Lock()
+	s := curSession
+	curSession = nil
+	stateMu.Unlock()
+	if s != nil {
+		dropSession(s)
+	}
+
+	devs, err := restartADB()
+	if err != nil {
+		log.Printf("[ADB] 重新啟動 adb server 失敗: %v", err)
+		writeError(w, http.StatusBadGateway, "adb_failed", fmt.Sprintf("adb restart failed: %v", err))
+		return
+	}
+	log.Printf("[ADB] adb server 已依請求重新啟動，找到 %d 台裝置", len(devs))
+
+	if devs == nil {
+		devs = []adb.ADBDevice{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "ok",
+		"devices": devs,
+	})
+}
+
+// === HTTP: POST /devices/{id}/quality handler ===
+// 調整位元率/解析度上限：重新啟動 scrcpy server，已連線的前端沿用同一條 PeerConnection
+func handleDeviceQuality(w http.ResponseWriter, r *http.Request) {
+	id := pathDeviceID(r)
+
+	var req struct {
+		BitRate int `json:"bitRate"`
+		MaxSize int `json:"maxSize"` // 0 表示沿用目前設定
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if req.BitRate <= 0 || req.MaxSize < 0 {
+		writeError(w, http.StatusBadRequest, "invalid_request", "bitRate must be > 0 and maxSize >= 0")
+		return
+	}
+
+	stateMu.RLock()
+	s := curSession
+	stateMu.RUnlock()
+	if s == nil || s.id != id {
+		writeError(w, http.StatusNotFound, "device_not_found", "device not found")
+		return
+	}
+	if !requireADB(w, s) {
+		return
+	}
+
+	opts := s.dev.Options()
+	opts.BitRate = req.BitRate
+	if req.MaxSize > 0 {
+		opts.MaxSize = req.MaxSize
+	}
+	if _, err := restartSession(s, opts); err != nil {
+		writeRestartError(w, id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":  "ok",
+		"id":      id,
+		"bitRate": opts.BitRate,
+		"maxSize": opts.MaxSize,
+	})
+}
+
 // === WebRTC: /offer handler ===
 func handleOffer(w http.ResponseWriter, r *http.Request) {
 	var offer webrtc.SessionDescription
 	if err := json.NewDecoder(r.Body).Decode(&offer); err != nil {
-		http.Error(w, "invalid offer", http.StatusBadRequest)
+		writeError(w, http.StatusBadRequest, "invalid_offer", "invalid offer")
+		return
+	}
+	if id := r.URL.Query().Get("sessionId"); id != "" {
+		handleICERestart(w, id, offer)
 		return
 	}
 
-	log.Printf("🔌 收到 WebRTC offer，開始建立 ADB 連線 (目標: %s)", adbTarget)
+	// 選擇雙方都支援的視訊編碼（-replay 只有 H.264）
+	prefs := codecPrefs
+	if *flagReplay != "" {
+		prefs = []string{"h264"}
+	}
+	offered := offeredVideoCodecs(offer.SDP)
+	codec := pickCodec(prefs, offered)
+	if codec == "" {
+		writeError(w, http.StatusBadRequest, "no_common_codec", fmt.Sprintf("offer supports none of: %s", strings.Join(prefs, ", ")))
+		return
+	}
+	// ?maxWidth=N：此前端改收 ffmpeg 縮放後的 H.264，不論裝置串流的編碼都能加入同一個 session
+	maxWidth, err := parseMaxWidth(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+	if maxWidth > 0 && !offered["H264"] {
+		writeError(w, http.StatusBadRequest, "no_common_codec", "maxWidth requires an offer that supports H264")
+		return
+	}
 
-	// 建立 ADB 連線
-	videoStream, controlStream, err := connectToDevice()
+	// 裝置已有 session 且瀏覽器支援它的編碼時加入同一個 scrcpy 串流，否則建立新的 ADB 連線
+	stateMu.RLock()
+	target := adbTarget
+	nClients := countClientsLocked(deviceKey(target))
+	shared := curSession
+	if shared != nil && (shared.id != deviceKey(target) || (maxWidth == 0 && !offered[strings.ToUpper(shared.codec)])) {
+		shared = nil
+	}
+	if shared != nil {
+		codec = shared.codec
+	}
+	stateMu.RUnlock()
+	logger.Info("offer_received", "device", deviceKey(target), "clients", nClients, "codec", codec, "shared", shared != nil, "maxWidth", maxWidth)
+	if *flagMaxClients > 0 && nClients >= *flagMaxClients {
+		logger.Warn("offer_rejected", "device", deviceKey(target), "reason", "max_clients", "max", *flagMaxClients)
+		writeError(w, http.StatusTooManyRequests, "too_many_clients", "too many clients for this device")
+		return
+	}
+	if shared != nil {
+		offerPeer(w, r, offer, shared, newSessionID(), codec, false)
+		return
+	}
+	if isDeviceDead(target) {
+		logger.Warn("offer_rejected", "device", deviceKey(target), "reason", "device_dead")
+		writeError(w, http.StatusServiceUnavailable, "device_dead", "device marked dead after repeated connection failures: check it, then POST /devices/"+deviceKey(target)+"/revive")
+		return
+	}
+	opts := deviceOptions()
+	opts.VideoCodec = codec
+	sess, err := connectToDevice(target, opts)
+	noteConnectResult(target, err)
 	if err != nil {
-		log.Printf("❌ ADB 連線失敗: %v", err)
-		http.Error(w, fmt.Sprintf("ADB connection failed: %v", err), http.StatusInternalServerError)
+		if errors.Is(err, errSerialNotAllowed) {
+			writeError(w, http.StatusForbidden, "serial_not_allowed", err.Error())
+			return
+		}
+		logger.Error("adb_connect_failed", "device", deviceKey(target), "err", err)
+		switch {
+		case errors.Is(err, adb.ErrDeviceUnauthorized):
+			markPendingAuth(target)
+			writeError(w, http.StatusForbidden, "device_unauthorized", "device unauthorized: accept the USB debugging prompt on the device, then retry")
+		case errors.Is(err, adb.ErrDeviceNotFound):
+			writeError(w, http.StatusNotFound, "device_not_found", fmt.Sprintf("device not found: %v", err))
+		case errors.Is(err, adb.ErrDeviceOffline):
+			writeError(w, http.StatusServiceUnavailable, "device_offline", fmt.Sprintf("device offline: %v", err))
+		default:
+			writeError(w, http.StatusInternalServerError, "adb_failed", fmt.Sprintf("ADB connection failed: %v", err))
+		}
 		return
 	}
 
-	log.Printf("✅ ADB 連線成功，開始設定 WebRTC")
+	installSession(sess, codec)
+	offerPeer(w, r, offer, sess, sess.sid, codec, true)
+}
 
-	// 設定全域控制連線
-	controlConn = controlStream
+// installSession 將新建立的 session 設為目前的裝置連線並啟動它。
+// 取代舊的裝置連線（若有），避免殘留串流與 reverse 通道；它的前端不會再收到視訊，一併關閉
+func installSession(sess *deviceSession, codec string) {
+	sess.codec = codec
+	stateMu.Lock()
+	prev := curSession
+	curSession = sess
+	auSeq = 0
+	havePTS0 = false
+	pts0 = 0
+	rtpTS0 = 0
+	tsContinue = false // 新 track 從 0 開始
+	stateMu.Unlock()
+	if prev != nil {
+		prev.Close()
+		for _, pc := range devicePeerConns(prev.id) {
+			goSafe("pc-close", func() { closePeerConn(pc) })
+		}
+	}
 
-	// 啟動控制通道處理
-	goSafe("control-reader", func() {
-		defer func() {
-			if c, ok := controlStream.(io.Closer); ok {
-				c.Close()
-			}
-		}()
-		readDeviceMessages(controlConn)
-	})
+	startSession(sess)
+}
 
-	// 啟動控制健康檢查
-	goSafe("control-health", startControlHealthLoop)
+// offerPeer 為前端建立 PeerConnection 並回傳 answer。created 表示 sess 是這次 /offer 建立的：
+// 協商失敗且沒有其他前端加入時釋放它，不留下空轉的 scrcpy server
+func offerPeer(w http.ResponseWriter, r *http.Request, offer webrtc.SessionDescription, sess *deviceSession, sid, codec string, created bool) {
+	if *flagWakeOnConnect {
+		wakeDevice(sess)
+	}
+	established := false
+	defer func() {
+		if established || !created {
+			return
+		}
+		stateMu.Lock()
+		current := curSession == sess
+		inUse := current && countClientsLocked(sess.id) > 0 // 協商期間已有其他前端加入
+		if current && !inUse {
+			curSession = nil
+		}
+		stateMu.Unlock()
+		switch {
+		case inUse:
+		case current:
+			dropSession(sess)
+		default:
+			sess.Close()
+		}
+	}()
 
-	// 啟動視訊處理
-	goSafe("video-loop", func() {
-		defer videoStream.Close()
-		startVideoLoop(videoStream)
-	})
+	// ?maxWidth：前端收的是 ffmpeg 重新編碼的 H.264（handleOffer 已檢查參數）
+	maxWidth, _ := parseMaxWidth(r)
+	if maxWidth > 0 {
+		codec = "h264"
+	}
 
-	// 媒體編解碼：H.264 packetization-mode=1
+	// 媒體編解碼：只註冊選定的編碼，answer 必定使用它
 	m := webrtc.MediaEngine{}
-	if err := m.RegisterCodec(webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeH264,
-			ClockRate:    90000,
-			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
-			RTCPFeedback: []webrtc.RTCPFeedback{{Type: "nack"}, {Type: "nack", Parameter: "pli"}, {Type: "ccm", Parameter: "fir"}},
-		},
-		PayloadType: 96,
-	}, webrtc.RTPCodecTypeVideo); err != nil {
-		http.Error(w, "register codec error", http.StatusInternalServerError)
+	if err := m.RegisterCodec(codecParameters(codec), webrtc.RTPCodecTypeVideo); err != nil {
+		writeError(w, http.StatusInternalServerError, "internal_error", "register codec error")
 		return
 	}
 
-	api := webrtc.NewAPI(webrtc.WithMediaEngine(&m))
+	api := webrtc.NewAPI(webrtc.WithMediaEngine(&m), webrtc.WithSettingEngine(iceSettings()))
 	pc, err := api.NewPeerConnection(webrtc.Configuration{})
 	if err != nil {
-		http.Error(w, "pc error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "pc error")
 		return
 	}
-	peerConn = pc
-	evActivePeer.Set(1)
+	defer func() {
+		if !established {
+			closePeerConn(pc) // 協商途中失敗
+		}
+	}()
 
-	// 建立 H.264 RTP Track
+	// 建立視訊 RTP Track
 	track, err := webrtc.NewTrackLocalStaticRTP(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, ClockRate: 90000},
+		webrtc.RTPCodecCapability{MimeType: codecMimeTypes[codec], ClockRate: 90000},
 		"video", "scrcpy",
 	)
 	if err != nil {
-		http.Error(w, "track error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "track error")
 		return
 	}
 	sender, err := pc.AddTrack(track)
 	if err != nil {
-		http.Error(w, "add track error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "internal_error", "add track error")
 		return
 	}
 
-	// 讀 RTCP：PLI / FIR
+	// 以下的事件處理在 server 重啟（調整畫質、方向、看門狗）後仍會被呼叫：
+	// 只保留前端 ID 與裝置 ID，需要 session 時以 sessionForDevice 取得目前的那一個
+	devID, lg := sess.id, sess.log
+	if sid != sess.sid {
+		lg = lg.With("client", sid) // 加入既有 session 的前端
+	}
+
+	// 讀 RTCP：PLI / FIR；Receiver/Sender Report 的接收報告記錄到前端（見 clients.go）
 	goSafe("rtcp-reader", func() {
 		rtcpBuf := make([]byte, 1500)
 		for {
@@ -830,56 +1990,62 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 			if err != nil {
 				continue
 			}
+			noteClientRTCP(sid)
+			cur := sessionForDevice(devID)
 			for _, pkt := range pkts {
 				switch p := pkt.(type) {
 				case *rtcp.PictureLossIndication:
-					keyframeMu.Lock()
-					stateMu.Lock()
+					if noteKeyframeLoss(sid) && cur != nil {
+						recoverClientDecoder(cur, sid)
+					}
 					// 避免重複請求：如果已經在等待關鍵幀，則跳過
-					if !needKeyframe {
-						needKeyframe = true
-						lastPLI = time.Now()
-						pliCount++
-						stateMu.Unlock()
+					if markClientNeedsKeyframe(sid) {
+						n := notePLI()
 						evRTCP_PLI.Add(1)
-						evPLICount.Set(int64(pliCount))
-						log.Printf("[RTCP] 收到 PLI，請求關鍵幀")
-						requestKeyframe()
-						evKeyframeRequests.Add(1)
+						evPLICount.Set(int64(n))
+						log.Printf("[RTCP][%s] 收到 PLI，請求關鍵幀", sid)
+						if cur != nil {
+							requestKeyframeDebounced(cur, "pli")
+						}
 					} else {
-						stateMu.Unlock()
-						log.Printf("[RTCP] 收到 PLI，但已在等待關鍵幀中，跳過")
+						log.Printf("[RTCP][%s] 收到 PLI，但已在等待關鍵幀中，跳過", sid)
 					}
-					keyframeMu.Unlock()
 				case *rtcp.FullIntraRequest:
-					keyframeMu.Lock()
-					stateMu.Lock()
-					if !needKeyframe {
-						needKeyframe = true
-						lastPLI = time.Now()
-						pliCount++
-						stateMu.Unlock()
+					if noteKeyframeLoss(sid) && cur != nil {
+						recoverClientDecoder(cur, sid)
+					}
+					if markClientNeedsKeyframe(sid) {
+						n := notePLI()
 						evRTCP_FIR.Add(1)
-						evPLICount.Set(int64(pliCount))
-						log.Printf("[RTCP] 收到 FIR，請求關鍵幀 (SenderSSRC=%d, MediaSSRC=%d)", p.SenderSSRC, p.MediaSSRC)
-						requestKeyframe()
-						evKeyframeRequests.Add(1)
+						evPLICount.Set(int64(n))
+						log.Printf("[RTCP][%s] 收到 FIR，請求關鍵幀 (SenderSSRC=%d, MediaSSRC=%d)", sid, p.SenderSSRC, p.MediaSSRC)
+						if cur != nil {
+							requestKeyframeDebounced(cur, "fir")
+						}
 					} else {
-						stateMu.Unlock()
-						log.Printf("[RTCP] 收到 FIR，但已在等待關鍵幀中，跳過")
+						log.Printf("[RTCP][%s] 收到 FIR，但已在等待關鍵幀中，跳過", sid)
 					}
-					keyframeMu.Unlock()
+				case *rtcp.ReceiverReport:
+					noteReceptionReports(sid, p.Reports)
+				case *rtcp.SenderReport:
+					noteReceptionReports(sid, p.Reports)
 				}
 			}
 		}
 	})
 
 	// 接前端 DataChannel（印原始資料 → 解析 → 注入）
-	pc.OnDataChannel(func(dc *webrtc.DataChannel) {
+	handleDC := func(dc *webrtc.DataChannel) {
 		log.Println("[RTC] DataChannel:", dc.Label())
 
-		dc.OnOpen(func() { log.Println("[RTC] DC open:", dc.Label()) })
-		dc.OnClose(func() { log.Println("[RTC] DC close:", dc.Label()) })
+		dc.OnOpen(func() {
+			log.Println("[RTC] DC open:", dc.Label())
+			setClientDC(sid, dc)
+		})
+		dc.OnClose(func() {
+			log.Println("[RTC] DC close:", dc.Label())
+			clearClientDC(sid, dc)
+		})
 
 		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
 			log.Printf("[RTC][DC:%s] recv isString=%v len=%d", dc.Label(), msg.IsString, len(msg.Data))
@@ -911,105 +2077,360 @@ func handleOffer(w http.ResponseWriter, r *http.Request) {
 			log.Printf("[CTRL] touch: type=%s id=%d x=%d y=%d pressure=%.3f buttons=%d pointerType=%s screen=%dx%d",
 				ev.Type, ev.ID, ev.X, ev.Y, ev.Pressure, ev.Buttons, ev.PointerType, ev.ScreenW, ev.ScreenH)
 
-			handleTouchEvent(ev)
+			cur := sessionForDevice(devID)
+			switch {
+			case ev.Type == "pong":
+				handlePong(sid, ev.T)
+			case ev.Type == "scroll":
+				handleScrollEvent(cur, ev)
+			case cur == nil && (ev.Type == "showTouches" || ev.Type == "keyboardSettings" || panelMessages[ev.Type] != 0):
+				log.Printf("[RTC][DC:%s] 裝置已中斷，忽略 %s", dc.Label(), ev.Type)
+			case ev.Type == "showTouches":
+				goSafe("show-touches", func() { setShowTouches(cur, ev.On) })
+			case ev.Type == "keyboardSettings":
+				openKeyboardSettings(cur)
+			case panelMessages[ev.Type] != 0:
+				sendPanelControl(cur, ev.Type)
+			case ev.Type == "keydown" || ev.Type == "keyup":
+				if !*flagOTG {
+					log.Printf("[CTRL] 鍵盤事件僅在 -otg 模式支援，忽略 code=%s", ev.Code)
+					return
+				}
+				handleHIDKey(ev)
+			case *flagOTG && ev.PointerType == "mouse":
+				handleHIDMouse(ev)
+			default:
+				handleTouchEvent(cur, ev)
+			}
 		})
-	})
+	}
+	// view-only（全域 -view-only 或 ?viewOnly=true）：不註冊 DataChannel，前端無法注入任何輸入
+	if *flagViewOnly || r.URL.Query().Get("viewOnly") == "true" {
+		sess.log.Info("view_only")
+	} else {
+		pc.OnDataChannel(handleDC)
+	}
 
 	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
-		log.Println("[RTC] PeerConnection state:", s.String())
+		lg.Info("peer_state", "state", s.String())
+		if s == webrtc.PeerConnectionStateConnected {
+			// track 綁定後才能送出 RTP：於此時（含 ICE restart 後）開始發送，補送參數集並請求關鍵幀
+			if cur := sessionForDevice(devID); clientConnected(sid, pc) && cur != nil {
+				requestKeyframeDebounced(cur, "client_connected")
+			}
+		}
 		if s == webrtc.PeerConnectionStateFailed ||
-			s == webrtc.PeerConnectionStateClosed ||
 			s == webrtc.PeerConnectionStateDisconnected {
-			stateMu.Lock()
-			videoTrack = nil
-			packetizer = nil
-			stateMu.Unlock()
-			evActivePeer.Set(0)
+			clientDisconnected(sid, pc) // 保留登記，供 ICE restart 恢復
+		}
+		if s == webrtc.PeerConnectionStateClosed {
+			removeClient(sid, pc)
+		}
+		if s == webrtc.PeerConnectionStateFailed {
+			// Failed 不會自行轉為 Closed：給前端 iceRestartGrace 以 ICE restart 恢復，
+			// 逾時仍為 Failed 才主動關閉，讓 rtcp-reader（sender.Read 回錯誤）與 DataChannel 一併結束
+			goSafe("pc-close", func() {
+				time.Sleep(iceRestartGrace)
+				if pc.ConnectionState() == webrtc.PeerConnectionStateFailed {
+					closePeerConn(pc)
+				}
+			})
 		}
 	})
 
 	// 設定 Remote SDP / Answer / 等待 ICE（非 trickle）
 	if err := pc.SetRemoteDescription(offer); err != nil {
-		http.Error(w, "set remote error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "invalid_offer", "set remote error")
 		return
 	}
 	answer, err := pc.CreateAnswer(nil)
 	if err != nil {
-		http.Error(w, "answer error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "answer_failed", "answer error")
 		return
 	}
 	if err := pc.SetLocalDescription(answer); err != nil {
-		http.Error(w, "set local error", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, "answer_failed", "set local error")
 		return
 	}
 	<-webrtc.GatheringCompletePromise(pc)
+	established = true
 
-	// 初始化發送端狀態
-	stateMu.Lock()
-	videoTrack = track
-	packetizer = rtp.NewPacketizer(
-		1200,
+	// 初始化此前端的發送端狀態
+	pk := rtp.NewPacketizer(
+		uint16(*flagRTPMTU),
 		96,
 		uint32(time.Now().UnixNano()),
-		&codecs.H264Payloader{},
+		newPayloader(codec),
 		rtp.NewRandomSequencer(),
 		90000,
 	)
-	needKeyframe = true // 新用戶：先送 SPS/PPS，再等 IDR
-	auSeq = 0
-	havePTS0 = false
-	pts0 = 0
-	rtpTS0 = 0
-	stateMu.Unlock()
+	client := newClient(sid, sess.id, pc, track, pk)
+	client.ssrc = senderSSRC(sender)
+	// 縮圖牆等低頻寬監看：只送關鍵幀，由視訊迴圈每 keyframeTick 主動請求一次
+	client.keyframesOnly = r.URL.Query().Get("keyframesOnly") == "true"
+	if maxWidth > 0 {
+		client.transcoder = newTranscoder(client, maxWidth)
+	}
+	addClient(client)
+	logger.Info("client_registered", "device", sess.id, "session", sid, "ssrc", client.ssrc, "maxWidth", maxWidth)
+	goSafe("client-ping", func() { startClientPing(client) })
 
 	log.Println("[WebRTC] packetizer 初始化完成，等待視訊流請求關鍵幀...")
 
-	// 回傳 Answer（含 ICE）
+	// 回傳 Answer（含 ICE）；session ID 供前端之後以 ICE restart 恢復同一條連線
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Session-Id", sid)
 	_ = json.NewEncoder(w).Encode(pc.LocalDescription())
 }
 
+// iceSettings 回傳 PeerConnection 的 ICE 設定。預設與空的 SettingEngine 相同：
+// 未設定 STUN/TURN，只會有 host candidate。-lan-only 另外限制為私有/本機位址的 IPv4 UDP，
+// 略過 IPv6 與對外介面，區網內連線更快完成
+func iceSettings() webrtc.SettingEngine {
+	var se webrtc.SettingEngine
+	if *flagLANOnly {
+		se.SetNetworkTypes([]webrtc.NetworkType{webrtc.NetworkTypeUDP4})
+		se.SetIPFilter(func(ip net.IP) bool {
+			return ip.IsPrivate() || ip.IsLoopback() || ip.IsLinkLocalUnicast()
+		})
+	}
+	return se
+}
+
+// h264ProfileLevelID 回傳 SDP fmtp 使用的 profile-level-id。
+// auto 模式取快取 SPS 的 profile_idc、constraint flags 與 level_idc（尚無 SPS 時退回 Baseline 3.1），
+// 避免 fmtp 宣告的 profile 與實際串流不符導致部分瀏覽器解碼失敗
+func h264ProfileLevelID() string {
+	const fallback = "42e01f"
+	if *flagH264Profile != "auto" {
+		return *flagH264Profile
+	}
+	stateMu.RLock()
+	sps := lastSPS
+	stateMu.RUnlock()
+	if len(sps) < 4 || naluType(sps) != 7 {
+		return fallback
+	}
+	return hex.EncodeToString(sps[1:4])
+}
+
 // 要求 Android 重新送出關鍵幀
 func requestKeyframe() {
-	if controlConn == nil {
+	if loadControlConn() == nil {
 		log.Println("[CTRL] requestKeyframe: controlConn is nil")
 		return
 	}
-	controlMu.Lock()
-	defer controlMu.Unlock()
-
-	// 添加寫入超時以避免阻塞
-	if conn, ok := controlConn.(net.Conn); ok {
-		conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
-		defer conn.SetWriteDeadline(time.Time{}) // 清除超時
-	}
 
 	// 控制訊息：TYPE_RESET_VIDEO 僅 1 byte
-	if _, err := controlConn.Write([]byte{controlMsgResetVideo}); err != nil {
+	if err := writeFull([]byte{controlMsgResetVideo}, *flagCtrlBgTimeout, true); err != nil {
 		log.Printf("[CTRL] send RESET_VIDEO failed: %v", err)
 	} else {
+		lastResetVideoAt.Store(time.Now().UnixNano())
 		log.Println("[CTRL] 已送出 RESET_VIDEO")
 	}
 }
 
+// requestKeyframeDebounced 合併同一裝置在 keyframeDebounce 內的關鍵幀請求：
+// 多個前端幾乎同時連上時只送一次 RESET_VIDEO，由進行中的 IDR 一起滿足，避免連續 IDR 造成頻寬尖峰。
+// 被合併的請求在視窗結束時若仍在等待關鍵幀會補送一次（畫面靜止時沒有新幀可觸發每 30 幀的重送）
+func requestKeyframeDebounced(sess *deviceSession, reason string) {
+	stateMu.Lock()
+	since := time.Since(sess.lastKeyframeReq)
+	if since < keyframeDebounce {
+		scheduled := sess.keyframeTrailing
+		sess.keyframeTrailing = true
+		stateMu.Unlock()
+		evKeyframeDebounced.Add(1)
+		sess.log.Debug("keyframe_request_debounced", "reason", reason, "since", since)
+		if !scheduled {
+			time.AfterFunc(keyframeDebounce-since, func() { requestKeyframeTrailing(sess) })
+		}
+		return
+	}
+	sess.lastKeyframeReq = time.Now()
+	stateMu.Unlock()
+	requestKeyframe()
+	evKeyframeRequests.Add(1)
+}
+
+// requestKeyframeTrailing 於去抖動視窗結束時執行：期間有請求被合併且仍未收到 IDR 時補送
+func requestKeyframeTrailing(sess *deviceSession) {
+	stateMu.Lock()
+	sess.keyframeTrailing = false
+	send := awaitingKeyframeLocked(sess.id) && curSession == sess
+	if send {
+		sess.lastKeyframeReq = time.Now()
+	}
+	stateMu.Unlock()
+	if send {
+		requestKeyframe()
+		evKeyframeRequests.Add(1)
+	}
+}
+
+// awakeDevices 記錄已送過喚醒訊息的裝置（deviceKey，受 stateMu 保護）；裝置最後一個前端離開時由 removeClient 清除
+var awakeDevices = make(map[string]bool)
+
+// wakeDevice 在裝置第一個前端連上時喚醒螢幕，避免一開始收到黑畫面；之後的前端與 server 重啟都不再送，
+// 直到所有前端離開。送 KEYCODE_WAKEUP 的 DOWN/UP：BACK_OR_SCREEN_ON 在螢幕已開啟時會注入返回鍵，
+// WAKEUP 只在螢幕關閉時喚醒，不會留下未放開的按鍵或讓前景 App 返回上一頁
+func wakeDevice(sess *deviceSession) {
+	stateMu.Lock()
+	if awakeDevices[sess.id] {
+		stateMu.Unlock()
+		return
+	}
+	awakeDevices[sess.id] = true
+	stateMu.Unlock()
+
+	enqueueControl(encodeKeycodeEvent(keyActionDown, keycodeWakeup), *flagCtrlTimeout, false)
+	enqueueControl(encodeKeycodeEvent(keyActionUp, keycodeWakeup), *flagCtrlTimeout, false)
+	sess.log.Info("wake_on_connect")
+}
+
+// savedShowTouches 為裝置第一次變更 show_touches 前的原值，以及還原時使用的 adb 裝置
+type savedShowTouches struct {
+	dev  *adb.Device
+	prev string
+}
+
+// showTouchesSaved 記錄已變更過 show_touches 的裝置（deviceKey，受 stateMu 保護）；
+// 跨 restartSession 保留，裝置最後一個前端離開時由 removeClient 還原並清除
+var showTouchesSaved = make(map[string]savedShowTouches)
+
+// setShowTouches 切換裝置的「顯示觸控」（settings system show_touches），方便示範時看到觸控位置；
+// scrcpy 協定沒有對應訊息，改以 adb shell 設定。第一次變更前記下原值，最後一個前端離開時還原
+func setShowTouches(sess *deviceSession, on bool) {
+	if sess.dev == nil {
+		sess.log.Warn("show_touches_unsupported", "reason", "no adb device")
+		return
+	}
+	stateMu.RLock()
+	_, saved := showTouchesSaved[sess.id]
+	stateMu.RUnlock()
+	if !saved {
+		prev, err := sess.dev.GetSetting("system", "show_touches")
+		if err != nil {
+			sess.log.Warn("show_touches_failed", "err", err)
+			return
+		}
+		stateMu.Lock()
+		if _, ok := showTouchesSaved[sess.id]; !ok {
+			showTouchesSaved[sess.id] = savedShowTouches{dev: sess.dev, prev: prev}
+		}
+		stateMu.Unlock()
+	}
+	value := "0"
+	if on {
+		value = "1"
+	}
+	if err := sess.dev.SetSetting("system", "show_touches", value); err != nil {
+		sess.log.Warn("show_touches_failed", "err", err)
+		return
+	}
+	sess.log.Info("show_touches", "on", on)
+}
+
+// restoreShowTouches 還原裝置變更前的 show_touches（原本未設定時視為 0）
+func restoreShowTouches(id string, saved savedShowTouches) {
+	prev := saved.prev
+	if prev != "1" {
+		prev = "0"
+	}
+	if err := saved.dev.SetSetting("system", "show_touches", prev); err != nil {
+		logger.Warn("show_touches_restore_failed", "device", id, "err", err)
+		return
+	}
+	logger.Info("show_touches_restored", "device", id, "value", prev)
+}
+
+// openKeyboardSettings 開啟裝置的實體鍵盤設定（可切換輸入法、啟用 -otg 的 HID 鍵盤），方便沒有軟體鍵盤的裝置輸入文字。
+// 訊息於 scrcpy 2.4 加入，舊版 server 會因未知的訊息類型中斷控制通道，因此版本不足時不送出；-replay 沒有裝置，直接忽略
+func openKeyboardSettings(sess *deviceSession) {
+	if sess.dev == nil {
+		sess.log.Info("keyboard_settings_ignored", "reason", "no adb device")
+		return
+	}
+	if !versionAtLeast(adb.ServerVersion, 2, 4) {
+		sess.log.Warn("keyboard_settings_unsupported", "server", adb.ServerVersion)
+		return
+	}
+	enqueueControl([]byte{controlMsgKbdSettings}, *flagCtrlTimeout, false)
+	sess.log.Info("keyboard_settings")
+}
+
+// panelMessages 為 DataChannel 訊息類型 → 通知欄控制訊息（單一 byte，編號依 scrcpy 3.x 的 ControlMessage）
+var panelMessages = map[string]byte{
+	"expandNotifications": controlMsgExpandNotif,
+	"expandSettings":      controlMsgExpandSets,
+	"collapsePanels":      controlMsgCollapse,
+}
+
+// sendPanelControl 展開通知欄/快速設定或收起面板；-replay 沒有裝置，直接忽略
+func sendPanelControl(sess *deviceSession, name string) {
+	if sess.dev == nil {
+		sess.log.Info("panel_ignored", "action", name, "reason", "no adb device")
+		return
+	}
+	enqueueControl([]byte{panelMessages[name]}, *flagCtrlTimeout, false)
+	sess.log.Info("panel", "action", name)
+}
+
+// versionAtLeast 比較 "major.minor[.patch]" 形式的版本字串
+func versionAtLeast(v string, major, minor int) bool {
+	var ma, mi int
+	if _, err := fmt.Sscanf(v, "%d.%d", &ma, &mi); err != nil {
+		return false
+	}
+	return ma > major || (ma == major && mi >= minor)
+}
+
 // 主動向 server 要求回傳剪貼簿（作為健康心跳）
 func sendGetClipboard(copyKey byte) {
-	if controlConn == nil {
+	if loadControlConn() == nil {
 		return
 	}
-	controlMu.Lock()
-	defer controlMu.Unlock()
 	// [type=8][copyKey=1B]
-	if _, err := controlConn.Write([]byte{controlMsgGetClipboard, copyKey}); err != nil {
+	if err := writeFull([]byte{controlMsgGetClipboard, copyKey}, *flagCtrlBgTimeout, true); err != nil {
 		log.Println("[CTRL] send GET_CLIPBOARD:", err)
 	} else {
 		log.Println("[CTRL] 已送出 GET_CLIPBOARD (heartbeat)")
 	}
 }
 
+// resyncFrame 在 frame meta 錯位後逐 byte 往後掃描，尋找「12 bytes meta + Annex-B 起始碼（00 00 00 01 或 00 00 01）」
+// 且 meta 中大小合理的位置；回傳該 frame 的 PTS、大小與已讀取的起始碼（frame 開頭）
+func resyncFrame(r io.Reader, maxSize uint32) (pts uint64, size uint32, prefix []byte, err error) {
+	const win = 12 + 4
+	var window [win]byte
+	var b [1]byte
+	limit := int64(maxSize) * 2
+	for scanned := int64(0); scanned < limit; scanned++ {
+		if _, err = io.ReadFull(r, b[:]); err != nil {
+			return 0, 0, nil, err
+		}
+		copy(window[:], window[1:])
+		window[win-1] = b[0]
+		// 先比對 4 bytes 起始碼：其末 3 bytes 也符合 3 bytes 起始碼，但 meta 位置不同
+		for _, sc := range [][]byte{{0, 0, 0, 1}, {0, 0, 1}} {
+			start := win - len(sc) - 12 // meta 在 window 中的起點
+			if scanned+1 < int64(win-start) || !bytes.Equal(window[win-len(sc):], sc) {
+				continue
+			}
+			size = binary.BigEndian.Uint32(window[start+8 : start+12])
+			if size <= uint32(len(sc)) || size > maxSize {
+				continue
+			}
+			pts = binary.BigEndian.Uint64(window[start : start+8])
+			return pts, size, append([]byte(nil), window[win-len(sc):]...), nil
+		}
+	}
+	return 0, 0, nil, fmt.Errorf("no valid frame found within %d bytes", limit)
+}
+
 // === 控制通道讀回（DeviceMessage）===
 // 目前解析 TYPE_CLIPBOARD： [type(1)][len(4 BE)][utf8 bytes]
-func readDeviceMessages(r io.Reader) {
+func readDeviceMessages(r io.Reader, sess *deviceSession) {
 	buf := make([]byte, 0, 4096)
 	readU8 := func() (byte, error) {
 		var b [1]byte
@@ -1021,6 +2442,11 @@ func readDeviceMessages(r io.Reader) {
 		_, err := io.ReadFull(r, b[:])
 		return binary.BigEndian.Uint32(b[:]), err
 	}
+	readU64BE := func() (uint64, error) {
+		var b [8]byte
+		_, err := io.ReadFull(r, b[:])
+		return binary.BigEndian.Uint64(b[:]), err
+	}
 
 	for {
 		typ, err := readU8()
@@ -1070,6 +2496,47 @@ func readDeviceMessages(r io.Reader) {
 			evCtrlReadsOK.Add(1)
 			evCtrlReadClipboardB.Add(int64(n))
 			log.Printf("[CTRL][READ] DeviceMessage.CLIPBOARD %dB: %q", n, trimString(string(buf[:n]), 200))
+			text := string(buf[:n])
+			stateMu.Lock()
+			changed := sess.clipboard != text // GET_CLIPBOARD 心跳會重複回報相同內容
+			sess.clipboard = text
+			sess.clipboardAt = time.Now()
+			stateMu.Unlock()
+			if changed && *flagClipSync {
+				broadcastClipboard(sess, text)
+			}
+		case deviceMsgTypeAckClip:
+			seq, err := readU64BE()
+			if err != nil {
+				log.Println("[CTRL][READ] ack clipboard err:", err)
+				evCtrlReadsErr.Add(1)
+				return
+			}
+			lastCtrlRead = time.Now()
+			evCtrlReadsOK.Add(1)
+			log.Printf("[CTRL][READ] DeviceMessage.ACK_CLIPBOARD seq=%d", seq)
+			stateMu.Lock()
+			sess.clipAckSeq = seq
+			stateMu.Unlock()
+		case deviceMsgTypeUHIDOut:
+			// [id u16][size u16][data]：HID output report（例如鍵盤 LED），轉給前端顯示
+			var hdr [4]byte
+			if _, err := io.ReadFull(r, hdr[:]); err != nil {
+				log.Println("[CTRL][READ] uhid output err:", err)
+				evCtrlReadsErr.Add(1)
+				return
+			}
+			id, size := binary.BigEndian.Uint16(hdr[:2]), binary.BigEndian.Uint16(hdr[2:])
+			report := make([]byte, size)
+			if _, err := io.ReadFull(r, report); err != nil {
+				log.Println("[CTRL][READ] uhid output err:", err)
+				evCtrlReadsErr.Add(1)
+				return
+			}
+			lastCtrlRead = time.Now()
+			evCtrlReadsOK.Add(1)
+			log.Printf("[CTRL][READ] DeviceMessage.UHID_OUTPUT id=%d % x", id, report)
+			sendToClients(sess.id, hidOutputMessage(id, report))
 		default:
 			// 未知型別：無長度資訊 → 無法安全跳過，只記錄
 			lastCtrlRead = time.Now()
@@ -1079,61 +2546,43 @@ func readDeviceMessages(r io.Reader) {
 	}
 }
 
-func trimString(s string, max int) string {
-	if len(s) <= max {
-		return s
+// sendToClients 將 JSON 訊息透過 DataChannel 傳給裝置的所有前端（通道未開啟的略過）
+func sendToClients(device string, v any) {
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	for _, c := range clients {
+		if c.device == device {
+			sendOnDC(c.dc, v)
+		}
 	}
-	return s[:max] + "...(truncated)"
 }
 
-// === RTP 發送（以指定 TS）===
-func sendNALUAccessUnitAtTS(nalus [][]byte, ts uint32) {
-	stateMu.RLock()
-	pk := packetizer
-	vt := videoTrack
-	stateMu.RUnlock()
-	if pk == nil || vt == nil || len(nalus) == 0 {
+// sendOnDC 以 JSON 文字送出到指定 DataChannel；通道未開啟時略過
+func sendOnDC(dc *webrtc.DataChannel, v any) {
+	if dc == nil || dc.ReadyState() != webrtc.DataChannelStateOpen {
 		return
 	}
-	for i, n := range nalus {
-		if len(n) == 0 {
-			continue
-		}
-		pkts := pk.Packetize(n, 0) // samples=0，手動覆寫 Timestamp
-		for j, p := range pkts {
-			p.Timestamp = ts
-			p.Marker = (i == len(nalus)-1) && (j == len(pkts)-1)
-			if err := vt.WriteRTP(p); err != nil {
-				log.Printf("[RTP] write error: %v (seq=%d, ts=%d)", err, p.SequenceNumber, p.Timestamp)
-				evRTPWriteErrors.Add(1)
-			} else {
-				evRTPPacketsSent.Add(1)
-			}
-		}
-	}
-}
-func sendNALUsAtTS(ts uint32, nalus ...[]byte) {
-	stateMu.RLock()
-	pk := packetizer
-	vt := videoTrack
-	stateMu.RUnlock()
-	if pk == nil || vt == nil {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[RTC] marshal DC message: %v", err)
 		return
 	}
-	for i, n := range nalus {
-		if len(n) == 0 {
-			continue
-		}
-		pkts := pk.Packetize(n, 0)
-		for j, p := range pkts {
-			p.Timestamp = ts
-			// 最後一個 NALU 的最後一個封包才設 marker
-			p.Marker = (i == len(nalus)-1) && (j == len(pkts)-1)
-			if err := vt.WriteRTP(p); err != nil {
-				log.Println("[RTP] write error:", err)
-			}
-		}
+	if err := dc.SendText(string(b)); err != nil {
+		log.Printf("[RTC][DC:%s] send error: %v", dc.Label(), err)
+	}
+}
+
+func trimString(s string, max int) string {
+	if len(s) <= max {
+		return s
 	}
+	return s[:max] + "...(truncated)"
+}
+
+// sendFrameMarker 於 -latency-probe 時在 AU 送出後通知前端：seq 為該前端遞增的 AU 計數，
+// ts 為送出時間（Unix ms），rtpTs 供前端對應 requestVideoFrameCallback 的 rtpTimestamp
+func sendFrameMarker(dc *webrtc.DataChannel, seq uint64, rtpTS uint32) {
+	sendOnDC(dc, map[string]any{"type": "frameMarker", "seq": seq, "ts": time.Now().UnixMilli(), "rtpTs": rtpTS})
 }
 
 // === Annex-B 工具 ===
@@ -1182,9 +2631,12 @@ func naluType(n []byte) uint8 {
 }
 
 // === PTS → RTP TS 轉換 ===
+// rtpTSFromPTS 將 PTS（微秒）相對於 base 的差換算為 90kHz 的 RTP 時間戳差。
+// 差值以有號數計算：編碼器輸出 B-frame 等重新排序的幀時 PTS 可能小於 base，
+// 此時得到略早的時間戳（RTP 時間戳本身以 32 位元循環），而不是無號相減溢位後的巨大數值
 func rtpTSFromPTS(pts, base uint64) uint32 {
-	delta := pts - base
-	return uint32((delta * 90000) / ptsPerSecond) // 90kHz * 秒數
+	delta := int64(pts - base)
+	return uint32(delta * 90000 / int64(ptsPerSecond)) // 90kHz * 秒數
 }
 
 // === H.264 SPS 解析寬高（極簡）===
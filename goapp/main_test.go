@@ -0,0 +1,1302 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v4"
+)
+
+// frameBytes 組出一個 scrcpy frame：12 bytes meta（PTS + 大小）接著 payload
+func frameBytes(pts uint64, payload []byte) []byte {
+	b := make([]byte, 12, 12+len(payload))
+	binary.BigEndian.PutUint64(b[0:8], pts)
+	binary.BigEndian.PutUint32(b[8:12], uint32(len(payload)))
+	return append(b, payload...)
+}
+
+func TestResyncFrame(t *testing.T) {
+	const maxSize = 1 << 10
+	// 錯位的 meta：大小欄位遠超上限，其後夾雜看似起始碼但大小不合理的垃圾
+	garbage := []byte{0xde, 0xad, 0xbe, 0xef, 0xde, 0xad, 0xbe, 0xef, 0x7f, 0xff, 0xff, 0xff, 0, 0, 0, 1,
+		0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0, 0, 1}
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{"4-byte start code", []byte{0, 0, 0, 1, 0x65, 0x88, 0x84, 0x21}},
+		{"3-byte start code", []byte{0, 0, 1, 0x65, 0x88, 0x84}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := append(append([]byte(nil), garbage...), frameBytes(123456, tt.payload)...)
+			r := bytes.NewReader(stream)
+			pts, size, prefix, err := resyncFrame(r, maxSize)
+			if err != nil {
+				t.Fatalf("resyncFrame: %v", err)
+			}
+			if pts != 123456 || size != uint32(len(tt.payload)) {
+				t.Fatalf("got pts=%d size=%d, want pts=123456 size=%d", pts, size, len(tt.payload))
+			}
+			rest := make([]byte, int(size)-len(prefix))
+			if _, err := io.ReadFull(r, rest); err != nil {
+				t.Fatalf("read rest of frame: %v", err)
+			}
+			if got := append(prefix, rest...); !bytes.Equal(got, tt.payload) {
+				t.Fatalf("frame = % x, want % x", got, tt.payload)
+			}
+		})
+	}
+}
+
+func TestResyncFrameGivesUp(t *testing.T) {
+	r := bytes.NewReader(bytes.Repeat([]byte{0xff}, 64))
+	if _, _, _, err := resyncFrame(r, 16); err == nil {
+		t.Fatal("expected an error when no frame can be found")
+	}
+}
+
+func TestToDeviceSpace(t *testing.T) {
+	tests := []struct {
+		name           string
+		x, y           int32
+		cw, ch, dw, dh uint16
+		wantX, wantY   int32
+		wantW, wantH   uint16
+	}{
+		{"same size", 100, 200, 1080, 2340, 1080, 2340, 100, 200, 1080, 2340},
+		{"within tolerance is not scaled", 1079, 2339, 1080, 2338, 1080, 2340, 1079, 2339, 1080, 2340},
+		{"client half size", 270, 585, 540, 1170, 1080, 2340, 540, 1170, 1080, 2340},
+		{"client larger than device", 2000, 1000, 2160, 4680, 1080, 2340, 1000, 500, 1080, 2340},
+		{"clamp negative", -5, -1, 1080, 2340, 1080, 2340, 0, 0, 1080, 2340},
+		{"clamp past right/bottom edge", 1080, 2340, 1080, 2340, 1080, 2340, 1079, 2339, 1080, 2340},
+		{"clamp after scaling", 600, 1300, 540, 1170, 1080, 2340, 1079, 2339, 1080, 2340},
+		{"unknown device size uses client size", 50, 60, 720, 1280, 0, 0, 50, 60, 720, 1280},
+		{"unknown device size still clamps", 800, 1300, 720, 1280, 0, 0, 719, 1279, 720, 1280},
+		{"unknown client size is not scaled", 10, 20, 0, 0, 1080, 2340, 10, 20, 1080, 2340},
+		// 前端仍為橫向、裝置已轉回直向：先轉向再縮放
+		{"landscape client, portrait device", 0, 0, 1170, 540, 1080, 2340, 1078, 0, 1080, 2340},
+		{"portrait client, landscape device", 100, 200, 1080, 2340, 2340, 1080, 200, 979, 2340, 1080},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y, w, h := toDeviceSpace(tt.x, tt.y, tt.cw, tt.ch, tt.dw, tt.dh)
+			if x != tt.wantX || y != tt.wantY || w != tt.wantW || h != tt.wantH {
+				t.Fatalf("toDeviceSpace(%d, %d, %dx%d, %dx%d) = (%d, %d, %dx%d), want (%d, %d, %dx%d)",
+					tt.x, tt.y, tt.cw, tt.ch, tt.dw, tt.dh, x, y, w, h, tt.wantX, tt.wantY, tt.wantW, tt.wantH)
+			}
+		})
+	}
+}
+
+func TestRotateToOrientation(t *testing.T) {
+	tests := []struct {
+		name         string
+		x, y         int32
+		cw, ch       uint16
+		wantX, wantY int32
+		wantW, wantH uint16
+	}{
+		// 直向 → 橫向：(x, y) → (y, w-1-x)，直向的右緣成為上緣
+		{"portrait top-left", 0, 0, 1080, 2340, 0, 1079, 2340, 1080},
+		{"portrait top-right", 1079, 0, 1080, 2340, 0, 0, 2340, 1080},
+		{"portrait bottom-left", 0, 2339, 1080, 2340, 2339, 1079, 2340, 1080},
+		{"portrait inner point", 100, 200, 1080, 2340, 200, 979, 2340, 1080},
+		// 橫向 → 直向：(x, y) → (h-1-y, x)
+		{"landscape top-left", 0, 0, 2340, 1080, 1079, 0, 1080, 2340},
+		{"landscape bottom-right", 2339, 1079, 2340, 1080, 0, 2339, 1080, 2340},
+		{"landscape inner point", 200, 979, 2340, 1080, 100, 200, 1080, 2340},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			x, y, w, h := rotateToOrientation(tt.x, tt.y, tt.cw, tt.ch)
+			if x != tt.wantX || y != tt.wantY || w != tt.wantW || h != tt.wantH {
+				t.Fatalf("rotateToOrientation(%d, %d, %dx%d) = (%d, %d, %dx%d), want (%d, %d, %dx%d)",
+					tt.x, tt.y, tt.cw, tt.ch, x, y, w, h, tt.wantX, tt.wantY, tt.wantW, tt.wantH)
+			}
+			// 轉回原方向應得到原座標
+			bx, by, bw, bh := rotateToOrientation(x, y, w, h)
+			if bx != tt.x || by != tt.y || bw != tt.cw || bh != tt.ch {
+				t.Fatalf("round trip = (%d, %d, %dx%d), want (%d, %d, %dx%d)", bx, by, bw, bh, tt.x, tt.y, tt.cw, tt.ch)
+			}
+		})
+	}
+}
+
+func TestEncodeScrollEvent(t *testing.T) {
+	tests := []struct {
+		name             string
+		hscroll, vscroll float64
+		want             []byte // hscroll、vscroll 兩個 i16fp 欄位
+	}{
+		// 0.5/16 × 2^15 = 1024
+		{"half line down", 0, 0.5, []byte{0x00, 0x00, 0x04, 0x00}},
+		// 3/16 × 2^15 = 6144
+		{"three lines down", 0, 3, []byte{0x00, 0x00, 0x18, 0x00}},
+		{"three lines up", 0, -3, []byte{0x00, 0x00, 0xe8, 0x00}},
+		{"half line right", 0.5, 0, []byte{0x04, 0x00, 0x00, 0x00}},
+		{"clamped to 16 lines", -20, 20, []byte{0x80, 0x00, 0x7f, 0xff}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := encodeScrollEvent(100, 200, 1080, 2340, tt.hscroll, tt.vscroll, 0x1)
+			want := append([]byte{
+				controlMsgInjectScroll,
+				0x00, 0x00, 0x00, 0x64, // x = 100
+				0x00, 0x00, 0x00, 0xc8, // y = 200
+				0x04, 0x38, // w = 1080
+				0x09, 0x24, // h = 2340
+			}, tt.want...)
+			want = append(want, 0x00, 0x00, 0x00, 0x01) // buttons
+			if !bytes.Equal(got, want) {
+				t.Fatalf("encodeScrollEvent = % x\nwant               % x", got, want)
+			}
+		})
+	}
+}
+
+func TestCanonicalSerial(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"R58M12345", "R58M12345"},
+		{"emulator-5554", "emulator-5554"},
+		{"192.168.1.20:5555", "192.168.1.20:5555"},
+		{"[fe80::1]:5555", "[fe80::1]:5555"},
+		{"[FE80:0::1]:5555", "[fe80::1]:5555"},
+		{"[2001:0db8:0000:0000:0000:0000:0000:0001]:5555", "[2001:db8::1]:5555"},
+		{"[fe80::1%wlan0]:5555", "[fe80::1%wlan0]:5555"},
+		{"[FE80::0001%wlan0]:37099", "[fe80::1%wlan0]:37099"},
+		// IPv4 對映位址維持 IPv6 寫法，不會被當成另一台 IPv4 裝置
+		{"[::ffff:192.168.1.20]:5555", "[::ffff:192.168.1.20]:5555"},
+		// 主機名稱（mDNS 等）不是 IP，原樣保留
+		{"adb-R58M12345._adb-tls-connect._tcp:5555", "adb-R58M12345._adb-tls-connect._tcp:5555"},
+	}
+	for _, tt := range tests {
+		if got := canonicalSerial(tt.in); got != tt.want {
+			t.Errorf("canonicalSerial(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestPathDeviceIDIPv6(t *testing.T) {
+	mux := http.NewServeMux()
+	var got string
+	mux.HandleFunc("GET /devices/{id}/clients", func(w http.ResponseWriter, r *http.Request) { got = pathDeviceID(r) })
+	for path, want := range map[string]string{
+		"/devices/[FE80:0::1]:5555/clients":           "[fe80::1]:5555",
+		"/devices/%5Bfe80::1%25wlan0%5D:5555/clients": "[fe80::1%wlan0]:5555",
+	} {
+		got = ""
+		mux.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if got != want {
+			t.Errorf("%s: id = %q, want %q", path, got, want)
+		}
+	}
+}
+
+func TestSanitizeDeviceName(t *testing.T) {
+	pad := func(s string) []byte { // 補 NUL 到 64 bytes，如同 scrcpy 送出的欄位
+		b := make([]byte, 64)
+		copy(b, s)
+		return b
+	}
+	full := bytes.Repeat([]byte("A"), 64)
+	// 21 個「機」（3 bytes）= 63 bytes，第 64 byte 是下一個「機」的第一個 byte
+	cut := append(bytes.Repeat([]byte("機"), 21), "機"[0])
+	tests := []struct {
+		name string
+		in   []byte
+		want string
+	}{
+		{"NUL padded", pad("Pixel 7"), "Pixel 7"},
+		{"exactly 64 bytes without NUL", full, string(full)},
+		{"multi-byte rune cut at 64 bytes", cut, strings.Repeat("機", 21)},
+		{"invalid UTF-8 dropped", pad("Gal\xffaxy\xc3"), "Galaxy"},
+		{"control characters removed", pad("Pixel\t7\x1b[0m\n"), "Pixel7[0m"},
+		{"surrounding spaces trimmed", pad("  Pixel 7  "), "Pixel 7"},
+		{"bytes after NUL ignored", append(pad("Pixel")[:6], "garbage"...), "Pixel"},
+		{"empty", make([]byte, 64), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := sanitizeDeviceName(tt.in); got != tt.want {
+				t.Fatalf("sanitizeDeviceName(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIdleGateTransitions(t *testing.T) {
+	const id = "idle-dev"
+	var g idleGate
+	step := func(what string, wantPaused, wantChanged bool) {
+		t.Helper()
+		if paused, changed := g.update(id); paused != wantPaused || changed != wantChanged {
+			t.Fatalf("%s: paused=%v changed=%v, want paused=%v changed=%v", what, paused, changed, wantPaused, wantChanged)
+		}
+	}
+	add := func(sid string) {
+		addClient(newClient(sid, id, nil, nil, nil))
+	}
+	t.Cleanup(func() {
+		for _, sid := range []string{"c1", "c2", "other"} {
+			removeClient(sid, nil)
+		}
+	})
+
+	step("no clients", true, true)
+	step("still no clients", true, false)
+	addClient(newClient("other", "other-dev", nil, nil, nil))
+	step("client of another device", true, false)
+	add("c1")
+	step("first client", false, true)
+	add("c2")
+	step("second client", false, false)
+	removeClient("c1", nil)
+	step("one of two clients left", false, false)
+	removeClient("c2", nil)
+	step("last client left", true, true)
+
+	_, unsubscribe := subscribeAUs(id, 1)
+	step("in-process subscriber", false, true)
+	unsubscribe()
+	step("subscriber gone", true, true)
+}
+
+// fakeControl 取代 controlConn，記錄寫入 control socket 的內容
+type fakeControl struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (c *fakeControl) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (c *fakeControl) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.buf.Write(p)
+}
+
+// count 回傳目前寫入內容中 b 出現的次數
+func (c *fakeControl) count(b byte) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return bytes.Count(c.buf.Bytes(), []byte{b})
+}
+
+// useControlConn 於測試期間以 conn 取代 controlConn；與 startSession 相同，在 controlMu 下替換
+func useControlConn(t *testing.T, conn io.ReadWriter) {
+	t.Helper()
+	controlMu.Lock()
+	old := loadControlConn()
+	setControlConnLocked(conn)
+	controlMu.Unlock()
+	t.Cleanup(func() {
+		controlMu.Lock()
+		setControlConnLocked(old)
+		controlMu.Unlock()
+	})
+}
+
+// useFakeControl 於測試期間以 fakeControl 取代 controlConn，並把 curSession 設為 sess
+func useFakeControl(t *testing.T, sess *deviceSession) *fakeControl {
+	t.Helper()
+	c := &fakeControl{}
+	useControlConn(t, c)
+	stateMu.Lock()
+	oldSess := curSession
+	curSession = sess
+	stateMu.Unlock()
+	t.Cleanup(func() {
+		stateMu.Lock()
+		curSession = oldSess
+		stateMu.Unlock()
+	})
+	return c
+}
+
+func TestRequestKeyframeDebounced(t *testing.T) {
+	for _, waiting := range []bool{false, true} {
+		name := "keyframe arrived"
+		if waiting {
+			name = "still waiting for keyframe"
+		}
+		t.Run(name, func(t *testing.T) {
+			sess := &deviceSession{id: "kf-dev", log: logger}
+			ctrl := useFakeControl(t, sess)
+			c := addTestClient(t, "kf-client", sess.id, &blockingTrack{})
+			debounced := evKeyframeDebounced.global.Value()
+
+			// 5 個前端同時連上
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					requestKeyframeDebounced(sess, "client_connected")
+				}()
+			}
+			wg.Wait()
+			if n := ctrl.count(controlMsgResetVideo); n != 1 {
+				t.Fatalf("sent %d RESET_VIDEO for 5 simultaneous clients, want 1", n)
+			}
+			if d := evKeyframeDebounced.global.Value() - debounced; d != 4 {
+				t.Errorf("keyframe_debounced += %d, want 4", d)
+			}
+
+			// 視窗結束：IDR 已送達時不補送；仍在等待時補送一次
+			stateMu.Lock()
+			c.sending, c.needKF = true, waiting
+			stateMu.Unlock()
+			time.Sleep(keyframeDebounce + 100*time.Millisecond)
+			want := 1
+			if waiting {
+				want = 2
+			}
+			if n := ctrl.count(controlMsgResetVideo); n != want {
+				t.Fatalf("after the debounce window: %d RESET_VIDEO, want %d", n, want)
+			}
+		})
+	}
+}
+
+// 兩個前端同時失步：各自補送參數集並從 IDR 重新開始，但只送一次 RESET_VIDEO
+func TestDecoderDesyncRecoveryDebounced(t *testing.T) {
+	sess := &deviceSession{id: "desync-dev", log: logger}
+	ctrl := useFakeControl(t, sess)
+	var cs []*clientInfo
+	for _, id := range []string{"desync-a", "desync-b"} {
+		c := addTestClient(t, id, sess.id, discardTrack{})
+		if !clientConnected(id, nil) {
+			t.Fatalf("client %s not registered", id)
+		}
+		stateMu.Lock()
+		c.needKF = false
+		stateMu.Unlock()
+		cs = append(cs, c)
+	}
+
+	for _, c := range cs {
+		recoverClientDecoder(sess, c.id)
+	}
+	if n := ctrl.count(controlMsgResetVideo); n != 1 {
+		t.Errorf("sent %d RESET_VIDEO for two desynced clients, want 1", n)
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	for _, c := range cs {
+		if !c.needKF || !c.paramsPending || c.recoveries != 1 {
+			t.Errorf("%s: needKF=%v paramsPending=%v recoveries=%d, want true true 1", c.id, c.needKF, c.paramsPending, c.recoveries)
+		}
+	}
+}
+
+func TestVideoSizePerSession(t *testing.T) {
+	a := &deviceSession{id: "size-a", metrics: newDeviceMetrics()}
+	b := &deviceSession{id: "size-b", metrics: newDeviceMetrics()}
+	old := curDevMetrics.Swap(a.metrics)
+	t.Cleanup(func() { curDevMetrics.Store(old) })
+
+	stateMu.Lock()
+	a.setVideoSizeLocked(1080, 2340)
+	b.setVideoSizeLocked(1920, 1080)
+	stateMu.Unlock()
+
+	if w, h := a.videoSize(); w != 1080 || h != 2340 {
+		t.Errorf("a.videoSize() = %dx%d, want 1080x2340", w, h)
+	}
+	if w, h := b.videoSize(); w != 1920 || h != 1080 {
+		t.Errorf("b.videoSize() = %dx%d, want 1920x1080", w, h)
+	}
+	if w, h := (*deviceSession)(nil).videoSize(); w != 0 || h != 0 {
+		t.Errorf("nil session videoSize() = %dx%d, want 0x0", w, h)
+	}
+	// 各裝置的 video_w/video_h 互不覆寫；全域值只跟著目前裝置
+	if v := b.metrics.vals["video_w"].Value(); v != 1920 {
+		t.Errorf("b video_w = %d, want 1920", v)
+	}
+	if v := a.metrics.vals["video_w"].Value(); v != 1080 {
+		t.Errorf("a video_w = %d, want 1080", v)
+	}
+	if v := evVideoW.global.Value(); v != 1080 {
+		t.Errorf("global video_w = %d, want 1080 (current device)", v)
+	}
+}
+
+func TestWakeDeviceSendsWakeupPair(t *testing.T) {
+	sess := &deviceSession{id: "wake-dev", log: logger}
+	useFakeControl(t, sess)
+	ctrlQueue.reset()
+	t.Cleanup(func() {
+		ctrlQueue.reset()
+		stateMu.Lock()
+		delete(awakeDevices, sess.id)
+		stateMu.Unlock()
+	})
+
+	// 第二個前端不再送
+	wakeDevice(sess)
+	wakeDevice(sess)
+	checkQueue(t, drain(ctrlQueue), [][]byte{
+		encodeKeycodeEvent(keyActionDown, keycodeWakeup),
+		encodeKeycodeEvent(keyActionUp, keycodeWakeup),
+	})
+}
+
+// resetTouchState 清空觸控 slot 與按鍵狀態（encodeTouchEvent 的全域狀態）
+func resetTouchState(t *testing.T) {
+	t.Helper()
+	reset := func() {
+		touchMu.Lock()
+		touchLocalByRemote = map[uint64]uint16{}
+		touchRemoteByLocal = [maxPointers]uint64{}
+		touchSlotUsed = [maxPointers]bool{}
+		touchMu.Unlock()
+		pointerMu.Lock()
+		pointerButtons = make(map[uint64]uint32)
+		pointerMu.Unlock()
+	}
+	reset()
+	t.Cleanup(reset)
+}
+
+// touchBytes 組出預期的 INJECT_TOUCH_EVENT（裝置尺寸固定為 1080×2340）
+func touchBytes(action byte, pointer uint64, x, y int32, pressure uint16, actionButton, buttons uint32) []byte {
+	b := make([]byte, 32)
+	b[0], b[1] = 2, action
+	binary.BigEndian.PutUint64(b[2:], pointer)
+	binary.BigEndian.PutUint32(b[10:], uint32(x))
+	binary.BigEndian.PutUint32(b[14:], uint32(y))
+	binary.BigEndian.PutUint16(b[18:], 1080)
+	binary.BigEndian.PutUint16(b[20:], 2340)
+	binary.BigEndian.PutUint16(b[22:], pressure)
+	binary.BigEndian.PutUint32(b[24:], actionButton)
+	binary.BigEndian.PutUint32(b[28:], buttons)
+	return b
+}
+
+func TestEncodeTouchEventLayout(t *testing.T) {
+	resetTouchState(t)
+	ev := touchEvent{Type: "down", ID: 7, X: 100, Y: 200, ScreenW: 1080, ScreenH: 2340, Pressure: 1, PointerType: "touch"}
+	got, pointer, ok := encodeTouchEvent(ev, 1080, 2340)
+	want := []byte{
+		0x02,                                           // INJECT_TOUCH_EVENT
+		0x00,                                           // AMOTION_EVENT_ACTION_DOWN
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, // pointer ID（第一個觸控 slot）
+		0x00, 0x00, 0x00, 0x64, // x = 100
+		0x00, 0x00, 0x00, 0xc8, // y = 200
+		0x04, 0x38, // screen width = 1080
+		0x09, 0x24, // screen height = 2340
+		0xff, 0xff, // pressure 1.0
+		0x00, 0x00, 0x00, 0x00, // action button
+		0x00, 0x00, 0x00, 0x00, // buttons
+	}
+	if !ok || pointer != 1 || !bytes.Equal(got, want) {
+		t.Fatalf("encodeTouchEvent = % x, pointer %d, ok %v\nwant             % x, pointer 1, ok true", got, pointer, ok, want)
+	}
+}
+
+func TestEncodeTouchEvent(t *testing.T) {
+	type step struct {
+		ev   touchEvent
+		want []byte // nil 表示應回傳 ok=false
+	}
+	touch := func(typ string, id uint64, x, y int32, pressure float64) touchEvent {
+		return touchEvent{Type: typ, ID: id, X: x, Y: y, ScreenW: 1080, ScreenH: 2340, Pressure: pressure, PointerType: "touch", Buttons: 1}
+	}
+	mouse := func(typ string, x, y int32, buttons uint32) touchEvent {
+		return touchEvent{Type: typ, X: x, Y: y, ScreenW: 1080, ScreenH: 2340, Pressure: 0.5, PointerType: "mouse", Buttons: buttons}
+	}
+	tenFingers := make([]step, 0, 12)
+	for i := 0; i < maxPointers; i++ {
+		tenFingers = append(tenFingers, step{touch("down", uint64(100+i), 10, 10, 1), touchBytes(0, uint64(i+1), 10, 10, 0xffff, 0, 0)})
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"touch down/move/up", []step{
+			{touch("down", 7, 100, 200, 1), touchBytes(0, 1, 100, 200, 0xffff, 0, 0)},
+			{touch("move", 7, 110, 220, 0.5), touchBytes(2, 1, 110, 220, 0x8000, 0, 0)},
+			{touch("up", 7, 120, 240, 0.5), touchBytes(1, 1, 120, 240, 0, 0, 0)}, // up 的壓力一律 0
+		}},
+		{"pressure clamped", []step{
+			{touch("down", 7, 0, 0, 2), touchBytes(0, 1, 0, 0, 0xffff, 0, 0)},
+			{touch("move", 7, 0, 0, -1), touchBytes(2, 1, 0, 0, 0, 0, 0)},
+			{touch("move", 7, 0, 0, 0.25), touchBytes(2, 1, 0, 0, 0x4000, 0, 0)},
+		}},
+		{"pointer IDs map to slots and are reused", []step{
+			{touch("down", 7, 1, 1, 1), touchBytes(0, 1, 1, 1, 0xffff, 0, 0)},
+			{touch("down", 42, 2, 2, 1), touchBytes(0, 2, 2, 2, 0xffff, 0, 0)},
+			{touch("move", 42, 3, 3, 1), touchBytes(2, 2, 3, 3, 0xffff, 0, 0)},
+			{touch("up", 7, 1, 1, 1), touchBytes(1, 1, 1, 1, 0, 0, 0)},
+			{touch("down", 99, 4, 4, 1), touchBytes(0, 1, 4, 4, 0xffff, 0, 0)}, // 空出的 slot 1 給新手指
+			{touch("cancel", 42, 3, 3, 1), touchBytes(3, 2, 3, 3, 0xffff, 0, 0)},
+			{touch("move", 42, 3, 3, 1), nil}, // cancel 後 slot 已釋放
+		}},
+		{"unknown pointer", []step{
+			{touch("move", 5, 1, 1, 1), nil},
+			{touch("up", 5, 1, 1, 1), nil},
+		}},
+		{"eleventh finger dropped", append(tenFingers,
+			step{touch("down", 200, 10, 10, 1), nil},
+			step{touch("up", 100, 10, 10, 1), touchBytes(1, 1, 10, 10, 0, 0, 0)},
+		)},
+		{"coordinates clamped", []step{
+			{touch("down", 7, -10, 5000, 1), touchBytes(0, 1, 0, 2339, 0xffff, 0, 0)},
+		}},
+		{"mouse buttons", []step{
+			{mouse("move", 5, 5, 0), nil}, // hover
+			{mouse("down", 5, 5, 1), touchBytes(0, 0, 5, 5, 0x8000, 1, 1)},
+			{mouse("down", 5, 5, 3), touchBytes(0, 0, 5, 5, 0x8000, 2, 3)}, // 再按右鍵：action button 只含新按下的
+			{mouse("move", 6, 6, 3), touchBytes(2, 0, 6, 6, 0x8000, 0, 3)},
+			{mouse("up", 6, 6, 2), touchBytes(1, 0, 6, 6, 0, 1, 2)},
+			{mouse("move", 7, 7, 0), nil},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resetTouchState(t)
+			for i, s := range tt.steps {
+				got, _, ok := encodeTouchEvent(s.ev, 1080, 2340)
+				switch {
+				case s.want == nil && ok:
+					t.Fatalf("step %d (%s id=%d): got % x, want ok=false", i, s.ev.Type, s.ev.ID, got)
+				case s.want != nil && !ok:
+					t.Fatalf("step %d (%s id=%d): ok=false", i, s.ev.Type, s.ev.ID)
+				case !bytes.Equal(got, s.want):
+					t.Fatalf("step %d (%s id=%d):\n got % x\nwant % x", i, s.ev.Type, s.ev.ID, got, s.want)
+				}
+			}
+		})
+	}
+}
+
+// writeStep 為 scriptedConn 單次 Write 的行為：最多寫出 n bytes，並回傳 err
+type writeStep struct {
+	n   int
+	err error
+}
+
+// scriptedConn 依序套用 steps（用完後每次全部寫出），並記錄寫入內容與 SetWriteDeadline 呼叫
+type scriptedConn struct {
+	steps     []writeStep
+	maxWrite  int // 沒有 step 時單次最多寫出的 bytes（0 為不限制）
+	buf       bytes.Buffer
+	writes    int
+	deadlines []time.Time
+}
+
+func (c *scriptedConn) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (c *scriptedConn) Write(p []byte) (int, error) {
+	c.writes++
+	n, err := len(p), error(nil)
+	if len(c.steps) > 0 {
+		n, err = min(c.steps[0].n, len(p)), c.steps[0].err
+		c.steps = c.steps[1:]
+	} else if c.maxWrite > 0 {
+		n = min(c.maxWrite, len(p))
+	}
+	c.buf.Write(p[:n])
+	return n, err
+}
+
+func (c *scriptedConn) SetWriteDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestWriteFull(t *testing.T) {
+	msg := []byte("0123456789abcdefghijklmnopqrstuv") // 32 bytes，與觸控訊息等長
+	errBroken := errors.New("broken pipe")
+	tests := []struct {
+		name        string
+		conn        *scriptedConn
+		wantErr     error
+		wantWritten string
+		wantWrites  int
+		wantRetries int64
+		wantTimeout int64
+	}{
+		{
+			name:        "short writes",
+			conn:        &scriptedConn{maxWrite: 5},
+			wantWritten: string(msg),
+			wantWrites:  7,
+		},
+		{
+			name:        "transient timeout after partial write",
+			conn:        &scriptedConn{steps: []writeStep{{10, os.ErrDeadlineExceeded}}},
+			wantWritten: string(msg),
+			wantWrites:  2,
+			wantRetries: 1,
+		},
+		{
+			name:        "timeout before any byte",
+			conn:        &scriptedConn{steps: []writeStep{{0, os.ErrDeadlineExceeded}}},
+			wantErr:     os.ErrDeadlineExceeded,
+			wantWrites:  1,
+			wantTimeout: 1,
+		},
+		{
+			name: "timeout keeps recurring",
+			conn: &scriptedConn{steps: []writeStep{
+				{4, os.ErrDeadlineExceeded}, {4, os.ErrDeadlineExceeded}, {4, os.ErrDeadlineExceeded},
+			}},
+			wantErr:     os.ErrDeadlineExceeded,
+			wantWritten: string(msg[:12]),
+			wantWrites:  ctrlPartialRetries + 1,
+			wantRetries: ctrlPartialRetries,
+			wantTimeout: 1,
+		},
+		{
+			name:        "other errors are not retried",
+			conn:        &scriptedConn{steps: []writeStep{{6, errBroken}}},
+			wantErr:     errBroken,
+			wantWritten: string(msg[:6]),
+			wantWrites:  1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useControlConn(t, tt.conn)
+			retries, timeouts := evCtrlWriteRetries.global.Value(), evCtrlWriteTimeouts.global.Value()
+
+			err := writeFull(msg, time.Second, true)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("err = %v, want %v", err, tt.wantErr)
+			}
+			if got := tt.conn.buf.String(); got != tt.wantWritten {
+				t.Errorf("written %q, want %q", got, tt.wantWritten)
+			}
+			if tt.conn.writes != tt.wantWrites {
+				t.Errorf("Write called %d times, want %d", tt.conn.writes, tt.wantWrites)
+			}
+			if d := evCtrlWriteRetries.global.Value() - retries; d != tt.wantRetries {
+				t.Errorf("control_write_retries += %d, want %d", d, tt.wantRetries)
+			}
+			if d := evCtrlWriteTimeouts.global.Value() - timeouts; d != tt.wantTimeout {
+				t.Errorf("control_write_timeouts += %d, want %d", d, tt.wantTimeout)
+			}
+			// 每次重試都延長 deadline，結束時清除
+			dl := tt.conn.deadlines
+			if want := 2 + int(tt.wantRetries); len(dl) != want {
+				t.Fatalf("SetWriteDeadline called %d times, want %d", len(dl), want)
+			}
+			if !dl[len(dl)-1].IsZero() {
+				t.Error("write deadline not cleared")
+			}
+			for i, d := range dl[:len(dl)-1] {
+				if d.IsZero() {
+					t.Errorf("deadline %d not set", i)
+				}
+			}
+		})
+	}
+}
+
+func TestRTPTSFromPTS(t *testing.T) {
+	const base = 5_000_000 // 5s
+	tests := []struct {
+		name string
+		pts  uint64
+		want uint32
+	}{
+		{"base", base, 0},
+		{"one second later", base + 1_000_000, 90000},
+		{"one frame at 30fps", base + 33_333, 2999},
+		{"one frame before base", base - 33_333, ^uint32(0) - 2998}, // -2999
+		{"one second before base", base - 1_000_000, ^uint32(0) - 89999},
+		{"ten hours wraps to 32 bits", base + 36_000_000_000, 3_240_000_000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := rtpTSFromPTS(tt.pts, base); got != tt.want {
+				t.Fatalf("rtpTSFromPTS(%d, %d) = %d, want %d", tt.pts, base, got, tt.want)
+			}
+		})
+	}
+
+	// 含 B-frame 的解碼順序：I0 P3 B1 B2（PTS 以 33333µs 為一幀）。
+	// 時間戳須依 PTS 排序，B-frame 相對前一個 P-frame 為小幅負差，而不是接近 2^32 的跳躍
+	order := []uint64{0, 3, 1, 2}
+	want := []uint32{0, 8999, 2999, 5999}
+	var prev uint32
+	for i, f := range order {
+		ts := rtpTSFromPTS(base+f*33_333, base)
+		if ts != want[i] {
+			t.Fatalf("frame %d (pts index %d): ts = %d, want %d", i, f, ts, want[i])
+		}
+		if i > 0 {
+			d := int32(ts - prev)
+			if d < -10000 || d > 10000 {
+				t.Fatalf("frame %d: ts step %d from the previous frame, want within ±10000", i, d)
+			}
+		}
+		prev = ts
+	}
+
+	// 第一個 frame 即為重新排序過的 B-frame（PTS 小於後續建立的基準）時也不會溢位
+	if d := int32(rtpTSFromPTS(base, base+66_666)); d != -5999 {
+		t.Errorf("pts before base: signed ts = %d, want -5999", d)
+	}
+}
+
+func TestNewVideoAU(t *testing.T) {
+	tests := []struct {
+		name  string
+		nalus [][]byte
+		hevc  bool
+		want  videoAU
+	}{
+		{"h264 keyframe", [][]byte{{0x67, 0x42}, {0x68, 0xce}, {0x65, 0x88}}, false,
+			videoAU{idr: true, hasSPS: true, hasPPS: true, hasVPS: true, params: true}},
+		{"h264 IDR without parameter sets", [][]byte{{0x06, 0x05}, {0x65, 0x88}}, false,
+			videoAU{idr: true, hasVPS: true}},
+		{"h264 P frame", [][]byte{{0x41, 0x9a}}, false,
+			videoAU{hasVPS: true}},
+		{"h264 SPS only", [][]byte{{0x67, 0x42}}, false,
+			videoAU{hasSPS: true, hasVPS: true, params: true}},
+		{"h265 keyframe", [][]byte{{0x40, 0x01}, {0x42, 0x01}, {0x44, 0x01}, {0x26, 0x01}}, true,
+			videoAU{idr: true, hasSPS: true, hasPPS: true, hasVPS: true, params: true}},
+		{"h265 CRA without VPS", [][]byte{{0x42, 0x01}, {0x44, 0x01}, {0x2a, 0x01}}, true,
+			videoAU{idr: true, hasSPS: true, hasPPS: true, params: true}},
+		{"h265 P frame", [][]byte{{0x02, 0x01}}, true,
+			videoAU{}},
+	}
+	flags := func(au videoAU) [5]bool { return [5]bool{au.idr, au.hasSPS, au.hasPPS, au.hasVPS, au.params} }
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := newVideoAU(tt.nalus, 3000, tt.hevc, nil)
+			if got.ts != 3000 || len(got.nalus) != len(tt.nalus) {
+				t.Fatalf("ts/nalus not carried over: ts=%d nalus=%d", got.ts, len(got.nalus))
+			}
+			if flags(got) != flags(tt.want) {
+				t.Errorf("newVideoAU [idr sps pps vps params] = %v, want %v", flags(got), flags(tt.want))
+			}
+		})
+	}
+}
+
+// packetTrack 記錄寫入的每個 RTP 封包
+type packetTrack struct {
+	mu   sync.Mutex
+	pkts []*rtp.Packet
+}
+
+func (p *packetTrack) WriteRTP(pkt *rtp.Packet) error {
+	p.mu.Lock()
+	p.pkts = append(p.pkts, pkt.Clone())
+	p.mu.Unlock()
+	return nil
+}
+
+// sentAU 為前端收到的一個 AU（到 marker 為止的封包）
+type sentAU struct {
+	ts    uint32
+	types []byte // 依序的 H.264 NALU 類型
+}
+
+// waitAUs 等到 track 收到 n 個 AU，檢查 marker 只出現在每個 AU 的最後一個封包、AU 內時間戳一致
+func (p *packetTrack) waitAUs(t *testing.T, n int) []sentAU {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		p.mu.Lock()
+		var aus []sentAU
+		var cur *sentAU
+		for _, pkt := range p.pkts {
+			if cur == nil {
+				cur = &sentAU{ts: pkt.Timestamp}
+			} else if pkt.Timestamp != cur.ts {
+				p.mu.Unlock()
+				t.Fatalf("AU at ts %d has a packet with ts %d (marker missing on the previous AU)", cur.ts, pkt.Timestamp)
+			}
+			cur.types = append(cur.types, h264Types(pkt.Payload)...)
+			if pkt.Marker {
+				aus = append(aus, *cur)
+				cur = nil
+			}
+		}
+		p.mu.Unlock()
+		if len(aus) >= n {
+			if len(aus) > n {
+				t.Fatalf("received %d AUs %v, want %d", len(aus), aus, n)
+			}
+			return aus
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("received %d AUs %v, want %d", len(aus), aus, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// checkAUs 比對收到的 AU（時間戳與 NALU 類型）
+func checkAUs(t *testing.T, got, want []sentAU) {
+	t.Helper()
+	for i := range want {
+		if got[i].ts != want[i].ts || !bytes.Equal(got[i].types, want[i].types) {
+			t.Fatalf("AU %d = {ts %d types %v}, want {ts %d types %v}", i, got[i].ts, got[i].types, want[i].ts, want[i].types)
+		}
+	}
+}
+
+// AU 組裝：新前端等待 IDR 並補上參數集、換 SPS 後重新等待 IDR、穩定狀態原樣轉送並在 AU 最後一個封包設 marker
+func TestAUAssembly(t *testing.T) {
+	const device = "au-dev"
+	var (
+		sps      = []byte{0x67, 0x42, 0x00, 0x1f}
+		pps      = []byte{0x68, 0xce, 0x3c, 0x80}
+		newSPS   = []byte{0x67, 0x42, 0x00, 0x28}
+		idr      = []byte{0x65, 0x88, 0x84, 0x00}
+		sei      = []byte{0x06, 0x05, 0x01, 0x00}
+		bigP     = append([]byte{0x41}, bytes.Repeat([]byte{0x9a}, 3000)...) // 超過 MTU：FU-A 分片
+		smallP   = []byte{0x41, 0x9a, 0x02}
+		keyframe = func(ts uint32, nalus ...[]byte) videoAU { return newVideoAU(nalus, ts, false, nil) }
+	)
+	stateMu.Lock()
+	oldSPS, oldPPS, oldVPS, oldCodec := lastSPS, lastPPS, lastVPS, videoCodec
+	lastSPS, lastPPS, lastVPS, videoCodec = sps, pps, nil, "h264"
+	stateMu.Unlock()
+	t.Cleanup(func() {
+		stateMu.Lock()
+		lastSPS, lastPPS, lastVPS, videoCodec = oldSPS, oldPPS, oldVPS, oldCodec
+		stateMu.Unlock()
+	})
+
+	tr := &packetTrack{}
+	c := addTestClient(t, "au-client", device, tr)
+	if !clientConnected(c.id, nil) {
+		t.Fatal("client not registered")
+	}
+
+	t.Run("waiting for IDR", func(t *testing.T) {
+		// 連上時正在串流中段：一般幀略過，IDR 補上快取的 SPS/PPS
+		if res := fanOutAU(device, keyframe(1000, smallP)); res.waiting != 1 {
+			t.Fatalf("P frame before the first IDR: waiting=%d, want 1", res.waiting)
+		}
+		if res := fanOutAU(device, keyframe(2000, sei, idr)); res.waiting != 0 || res.incompleteKF {
+			t.Fatalf("IDR: waiting=%d incompleteKF=%v", res.waiting, res.incompleteKF)
+		}
+		checkAUs(t, tr.waitAUs(t, 1), []sentAU{{2000, []byte{7, 8, 6, 5}}})
+	})
+
+	t.Run("steady state", func(t *testing.T) {
+		fanOutAU(device, keyframe(3000, sei, bigP))
+		fanOutAU(device, keyframe(4000, smallP))
+		checkAUs(t, tr.waitAUs(t, 3)[1:], []sentAU{
+			{3000, []byte{6, 1}}, // bigP 分成多個 FU-A，只有最後一片帶 marker
+			{4000, []byte{1}},
+		})
+	})
+
+	t.Run("new SPS", func(t *testing.T) {
+		// 視訊迴圈收到不同的 SPS：所有前端重新等待 IDR
+		stateMu.Lock()
+		n := markDeviceNeedsKeyframeLocked(device)
+		lastSPS = newSPS
+		stateMu.Unlock()
+		if n != 1 {
+			t.Fatalf("markDeviceNeedsKeyframeLocked = %d, want 1", n)
+		}
+		if res := fanOutAU(device, keyframe(5000, smallP)); res.waiting != 1 {
+			t.Fatalf("P frame after a new SPS: waiting=%d, want 1", res.waiting)
+		}
+		fanOutAU(device, keyframe(6000, newSPS, pps, idr))
+		fanOutAU(device, keyframe(7000, smallP))
+		checkAUs(t, tr.waitAUs(t, 5)[3:], []sentAU{
+			{6000, []byte{7, 8, 5}},
+			{7000, []byte{1}},
+		})
+	})
+}
+
+// ---- 端到端測試：以 -replay 的合成串流取代實體裝置，在同一行程內用 pion 扮演瀏覽器 ----
+
+// bitWriter 組出 SPS 用的位元串（ue(v) 為 Exp-Golomb）
+type bitWriter struct {
+	b []byte
+	n int // 已寫入的 bit 數
+}
+
+func (w *bitWriter) u(bits int, v uint) {
+	for i := bits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.b = append(w.b, 0)
+		}
+		if v>>uint(i)&1 == 1 {
+			w.b[len(w.b)-1] |= 1 << uint(7-w.n%8)
+		}
+		w.n++
+	}
+}
+
+func (w *bitWriter) ue(v uint) {
+	v++
+	bits := 0
+	for x := v; x > 1; x >>= 1 {
+		bits++
+	}
+	w.u(bits, 0)
+	w.u(bits+1, v)
+}
+
+// testSPS 回傳 Baseline profile、w×h（16 的倍數）的 H.264 SPS（不含起始碼）
+func testSPS(w, h int) []byte {
+	var bw bitWriter
+	bw.u(8, 66) // profile_idc：Baseline
+	bw.u(8, 0xc0)
+	bw.u(8, 30) // level_idc
+	bw.ue(0)    // seq_parameter_set_id
+	bw.ue(0)    // log2_max_frame_num_minus4
+	bw.ue(2)    // pic_order_cnt_type
+	bw.ue(1)    // num_ref_frames
+	bw.u(1, 0)  // gaps_in_frame_num_value_allowed_flag
+	bw.ue(uint(w/16 - 1))
+	bw.ue(uint(h/16 - 1))
+	bw.u(1, 1) // frame_mbs_only_flag
+	bw.u(1, 1) // direct_8x8_inference_flag
+	bw.u(1, 0) // frame_cropping_flag
+	bw.u(1, 0) // vui_parameters_present_flag
+	bw.u(1, 1) // rbsp_stop_one_bit
+	return append([]byte{0x67}, bw.b...)
+}
+
+// syntheticH264 回傳可供 -replay 播放的 Annex-B 串流：SPS/PPS + IDR，接著數個一般幀。
+// 內容不是真正可解碼的畫面，只需要 NALU 類型正確，讓視訊迴圈與 RTP 發送走完整路徑
+func syntheticH264(w, h int) []byte {
+	sc := []byte{0, 0, 0, 1}
+	var b []byte
+	for _, n := range [][]byte{testSPS(w, h), {0x68, 0xce, 0x38, 0x80}, append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0x5a}, 3000)...)} {
+		b = append(append(b, sc...), n...)
+	}
+	for i := 0; i < 9; i++ {
+		b = append(append(b, sc...), append([]byte{0x41, 0x9a}, bytes.Repeat([]byte{byte(i)}, 200)...)...)
+	}
+	return b
+}
+
+// setFlag 於測試期間改變命令列參數，結束時還原
+func setFlag(t *testing.T, name, value string) {
+	t.Helper()
+	f := flag.Lookup(name)
+	old := f.Value.String()
+	if err := flag.Set(name, value); err != nil {
+		t.Fatalf("set -%s: %v", name, err)
+	}
+	t.Cleanup(func() { flag.Set(name, old) })
+}
+
+// startReplayServer 以 -replay 的合成串流啟動完整的 HTTP 路由；結束時中斷裝置並關閉 server
+func startReplayServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	}
+	path := filepath.Join(t.TempDir(), "replay.h264")
+	if err := os.WriteFile(path, syntheticH264(320, 240), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "replay", path)
+	setFlag(t, "replay-fps", "60")
+	mux, _ := newMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		stateMu.Lock()
+		s := curSession
+		curSession = nil
+		stateMu.Unlock()
+		if s != nil {
+			dropSession(s)
+		}
+		srv.Close()
+	})
+	return srv
+}
+
+// testPeer 為扮演瀏覽器的 pion PeerConnection
+type testPeer struct {
+	pc        *webrtc.PeerConnection
+	sessionID string
+	connected chan struct{}
+	rtp       chan *rtp.Packet
+}
+
+// dialTestPeer 建立只接收視訊、附帶 controlR DataChannel 的 PeerConnection，對 /offer 完成協商
+func dialTestPeer(t *testing.T, srv *httptest.Server, query string) *testPeer {
+	t.Helper()
+	var m webrtc.MediaEngine
+	if err := m.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	pc, err := webrtc.NewAPI(webrtc.WithMediaEngine(&m)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPeer{pc: pc, connected: make(chan struct{}), rtp: make(chan *rtp.Packet, 64)}
+	var once sync.Once
+	pc.OnConnectionStateChange(func(s webrtc.PeerConnectionState) {
+		if s == webrtc.PeerConnectionStateConnected {
+			once.Do(func() { close(p.connected) })
+		}
+	})
+	pc.OnTrack(func(tr *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		for {
+			pkt, _, err := tr.ReadRTP()
+			if err != nil {
+				return
+			}
+			select {
+			case p.rtp <- pkt:
+			default:
+			}
+		}
+	})
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeVideo,
+		webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.CreateDataChannel("controlR", nil); err != nil {
+		t.Fatal(err)
+	}
+	offer, err := pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gathered := webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+
+	body, _ := json.Marshal(pc.LocalDescription())
+	resp, err := srv.Client().Post(srv.URL+"/offer"+query, "application/json", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		b, _ := io.ReadAll(resp.Body)
+		t.Fatalf("/offer: %s: %s", resp.Status, b)
+	}
+	var answer webrtc.SessionDescription
+	if err := json.NewDecoder(resp.Body).Decode(&answer); err != nil {
+		t.Fatalf("decode answer: %v", err)
+	}
+	if answer.Type != webrtc.SDPTypeAnswer || !strings.Contains(answer.SDP, "H264") {
+		t.Fatalf("unexpected answer: type=%s sdp=%q", answer.Type, answer.SDP)
+	}
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		t.Fatalf("set answer: %v", err)
+	}
+	p.sessionID = resp.Header.Get("X-Session-Id")
+	return p
+}
+
+// waitConnected 等待 PeerConnection 進入 Connected
+func (p *testPeer) waitConnected(t *testing.T) {
+	t.Helper()
+	select {
+	case <-p.connected:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("peer not connected (state %s)", p.pc.ConnectionState())
+	}
+}
+
+// waitGoroutines 等待 goroutine 數降到 want 以下（背景收尾需要時間），回傳最後的數量
+func waitGoroutines(want int, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= want || time.Now().After(deadline) {
+			return n
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestOfferSessionsDoNotLeakGoroutines(t *testing.T) {
+	srv := startReplayServer(t)
+	srv.Client().Transport.(*http.Transport).DisableKeepAlives = true
+	sessions := 100
+	if testing.Short() {
+		sessions = 10
+	}
+
+	// 基準：先跑一輪讓 pion 與 net/http 的常駐 goroutine 就位
+	warm := dialTestPeer(t, srv, "")
+	warm.waitConnected(t)
+	warm.pc.Close()
+	resp, err := srv.Client().Post(srv.URL+"/devices/replay/disconnect", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	baseline := waitGoroutines(0, 2*time.Second)
+
+	for i := 0; i < sessions; i++ {
+		p := dialTestPeer(t, srv, "")
+		p.waitConnected(t)
+		if err := p.pc.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err = srv.Client().Post(srv.URL+"/devices/replay/disconnect", "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// 允許少量差異（計時器、尚在收尾的 HTTP 連線）
+	const slack = 5
+	if n := waitGoroutines(baseline+slack, 10*time.Second); n > baseline+slack {
+		buf := make([]byte, 1<<20)
+		t.Fatalf("goroutines: %d after %d sessions, baseline %d\n%s", n, sessions, baseline, buf[:runtime.Stack(buf, true)])
+	}
+}
+
+// h264Types 回傳 RTP payload 內含的 NALU 類型：STAP-A 展開、FU-A 只在第一個分片回傳內含的類型
+func h264Types(payload []byte) []byte {
+	if len(payload) == 0 {
+		return nil
+	}
+	switch typ := payload[0] & 0x1F; typ {
+	case 24: // STAP-A：[size u16][NALU]...
+		var types []byte
+		for b := payload[1:]; len(b) > 2; {
+			size := int(binary.BigEndian.Uint16(b))
+			if size == 0 || len(b) < 2+size {
+				break
+			}
+			types = append(types, b[2]&0x1F)
+			b = b[2+size:]
+		}
+		return types
+	case 28: // FU-A
+		if len(payload) < 2 || payload[1]&0x80 == 0 {
+			return nil
+		}
+		return []byte{payload[1] & 0x1F}
+	default:
+		return []byte{typ}
+	}
+}
+
+// readUntilIDR 讀取 RTP 直到收到 IDR 之後的一般幀，回傳 IDR 與其後一般幀的時間戳。
+// 要求 IDR 之前只有參數集（伺服器在 IDR 前不送一般幀）
+func (p *testPeer) readUntilIDR(t *testing.T) (idrTS, nextTS uint32) {
+	t.Helper()
+	timeout := time.After(10 * time.Second)
+	sawIDR := false
+	for {
+		var pkt *rtp.Packet
+		select {
+		case pkt = <-p.rtp:
+		case <-timeout:
+			t.Fatalf("no IDR followed by a frame within 10s (saw IDR: %v)", sawIDR)
+		}
+		for _, typ := range h264Types(pkt.Payload) {
+			switch {
+			case typ == 5 && !sawIDR:
+				sawIDR, idrTS = true, pkt.Timestamp
+			case typ == 1 && !sawIDR:
+				t.Fatalf("non-IDR slice (seq %d) before the first IDR", pkt.SequenceNumber)
+			case typ == 1:
+				return idrTS, pkt.Timestamp
+			}
+		}
+	}
+}
+
+func TestReplayOfferReceivesRTP(t *testing.T) {
+	srv := startReplayServer(t)
+
+	// dialTestPeer 已確認回應為含 H264 的 answer
+	p := dialTestPeer(t, srv, "")
+	t.Cleanup(func() { p.pc.Close() })
+	if p.sessionID == "" {
+		t.Error("answer has no X-Session-Id")
+	}
+	if sdp := p.pc.RemoteDescription().SDP; !strings.Contains(sdp, "a=candidate:") || !strings.Contains(sdp, "a=fingerprint:") {
+		t.Fatalf("answer lacks ICE candidates or DTLS fingerprint:\n%s", sdp)
+	}
+	p.waitConnected(t)
+
+	idrTS, nextTS := p.readUntilIDR(t)
+	if d := int32(nextTS - idrTS); d <= 0 {
+		t.Errorf("frame after the IDR has ts %d, not after the IDR's %d", nextTS, idrTS)
+	}
+}
+
+func TestReplayViewersShareSession(t *testing.T) {
+	srv := startReplayServer(t)
+
+	first := dialTestPeer(t, srv, "")
+	t.Cleanup(func() { first.pc.Close() })
+	first.waitConnected(t)
+	first.readUntilIDR(t)
+	stateMu.RLock()
+	sess := curSession
+	stateMu.RUnlock()
+
+	// 第二個前端加入同一個 scrcpy session，從自己的 IDR 開始；第一個前端不受影響
+	second := dialTestPeer(t, srv, "")
+	t.Cleanup(func() { second.pc.Close() })
+	second.waitConnected(t)
+	if second.sessionID == first.sessionID {
+		t.Fatalf("both viewers got session ID %q", first.sessionID)
+	}
+	stateMu.RLock()
+	same := curSession == sess
+	stateMu.RUnlock()
+	if !same {
+		t.Fatal("second offer replaced the device session instead of joining it")
+	}
+	second.readUntilIDR(t)
+	for len(first.rtp) > 0 { // 捨棄加入前就收到的封包
+		<-first.rtp
+	}
+	select {
+	case <-first.rtp:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("first viewer stopped receiving RTP after the second joined (state %s)", first.pc.ConnectionState())
+	}
+
+	resp, err := srv.Client().Get(srv.URL + "/devices/replay/clients")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var list []struct {
+		ID  string  `json:"id"`
+		Seq *uint32 `json:"seq"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&list); err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 2 {
+		t.Fatalf("GET /devices/replay/clients listed %d clients, want 2", len(list))
+	}
+	for _, c := range list {
+		if c.Seq == nil {
+			t.Errorf("client %s has no RTP sequence number", c.ID)
+		}
+	}
+}
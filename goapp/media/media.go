@@ -0,0 +1,26 @@
+// 裝置視訊的 access unit，供在同一個行程內處理畫面的程式（Server.OnFrame、deviceSession.Subscribe）使用
+package media
+
+// AccessUnit 為一個 H.264/H.265 access unit（一幀畫面）
+type AccessUnit struct {
+	NALUs    [][]byte // 不含 Annex-B 起始碼
+	TS       uint32   // 90kHz RTP 時間戳
+	Keyframe bool     // 含 IDR（H.265 為 IRAP），解碼器可從這裡開始
+}
+
+// AnnexB 以 4 bytes 起始碼串接 NALU，可直接寫入 .h264 檔或交給解碼器
+func (au AccessUnit) AnnexB() []byte {
+	size := 0
+	for _, n := range au.NALUs {
+		size += 4 + len(n)
+	}
+	b := make([]byte, 0, size)
+	for _, n := range au.NALUs {
+		if len(n) == 0 {
+			continue
+		}
+		b = append(b, 0, 0, 0, 1)
+		b = append(b, n...)
+	}
+	return b
+}
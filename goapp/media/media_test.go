@@ -0,0 +1,17 @@
+package media
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestAnnexB(t *testing.T) {
+	au := AccessUnit{NALUs: [][]byte{{0x67, 0x42}, {}, {0x65, 0x88, 0x84}}}
+	want := []byte{0, 0, 0, 1, 0x67, 0x42, 0, 0, 0, 1, 0x65, 0x88, 0x84}
+	if got := au.AnnexB(); !bytes.Equal(got, want) {
+		t.Errorf("AnnexB() = % x, want % x", got, want)
+	}
+	if got := (AccessUnit{}).AnnexB(); len(got) != 0 {
+		t.Errorf("empty AU: AnnexB() = % x, want nothing", got)
+	}
+}
@@ -0,0 +1,177 @@
+// metrics.go — 計數器與 GET /metrics。
+// 每個計數器同時累加：全域 expvar（/debug/vars，向下相容的彙總值）與目前裝置的 deviceMetrics；
+// 每台連線過的裝置保留一份 deviceMetrics（跨 session 沿用，counter 不會因重啟 server 歸零），
+// /metrics 以 Prometheus text format 輸出每台裝置的值並加上 device 標籤。
+// 裝置的 session 結束後 gauge 歸零，counter 保留最後的值。
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+const metricsPrefix = "scrcpy_"
+
+// 瞬時值（其餘視為累計 counter）
+var gaugeMetrics = map[string]bool{
+	"video_w":                  true,
+	"video_h":                  true,
+	"last_control_write_ms":    true,
+	"last_frame_meta_ms":       true,
+	"last_frame_read_ms":       true,
+	"last_control_read_ms_ago": true,
+	"au_seq":                   true,
+	"frames_since_kf":          true,
+	"pending_pointers":         true,
+	"active_peer":              true,
+	"client_rtt_ms":            true,
+	"frames_drop_rate_pct":     true,
+	"gop_frames":               true,
+	"ms_since_idr":             true,
+	"rtcp_fraction_lost":       true,
+}
+
+// metricNames 依註冊順序記錄所有計數器名稱
+var metricNames []string
+
+// curDevMetrics 為目前裝置的計數器；無裝置連線時為 nil（只累加全域值）
+var curDevMetrics atomic.Pointer[deviceMetrics]
+
+// metric 為全域 expvar 與目前裝置計數器的組合
+type metric struct {
+	name   string
+	global *expvar.Int
+}
+
+func newMetric(name string) *metric {
+	metricNames = append(metricNames, name)
+	return &metric{name: name, global: expvar.NewInt(name)}
+}
+
+func (m *metric) Add(delta int64) {
+	m.global.Add(delta)
+	if d := curDevMetrics.Load(); d != nil {
+		d.vals[m.name].Add(delta)
+	}
+}
+
+func (m *metric) Set(value int64) {
+	m.global.Set(value)
+	if d := curDevMetrics.Load(); d != nil {
+		d.vals[m.name].Set(value)
+	}
+}
+
+// setFor 設定指定裝置的瞬時值；該裝置為目前裝置時一併更新全域值
+func (m *metric) setFor(d *deviceMetrics, value int64) {
+	if d == nil {
+		return
+	}
+	d.vals[m.name].Set(value)
+	if curDevMetrics.Load() == d {
+		m.global.Set(value)
+	}
+}
+
+// deviceMetrics 為單一裝置的計數器（未發佈到 expvar）
+type deviceMetrics struct {
+	vals map[string]*expvar.Int // 建立後不再增刪 key，可並行讀取
+}
+
+func newDeviceMetrics() *deviceMetrics {
+	d := &deviceMetrics{vals: make(map[string]*expvar.Int, len(metricNames))}
+	for _, name := range metricNames {
+		d.vals[name] = new(expvar.Int)
+	}
+	return d
+}
+
+// resetGauges 將瞬時值歸零（裝置已無 session 時不再回報過時的解析度、前端數等）
+func (d *deviceMetrics) resetGauges() {
+	if d == nil {
+		return
+	}
+	for name := range gaugeMetrics {
+		d.vals[name].Set(0)
+	}
+}
+
+// 每台連線過的裝置的計數器（受 devMetricsMu 保護）
+var (
+	devMetricsMu sync.Mutex
+	devMetrics   = map[string]*deviceMetrics{}
+)
+
+// deviceMetricsFor 取得裝置的計數器；第一次連線時建立
+func deviceMetricsFor(id string) *deviceMetrics {
+	devMetricsMu.Lock()
+	defer devMetricsMu.Unlock()
+	d := devMetrics[id]
+	if d == nil {
+		d = newDeviceMetrics()
+		devMetrics[id] = d
+	}
+	return d
+}
+
+// lookupDeviceMetrics 取得裝置的計數器；尚未連線過時為 nil
+func lookupDeviceMetrics(id string) *deviceMetrics {
+	devMetricsMu.Lock()
+	defer devMetricsMu.Unlock()
+	return devMetrics[id]
+}
+
+// deviceCounters 為 GET /devices 列出的每台裝置累計計數
+var deviceCounters = []string{"frames_read", "bytes_read", "frames_dropped_on_send", "pli_count", "keyframe_requests", "rtp_packets_sent"}
+
+// counters 回傳 deviceCounters 的目前值；d 為 nil 時回傳 nil
+func (d *deviceMetrics) counters() map[string]int64 {
+	if d == nil {
+		return nil
+	}
+	m := make(map[string]int64, len(deviceCounters))
+	for _, name := range deviceCounters {
+		m[name] = d.vals[name].Value()
+	}
+	return m
+}
+
+// trackedDeviceMetrics 依裝置 ID 排序回傳所有連線過的裝置與其計數器
+func trackedDeviceMetrics() ([]string, []*deviceMetrics) {
+	devMetricsMu.Lock()
+	defer devMetricsMu.Unlock()
+	ids := make([]string, 0, len(devMetrics))
+	for id := range devMetrics {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	ds := make([]*deviceMetrics, len(ids))
+	for i, id := range ids {
+		ds[i] = devMetrics[id]
+	}
+	return ids, ds
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	ids, ds := trackedDeviceMetrics()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	var b strings.Builder
+	for _, name := range metricNames {
+		typ := "counter"
+		if gaugeMetrics[name] {
+			typ = "gauge"
+		}
+		fmt.Fprintf(&b, "# TYPE %s%s %s\n", metricsPrefix, name, typ)
+		for i, d := range ds {
+			fmt.Fprintf(&b, "%s%s{device=%q} %d\n", metricsPrefix, name, ids[i], d.vals[name].Value())
+		}
+	}
+	_, _ = w.Write([]byte(b.String()))
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestMetricsListsEveryDevice(t *testing.T) {
+	a := &deviceSession{id: "metrics-a", log: logger, metrics: deviceMetricsFor("metrics-a"), done: make(chan struct{})}
+	b := &deviceSession{id: "metrics-b", log: logger, metrics: deviceMetricsFor("metrics-b"), done: make(chan struct{})}
+	old := curDevMetrics.Swap(a.metrics)
+	t.Cleanup(func() { curDevMetrics.Store(old) })
+
+	evFramesRead.Add(7)
+	curDevMetrics.Store(b.metrics)
+	evFramesRead.Add(3)
+	stateMu.Lock()
+	a.setVideoSizeLocked(1080, 2340)
+	b.setVideoSizeLocked(1920, 1080)
+	stateMu.Unlock()
+
+	// a 的 session 結束：counter 保留，gauge 歸零；b 仍在串流
+	a.Close()
+	if deviceMetricsFor("metrics-a") != a.metrics {
+		t.Fatal("a new session of the device does not reuse its counters")
+	}
+
+	w := httptest.NewRecorder()
+	handleMetrics(w, httptest.NewRequest("GET", "/metrics", nil))
+	body := w.Body.String()
+	for _, want := range []string{
+		`scrcpy_frames_read{device="metrics-a"} 7`,
+		`scrcpy_frames_read{device="metrics-b"} 3`,
+		`scrcpy_video_w{device="metrics-a"} 0`,
+		`scrcpy_video_w{device="metrics-b"} 1920`,
+	} {
+		if !strings.Contains(body, want+"\n") {
+			t.Errorf("/metrics missing %q", want)
+		}
+	}
+	if strings.Index(body, `device="metrics-a"`) > strings.Index(body, `device="metrics-b"`) {
+		t.Error("devices not listed in ID order")
+	}
+	if curDevMetrics.Load() != b.metrics {
+		t.Error("closing a's session detached the current device's counters")
+	}
+}
+
+func TestDeviceCounters(t *testing.T) {
+	if c := lookupDeviceMetrics("counters-never-connected").counters(); c != nil {
+		t.Errorf("device that never connected has counters %v, want none", c)
+	}
+	d := deviceMetricsFor("counters-dev")
+	d.vals["frames_read"].Set(42)
+	c := lookupDeviceMetrics("counters-dev").counters()
+	if len(c) != len(deviceCounters) {
+		t.Fatalf("got %d counters, want %d", len(c), len(deviceCounters))
+	}
+	if c["frames_read"] != 42 {
+		t.Errorf("frames_read = %d, want 42", c["frames_read"])
+	}
+}
@@ -0,0 +1,72 @@
+// nalufilter.go — -drop-nalu：在送出前移除指定種類的非 VCL NALU（例如每幀都帶的大型 SEI、AUD），
+// 節省頻寬並避免部分瀏覽器解碼器被特定 SEI 干擾。以名稱指定，依協商出的編碼對應到 H.264 / H.265 的 nal_unit_type；
+// 只開放不影響解碼的種類，參數集與切片不能移除。移除後 RTP、RTMP 與訂閱者都看不到這些 NALU。
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+)
+
+// droppableNALUs 為可移除的種類 → H.264 / H.265 的 nal_unit_type
+var droppableNALUs = map[string]struct{ h264, h265 []uint8 }{
+	"sei":    {h264: []uint8{6}, h265: []uint8{39, 40}}, // H.265 分 prefix / suffix SEI
+	"aud":    {h264: []uint8{9}, h265: []uint8{35}},
+	"filler": {h264: []uint8{12}, h265: []uint8{38}},
+}
+
+// naluDropH264 / naluDropH265 為 -drop-nalu 解析後要移除的 nal_unit_type → 名稱（main 啟動時設定，之後唯讀）
+var naluDropH264, naluDropH265 map[uint8]string
+
+// evNALUsFiltered 依種類名稱累計被移除的 NALU 數
+var evNALUsFiltered = expvar.NewMap("nalus_filtered")
+
+// initNALUFilter 解析逗號分隔的種類名稱；空字串表示全部保留
+func initNALUFilter(list string) error {
+	naluDropH264, naluDropH265 = map[uint8]string{}, map[uint8]string{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		types, ok := droppableNALUs[name]
+		if !ok {
+			return fmt.Errorf("unknown NALU kind %q (sei, aud, filler)", name)
+		}
+		for _, t := range types.h264 {
+			naluDropH264[t] = name
+		}
+		for _, t := range types.h265 {
+			naluDropH265[t] = name
+		}
+	}
+	return nil
+}
+
+// filterNALUs 就地移除 -drop-nalu 指定的 NALU 並回傳剩下的部分
+func filterNALUs(nalus [][]byte, hevc bool) [][]byte {
+	drop := naluDropH264
+	if hevc {
+		drop = naluDropH265
+	}
+	if len(drop) == 0 {
+		return nalus
+	}
+	kept := nalus[:0]
+	for _, n := range nalus {
+		if len(n) > 0 {
+			t := n[0] & 0x1F
+			if hevc {
+				t = (n[0] >> 1) & 0x3F
+			}
+			if name, ok := drop[t]; ok {
+				evNALUsFiltered.Add(name, 1)
+				continue
+			}
+		}
+		kept = append(kept, n)
+	}
+	return kept
+}
@@ -0,0 +1,64 @@
+// orientation.go — 擷取方向：-lock-orientation 對應 scrcpy server 的 capture_orientation 參數，
+// 可固定畫面方向（例如遊戲串流一律橫向），不受裝置旋轉影響；
+// POST /devices/{id}/orientation 以新的設定重新啟動目前裝置的 scrcpy server。
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// captureOrientations 為 scrcpy 接受的方向值（不含鎖定前綴 @）
+var captureOrientations = map[string]bool{
+	"0": true, "90": true, "180": true, "270": true,
+	"flip0": true, "flip90": true, "flip180": true, "flip270": true,
+}
+
+// validateOrientation 檢查 capture_orientation 值：空字串（跟隨旋轉）、單獨 "@"（鎖定在初始方向）
+// 或可加 "@" 前綴的方向值
+func validateOrientation(v string) error {
+	if v == "" || v == "@" {
+		return nil
+	}
+	if !captureOrientations[strings.TrimPrefix(v, "@")] {
+		return fmt.Errorf("invalid orientation %q (0, 90, 180, 270, flip0, flip90, flip180, flip270, optionally prefixed with @)", v)
+	}
+	return nil
+}
+
+// === HTTP: POST /devices/{id}/orientation handler ===
+// body 為 {"orientation":"@90"}；空字串恢復跟隨裝置旋轉。會重新啟動 scrcpy server，前端需等待新的關鍵幀
+func handleDeviceOrientation(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil || !requireADB(w, s) {
+		return
+	}
+	var req struct {
+		Orientation string `json:"orientation"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if err := validateOrientation(req.Orientation); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	opts := s.dev.Options()
+	opts.CaptureOrientation = req.Orientation
+	if _, err := restartSession(s, opts); err != nil {
+		writeRestartError(w, s.id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status":      "ok",
+		"id":          s.id,
+		"orientation": req.Orientation,
+	})
+}
@@ -3,9 +3,17 @@ package protocol
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"io"
 )
 
+// DefaultMaxPacketSize 為 Decode 與未指定上限的 Decoder 使用的 Body 大小上限
+const DefaultMaxPacketSize = 1 << 20
+
+// ErrPacketTooLarge 表示封包標頭宣告的大小超過 Decoder 的上限
+var ErrPacketTooLarge = errors.New("protocol: packet too large")
+
 // Packet 表示從 scrcpy 伺服器收到的簡化封包
 type Packet struct {
 	Type uint8
@@ -13,16 +21,40 @@ type Packet struct {
 	Body []byte
 }
 
-// Decode 從指定的 reader 讀取並解析封包
-func Decode(r io.Reader) (*Packet, error) {
+// Decoder 從 reader 依序解析封包。標頭宣告的大小超過 MaxSize 時回傳 ErrPacketTooLarge 而不配置 Body，
+// 避免損毀或惡意的資料造成巨量配置；MaxSize 為 0 時使用 DefaultMaxPacketSize
+type Decoder struct {
+	r       io.Reader
+	MaxSize uint32
+}
+
+// NewDecoder 建立以 maxSize 為 Body 上限的 Decoder（0 表示 DefaultMaxPacketSize）
+func NewDecoder(r io.Reader, maxSize uint32) *Decoder {
+	return &Decoder{r: r, MaxSize: maxSize}
+}
+
+// Decode 讀取並解析下一個封包
+func (d *Decoder) Decode() (*Packet, error) {
+	max := d.MaxSize
+	if max == 0 {
+		max = DefaultMaxPacketSize
+	}
 	var header [5]byte
-	if _, err := io.ReadFull(r, header[:]); err != nil {
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
 		return nil, err
 	}
 	p := &Packet{Type: header[0], Size: binary.BigEndian.Uint32(header[1:])}
+	if p.Size > max {
+		return nil, fmt.Errorf("%w: %d > %d", ErrPacketTooLarge, p.Size, max)
+	}
 	p.Body = make([]byte, p.Size)
-	if _, err := io.ReadFull(r, p.Body); err != nil {
+	if _, err := io.ReadFull(d.r, p.Body); err != nil {
 		return nil, err
 	}
 	return p, nil
 }
+
+// Decode 從指定的 reader 讀取並解析一個封包，上限為 DefaultMaxPacketSize
+func Decode(r io.Reader) (*Packet, error) {
+	return NewDecoder(r, 0).Decode()
+}
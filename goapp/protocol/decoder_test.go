@@ -0,0 +1,29 @@
+package protocol
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestDecodeRejectsHugeHeader(t *testing.T) {
+	// 標頭宣告約 4GB，後面沒有資料：必須在配置前就回傳錯誤
+	r := bytes.NewReader([]byte{7, 0xff, 0xff, 0xff, 0xff})
+	if _, err := Decode(r); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("Decode error = %v, want ErrPacketTooLarge", err)
+	}
+}
+
+func TestDecoderMaxSize(t *testing.T) {
+	data := []byte{1, 0, 0, 0, 4, 'a', 'b', 'c', 'd'}
+	if _, err := NewDecoder(bytes.NewReader(data), 3).Decode(); !errors.Is(err, ErrPacketTooLarge) {
+		t.Fatalf("max 3: error = %v, want ErrPacketTooLarge", err)
+	}
+	p, err := NewDecoder(bytes.NewReader(data), 4).Decode()
+	if err != nil {
+		t.Fatalf("max 4: %v", err)
+	}
+	if p.Type != 1 || p.Size != 4 || string(p.Body) != "abcd" {
+		t.Fatalf("got %+v", p)
+	}
+}
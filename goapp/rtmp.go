@@ -0,0 +1,302 @@
+// rtmp.go — 將裝置的 H.264/H.265 推送到 RTMP/RTSP（例如 OBS、串流平台的 ingest）。
+// 啟動外部 ffmpeg，從 stdin 讀取 Annex-B access unit，以 -c copy 轉封裝為 FLV（rtmp://）或 RTSP（rtsp://），不重新編碼。
+// 原始 H.264 沒有時間戳，ffmpeg 以收到的時間（-use_wallclock_as_timestamps）標記；AU 依 scrcpy 的 PTS 節奏即時送達，兩者一致。
+// ffmpeg 結束時以指數退避重新啟動，每次都從 SPS/PPS + IDR 開始。
+// 推流以裝置 ID 區分：POST /devices/{id}/rtmp（-enable-rtmp，需要 Bearer token）只設定該裝置的推流（url 空字串為停止）；
+// 啟動時的 -rtmp-url 則推送目前連線的裝置。
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	rtmpQueueSize  = 60 // 等待寫入 ffmpeg 的 AU 上限；塞滿時丟棄並等下一個 IDR
+	rtmpBackoffMin = time.Second
+	rtmpBackoffMax = 30 * time.Second
+	rtmpStopGrace  = 2 * time.Second // 停止時等待 ffmpeg 收尾的時間
+)
+
+type rtmpAU struct {
+	nalus [][]byte
+	idr   bool
+	frame *frameRef // 寫出或略過後 release；推流停止時留在 channel 的交給 GC
+}
+
+// rtmpAnyDevice 為 -rtmp-url 推流的 key：跟隨目前連線的裝置
+const rtmpAnyDevice = ""
+
+// rtmpSink 為一個推流目的地與其 ffmpeg 行程
+type rtmpSink struct {
+	device   string
+	url      string
+	format   string // ffmpeg 輸出格式：flv 或 rtsp
+	frames   chan rtmpAU
+	resync   atomic.Bool // 曾丟棄 AU，需從下一個 IDR 重新開始
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+var (
+	rtmpMu    sync.Mutex
+	rtmpSinks = make(map[string]*rtmpSink) // 以裝置 ID 為 key（受 rtmpMu 保護）
+)
+
+// rtmpFormat 依 URL scheme 決定 ffmpeg 的輸出格式
+func rtmpFormat(raw string) (string, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return "", fmt.Errorf("invalid url: %w", err)
+	}
+	switch u.Scheme {
+	case "rtmp", "rtmps":
+		return "flv", nil
+	case "rtsp":
+		return "rtsp", nil
+	}
+	return "", fmt.Errorf("unsupported scheme %q (rtmp, rtmps or rtsp)", u.Scheme)
+}
+
+// startRTMP 開始將裝置推流到 url，取代該裝置既有的推流
+func startRTMP(device, raw string) error {
+	format, err := rtmpFormat(raw)
+	if err != nil {
+		return err
+	}
+	s := &rtmpSink{device: device, url: raw, format: format, frames: make(chan rtmpAU, rtmpQueueSize), stop: make(chan struct{})}
+	rtmpMu.Lock()
+	prev := rtmpSinks[device]
+	rtmpSinks[device] = s
+	rtmpMu.Unlock()
+	if prev != nil {
+		prev.close()
+	}
+	logger.Info("rtmp_started", "device", device, "url", raw, "format", format)
+	goSafe("rtmp", s.run)
+	return nil
+}
+
+// stopRTMP 停止裝置的推流（若有）
+func stopRTMP(device string) {
+	rtmpMu.Lock()
+	prev := rtmpSinks[device]
+	delete(rtmpSinks, device)
+	rtmpMu.Unlock()
+	if prev != nil {
+		prev.close()
+		logger.Info("rtmp_stopped", "device", device, "url", prev.url)
+	}
+}
+
+// rtmpSinksFor 回傳裝置的推流：它自己的與 -rtmp-url 的
+func rtmpSinksFor(device string) []*rtmpSink {
+	rtmpMu.Lock()
+	defer rtmpMu.Unlock()
+	var sinks []*rtmpSink
+	if s := rtmpSinks[device]; s != nil {
+		sinks = append(sinks, s)
+	}
+	if s := rtmpSinks[rtmpAnyDevice]; s != nil && device != rtmpAnyDevice {
+		sinks = append(sinks, s)
+	}
+	return sinks
+}
+
+// rtmpActive 回傳裝置是否有推流（-idle-pause 視為有觀看者）
+func rtmpActive(device string) bool {
+	return len(rtmpSinksFor(device)) > 0
+}
+
+// rtmpFeed 由視訊迴圈呼叫，將裝置的一個 AU 交給它的推流；不阻塞，佇列滿時丟棄
+func rtmpFeed(device string, nalus [][]byte, idr bool, frame *frameRef) {
+	for _, s := range rtmpSinksFor(device) {
+		frame.retain()
+		select {
+		case s.frames <- rtmpAU{nalus: nalus, idr: idr, frame: frame}:
+		default:
+			frame.release()
+			s.resync.Store(true)
+			evRTMPFramesDropped.Add(1)
+		}
+	}
+}
+
+func (s *rtmpSink) close() {
+	s.stopOnce.Do(func() { close(s.stop) })
+}
+
+// run 反覆啟動 ffmpeg，異常結束時以指數退避重試，直到 close
+func (s *rtmpSink) run() {
+	backoff := rtmpBackoffMin
+	for {
+		started := time.Now()
+		err := s.stream()
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		if time.Since(started) > rtmpBackoffMax {
+			backoff = rtmpBackoffMin // 跑了一段時間才結束：視為新的失敗
+		}
+		logger.Warn("rtmp_ffmpeg_exited", "device", s.device, "url", s.url, "err", err, "retryIn", backoff)
+		evRTMPRestarts.Add(1)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, rtmpBackoffMax)
+	}
+}
+
+// stream 執行一次 ffmpeg，把 AU 寫入其 stdin；ffmpeg 結束或寫入失敗時回傳錯誤，close 時回傳 nil
+func (s *rtmpSink) stream() error {
+	inFormat := "h264"
+	stateMu.RLock()
+	if videoCodec == "h265" {
+		inFormat = "hevc"
+	}
+	stateMu.RUnlock()
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "warning",
+		"-use_wallclock_as_timestamps", "1", "-f", inFormat, "-i", "pipe:0",
+		"-c", "copy", "-f", s.format, s.url)
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// 每次啟動都從 IDR 開始；請求新的關鍵幀可縮短等待
+	waitKF := true
+	if sess := s.session(); sess != nil {
+		requestKeyframeDebounced(sess, "rtmp_started")
+	}
+	for {
+		select {
+		case <-s.stop:
+			stdin.Close()
+			select {
+			case <-exited:
+			case <-time.After(rtmpStopGrace):
+				cmd.Process.Kill()
+				<-exited
+			}
+			return nil
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("ffmpeg exited")
+			}
+			return err
+		case au := <-s.frames:
+			if s.resync.Swap(false) {
+				waitKF = true
+			}
+			if waitKF {
+				if !au.idr {
+					au.frame.release()
+					continue
+				}
+				waitKF = false
+			}
+			err := writeAnnexB(stdin, withParamSets(au.nalus, au.idr))
+			au.frame.release()
+			if err != nil {
+				cmd.Process.Kill()
+				<-exited
+				return fmt.Errorf("write to ffmpeg: %w", err)
+			}
+		}
+	}
+}
+
+// session 回傳推流目前推送的裝置 session；裝置未連線時為 nil
+func (s *rtmpSink) session() *deviceSession {
+	if s.device != rtmpAnyDevice {
+		return sessionForDevice(s.device)
+	}
+	stateMu.RLock()
+	defer stateMu.RUnlock()
+	return curSession
+}
+
+// withParamSets 在 IDR 前補上快取的參數集（scrcpy 的參數集通常在獨立的 config packet）
+func withParamSets(nalus [][]byte, idr bool) [][]byte {
+	if !idr {
+		return nalus
+	}
+	stateMu.RLock()
+	hevc := videoCodec == "h265"
+	stateMu.RUnlock()
+	for _, n := range nalus {
+		if classifyNALU(n, hevc) == nalSPS {
+			return nalus
+		}
+	}
+	ps := paramSets()
+	if ps == nil {
+		return nalus
+	}
+	return append(ps, nalus...)
+}
+
+// writeAnnexB 以 4 bytes 起始碼寫出 NALU
+func writeAnnexB(w io.Writer, nalus [][]byte) error {
+	startCode := []byte{0, 0, 0, 1}
+	for _, n := range nalus {
+		if len(n) == 0 {
+			continue
+		}
+		if _, err := w.Write(startCode); err != nil {
+			return err
+		}
+		if _, err := w.Write(n); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// === HTTP: POST /devices/{id}/rtmp handler ===
+// body 為 {"url":"rtmp://..."}；url 為空字串時停止推流。只有 -enable-rtmp 且設定 -api-token 時註冊（需要 Bearer token）
+func handleDeviceRTMP(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil {
+		return
+	}
+	var req struct {
+		URL string `json:"url"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	if req.URL == "" {
+		stopRTMP(s.id)
+	} else if err := startRTMP(s.id, req.URL); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_request", err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "ok",
+		"url":    req.URL,
+	})
+}
@@ -0,0 +1,39 @@
+package main
+
+import "testing"
+
+func TestRTMPFeedKeyedByDevice(t *testing.T) {
+	newSink := func(device string) *rtmpSink {
+		return &rtmpSink{device: device, frames: make(chan rtmpAU, 4), stop: make(chan struct{})}
+	}
+	a, follow := newSink("rtmp-a"), newSink(rtmpAnyDevice)
+	rtmpMu.Lock()
+	rtmpSinks["rtmp-a"] = a
+	rtmpMu.Unlock()
+	t.Cleanup(func() { stopRTMP("rtmp-a"); stopRTMP(rtmpAnyDevice) })
+
+	au := [][]byte{{0x65, 0x88}}
+	rtmpFeed("rtmp-b", au, true, nil)
+	if len(a.frames) != 0 {
+		t.Error("another device's AU reached rtmp-a's sink")
+	}
+	if rtmpActive("rtmp-b") {
+		t.Error("rtmp-b reported as streaming")
+	}
+	rtmpFeed("rtmp-a", au, true, nil)
+	if len(a.frames) != 1 {
+		t.Errorf("rtmp-a's sink got %d AUs, want 1", len(a.frames))
+	}
+
+	// -rtmp-url 推送目前連線的任何裝置
+	rtmpMu.Lock()
+	rtmpSinks[rtmpAnyDevice] = follow
+	rtmpMu.Unlock()
+	rtmpFeed("rtmp-b", au, true, nil)
+	if len(follow.frames) != 1 || len(a.frames) != 1 {
+		t.Errorf("-rtmp-url sink got %d AUs, rtmp-a %d; want 1 and 1", len(follow.frames), len(a.frames))
+	}
+	if !rtmpActive("rtmp-b") {
+		t.Error("rtmp-b not reported as streaming to -rtmp-url")
+	}
+}
@@ -0,0 +1,174 @@
+// rtp_queue.go — 視訊讀取迴圈與各前端 RTP 發送之間的有界佇列。
+// 每個前端一條佇列與一個發送 goroutine（見 fanout.go），讀取端不會因任何一個前端的 WebRTC 發送變慢而阻塞；
+// 佇列滿時依策略丟棄，預設絕不丟棄含 IDR 的 AU。
+
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// paceMaxDelay 為 -pace 模式下兩個 AU 之間最長的等待時間（避免 PTS 跳動時卡住）
+const paceMaxDelay = 100 * time.Millisecond
+
+// rtpPayload 為一個待發送的 Access Unit
+type rtpPayload struct {
+	nalus [][]byte
+	ts    uint32
+	idr   bool      // AU 內含 IDR（丟掉會造成長時間花屏）
+	frame *frameRef // nalus 所切自的 frame；佇列持有一個引用，取出者用完後 release（nil 為不需歸還）
+}
+
+type rtpQueue struct {
+	mu     sync.Mutex
+	items  []rtpPayload
+	max    int
+	notify chan struct{} // 有新資料或已關閉（容量 1）
+	closed bool
+
+	keepKeyframes bool // 佇列滿時以淘汰舊的非關鍵幀保住 IDR
+	awaitingKF    bool // 已因丟幀請求過關鍵幀，收到 IDR 前不重複請求
+}
+
+func newRTPQueue(max int, keepKeyframes bool) *rtpQueue {
+	return &rtpQueue{
+		items:         make([]rtpPayload, 0, max),
+		max:           max,
+		notify:        make(chan struct{}, 1),
+		keepKeyframes: keepKeyframes,
+	}
+}
+
+// push 放入一個 AU（放入時 retain 它的 frame）；dropped 表示因佇列已滿丟棄了它，needKF 表示丟棄的是非關鍵幀且尚未請求過關鍵幀（呼叫端應請求）
+func (q *rtpQueue) push(p rtpPayload) (dropped, needKF bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return false, false
+	}
+	if p.idr {
+		q.awaitingKF = false
+	}
+	if len(q.items) >= q.max {
+		if !p.idr || !q.keepKeyframes {
+			evFramesDropped.Add(1)
+			if q.awaitingKF {
+				return true, false
+			}
+			q.awaitingKF = true
+			return true, true
+		}
+		// 新 AU 含 IDR：淘汰最舊的非關鍵幀；全是關鍵幀時淘汰最舊者
+		victim := 0
+		for i, it := range q.items {
+			if !it.idr {
+				victim = i
+				break
+			}
+		}
+		q.items[victim].frame.release()
+		q.items = append(q.items[:victim], q.items[victim+1:]...)
+		evFramesEvictedKF.Add(1)
+	}
+	p.frame.retain()
+	q.items = append(q.items, p)
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return false, false
+}
+
+// pop 取出最舊的 AU（連同它的 frame 引用）；佇列已關閉且清空時回傳 false
+func (q *rtpQueue) pop() (rtpPayload, bool) {
+	for {
+		q.mu.Lock()
+		if len(q.items) > 0 {
+			p := q.items[0]
+			q.items[0] = rtpPayload{}
+			q.items = q.items[1:]
+			q.mu.Unlock()
+			return p, true
+		}
+		if q.closed {
+			q.mu.Unlock()
+			return rtpPayload{}, false
+		}
+		q.mu.Unlock()
+		<-q.notify
+	}
+}
+
+func (q *rtpQueue) close() {
+	q.mu.Lock()
+	q.closed = true
+	q.mu.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// startRTPSender 依序取出前端佇列中的 AU 並寫入它的 track，佇列關閉（removeClient）後結束。
+// pace 為 true 時依 RTP 時間戳差（90kHz）間隔送出，把 scrcpy 停頓後的一批 AU 攤平，以少許延遲換取穩定的節奏；
+// probe 為 true 時每送出一個 AU 就送 frameMarker（-latency-probe）
+func startRTPSender(c *clientInfo, pace, probe bool) {
+	var prevTS uint32
+	var prevSent time.Time
+	var markerSeq uint64
+	for {
+		p, ok := c.queue.pop()
+		if !ok {
+			return
+		}
+		if pace && !prevSent.IsZero() {
+			delta := time.Duration(int32(p.ts-prevTS)) * time.Second / 90000
+			if delta > paceMaxDelay {
+				delta = paceMaxDelay
+			}
+			// 時間戳倒退或已經落後時不等待
+			if wait := time.Until(prevSent.Add(delta)); delta > 0 && wait > 0 {
+				time.Sleep(wait)
+			}
+		}
+		sent := c.writeAU(p.nalus, p.ts)
+		p.frame.release() // packetizer 已複製出 payload
+		if sent && probe {
+			markerSeq++
+			stateMu.RLock()
+			dc := c.dc
+			stateMu.RUnlock()
+			sendFrameMarker(dc, markerSeq, p.ts)
+		}
+		prevTS, prevSent = p.ts, time.Now()
+	}
+}
+
+// writeAU 以前端自己的 packetizer 將 AU 切成 RTP 封包寫入它的 track（時間戳以 ts 覆寫）
+func (c *clientInfo) writeAU(nalus [][]byte, ts uint32) bool {
+	if len(nalus) == 0 {
+		return false
+	}
+	for i, n := range nalus {
+		if len(n) == 0 {
+			continue
+		}
+		pkts := c.packetizer.Packetize(n, 0) // samples=0，手動覆寫 Timestamp
+		for j, p := range pkts {
+			p.Timestamp = ts
+			p.Marker = (i == len(nalus)-1) && (j == len(pkts)-1)
+			if err := c.track.WriteRTP(p); err != nil {
+				log.Printf("[RTP][%s] write error: %v (seq=%d, ts=%d)", c.id, err, p.SequenceNumber, p.Timestamp)
+				evRTPWriteErrors.Add(1)
+			} else {
+				evRTPPacketsSent.Add(1)
+				c.lastSeq.Store(uint32(p.SequenceNumber))
+				c.lastTS.Store(p.Timestamp)
+				c.sentRTP.Store(true)
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,85 @@
+// serials.go — -allow-serials / -deny-serials：限制這個服務可以連線的 adb 序號。
+// 同一台主機上跑多個 scrcpy 服務時，用來避免搶到別人的裝置。序號可為 USB 序號或 IP:port（無線 adb）。
+// deny 優先於 allow；設定了 allow-list 時只連線列出的序號。
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+// errSerialNotAllowed 表示序號被 allow/deny 設定排除
+var errSerialNotAllowed = errors.New("serial not allowed")
+
+var (
+	allowSerials map[string]bool // nil 表示不限制
+	denySerials  map[string]bool
+)
+
+// initSerialFilters 解析 -allow-serials / -deny-serials；必須在 flag.Parse 之後呼叫
+func initSerialFilters(allow, deny string) {
+	allowSerials = parseSerialList(allow)
+	denySerials = parseSerialList(deny)
+}
+
+// parseSerialList 解析逗號分隔的序號清單；空字串回傳 nil
+func parseSerialList(s string) map[string]bool {
+	var m map[string]bool
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		if m == nil {
+			m = make(map[string]bool)
+		}
+		m[f] = true
+	}
+	return m
+}
+
+// checkSerial 判斷序號是否允許連線；空序號（adb 預設裝置）在有設定清單時先解析成實際序號
+func checkSerial(serial string) error {
+	if allowSerials == nil && denySerials == nil {
+		return nil
+	}
+	if serial == "" {
+		s, err := defaultSerial()
+		if err != nil {
+			return err
+		}
+		serial = s
+	}
+	if denySerials[serial] {
+		return fmt.Errorf("%s: %w（-deny-serials）", serial, errSerialNotAllowed)
+	}
+	if allowSerials != nil && !allowSerials[serial] {
+		return fmt.Errorf("%s: %w（不在 -allow-serials 中）", serial, errSerialNotAllowed)
+	}
+	return nil
+}
+
+// defaultSerial 找出未指定序號時 adb 會選到的裝置（僅有一台 device 狀態的裝置時）
+func defaultSerial() (string, error) {
+	devs, err := adb.ListDevices()
+	if err != nil {
+		return "", fmt.Errorf("list devices: %w", err)
+	}
+	serial := ""
+	for _, d := range devs {
+		if d.State != "device" {
+			continue
+		}
+		if serial != "" {
+			return "", fmt.Errorf("有多台裝置，設定 -allow-serials/-deny-serials 時請指定序號")
+		}
+		serial = d.Serial
+	}
+	if serial == "" {
+		return "", fmt.Errorf("找不到可用的裝置")
+	}
+	return serial, nil
+}
@@ -0,0 +1,151 @@
+// server.go — 在 Go 程式中直接操作本服務：Server 提供新增/移除裝置、列出裝置與逐幀回呼（OnFrame），
+// 不必經過 HTTP；HTTP 路由也由 Server 提供（Handler），main 只建立 Server 並掛上 http.Server。
+// 與 /offer 相同，同一時間只有一台裝置的 scrcpy session：AddDevice 另一台裝置會取代目前的連線並關閉它的前端。
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/yourname/scrcpy-go/media"
+)
+
+// Server 為本服務的程式介面
+type Server struct {
+	mux         *http.ServeMux
+	debugRoutes string // 已開啟的偵錯端點（啟動日誌用）
+}
+
+// DeviceOptions 為 AddDevice 的參數；其餘 scrcpy 選項沿用命令列旗標
+type DeviceOptions struct {
+	Serial string // adb 序號（USB 序號或 IP:port）；空字串為 adb 的預設裝置
+	Codec  string // h264 或 h265；空字串為 h264
+}
+
+// DeviceInfo 為 ListDevices 中的一台裝置
+type DeviceInfo struct {
+	ID            string // 裝置 ID（同 HTTP 路徑中的 {id}）
+	Connected     bool   // 有 scrcpy session
+	Codec         string // 以下僅 Connected 時有值
+	Width, Height uint16
+	Clients       int // 連線中的 WebRTC 前端數
+}
+
+// FrameFunc 為 OnFrame 的回呼：device 為裝置 ID
+type FrameFunc func(device string, au media.AccessUnit)
+
+// NewServer 建立 Server 與它的 HTTP 路由（依命令列旗標開啟高權限與偵錯端點）
+func NewServer() *Server {
+	mux, debugRoutes := newMux()
+	return &Server{mux: mux, debugRoutes: debugRoutes}
+}
+
+// Handler 回傳 HTTP 路由（/offer、/devices、/stats 等）
+func (s *Server) Handler() http.Handler {
+	return s.mux
+}
+
+// AddDevice 連線到裝置並啟動 scrcpy server；裝置已連線時直接回傳它的資訊。
+// 之後瀏覽器的 /offer 會加入這台裝置的 session
+func (s *Server) AddDevice(opts DeviceOptions) (DeviceInfo, error) {
+	codec := opts.Codec
+	if codec == "" || *flagReplay != "" {
+		codec = "h264"
+	}
+	if _, ok := codecMimeTypes[codec]; !ok {
+		return DeviceInfo{}, fmt.Errorf("unsupported codec %q (h264 or h265)", codec)
+	}
+	id := deviceKey(opts.Serial)
+	if sessionForDevice(id) == nil {
+		if isDeviceDead(opts.Serial) {
+			return DeviceInfo{}, fmt.Errorf("device %s marked dead after repeated connection failures", id)
+		}
+		dopts := deviceOptions()
+		dopts.VideoCodec = codec
+		sess, err := connectToDevice(opts.Serial, dopts)
+		noteConnectResult(opts.Serial, err)
+		if err != nil {
+			return DeviceInfo{}, err
+		}
+		installSession(sess, codec)
+	}
+	stateMu.Lock()
+	adbTarget = opts.Serial
+	stateMu.Unlock()
+	for _, d := range s.ListDevices() {
+		if d.ID == id {
+			return d, nil
+		}
+	}
+	return DeviceInfo{}, errors.New("device disconnected right after connecting")
+}
+
+// RemoveDevice 中斷裝置的連線並關閉它的所有前端
+func (s *Server) RemoveDevice(id string) error {
+	if !disconnectDevice(id) {
+		return fmt.Errorf("device %s not connected", id)
+	}
+	return nil
+}
+
+// ListDevices 列出目前連線中的裝置與有前端的裝置，依裝置 ID 排序
+func (s *Server) ListDevices() []DeviceInfo {
+	stateMu.RLock()
+	stats := statsLocked()
+	stateMu.RUnlock()
+	devices := make([]DeviceInfo, 0, len(stats))
+	for _, d := range stats {
+		info := DeviceInfo{ID: d.ID, Clients: len(d.Clients)}
+		if d.Stream != nil {
+			info.Connected = true
+			info.Codec, info.Width, info.Height = d.Stream.Codec, d.Stream.Width, d.Stream.Height
+		}
+		devices = append(devices, info)
+	}
+	return devices
+}
+
+// OnFrame 註冊逐幀回呼：每台裝置的每個 access unit 都會在視訊迴圈中同步呼叫 fn，
+// 因此 fn 必須很快返回（耗時的處理請改用有緩衝的 Subscribe）；
+// au.NALUs 只在回呼期間有效，需要保留時請複製。回傳的 cancel 取消註冊
+func (s *Server) OnFrame(fn FrameFunc) (cancel func()) {
+	h := &fn
+	frameHooksMu.Lock()
+	frameHooks[h] = struct{}{}
+	frameHooksMu.Unlock()
+	return func() {
+		frameHooksMu.Lock()
+		delete(frameHooks, h)
+		frameHooksMu.Unlock()
+	}
+}
+
+// Subscribe 以有緩衝的 channel 訂閱裝置的 access unit，跟不上時丟棄並從下一個關鍵幀重新開始；
+// 第一個收到的是補上參數集的關鍵幀。裝置不需已連線，之後的 session 都會收到（見 subscribe.go）
+func (s *Server) Subscribe(device string, buf int) (<-chan media.AccessUnit, func()) {
+	return subscribeAUs(device, buf)
+}
+
+var (
+	frameHooksMu sync.RWMutex
+	frameHooks   = make(map[*FrameFunc]struct{})
+)
+
+// runFrameHooks 由視訊迴圈呼叫，把 AU 交給 OnFrame 的回呼
+func runFrameHooks(device string, nalus [][]byte, ts uint32, idr bool) {
+	frameHooksMu.RLock()
+	defer frameHooksMu.RUnlock()
+	for h := range frameHooks {
+		(*h)(device, media.AccessUnit{NALUs: nalus, TS: ts, Keyframe: idr})
+	}
+}
+
+// frameHooked 回傳是否有 OnFrame 回呼（-idle-pause 視為有觀看者）
+func frameHooked() bool {
+	frameHooksMu.RLock()
+	defer frameHooksMu.RUnlock()
+	return len(frameHooks) > 0
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/yourname/scrcpy-go/media"
+)
+
+func TestServerAPI(t *testing.T) {
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+		t.Cleanup(func() { log.SetOutput(os.Stderr) })
+	}
+	path := filepath.Join(t.TempDir(), "replay.h264")
+	if err := os.WriteFile(path, syntheticH264(320, 240), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	setFlag(t, "replay", path)
+	setFlag(t, "replay-fps", "60")
+	t.Cleanup(func() {
+		disconnectDevice("replay")
+		stateMu.Lock()
+		adbTarget = ""
+		stateMu.Unlock()
+	})
+
+	srv := NewServer()
+	frames := make(chan media.AccessUnit, 1)
+	cancel := srv.OnFrame(func(device string, au media.AccessUnit) {
+		if device != "replay" || !au.Keyframe {
+			return
+		}
+		au.NALUs = cloneNALUs(au.NALUs) // 只在回呼期間有效
+		select {
+		case frames <- au:
+		default:
+		}
+	})
+	defer cancel()
+
+	info, err := srv.AddDevice(DeviceOptions{})
+	if err != nil {
+		t.Fatalf("AddDevice: %v", err)
+	}
+	if info.ID != "replay" || !info.Connected || info.Codec != "h264" {
+		t.Fatalf("AddDevice = %+v, want connected replay device with h264", info)
+	}
+	sess := sessionForDevice("replay")
+	if again, err := srv.AddDevice(DeviceOptions{}); err != nil || again.ID != "replay" || sessionForDevice("replay") != sess {
+		t.Errorf("adding a connected device again: %+v, %v; want the existing session", again, err)
+	}
+
+	select {
+	case au := <-frames:
+		if len(au.NALUs) == 0 {
+			t.Error("OnFrame got an empty keyframe")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnFrame never saw a keyframe")
+	}
+
+	if devs := srv.ListDevices(); len(devs) != 1 || devs[0].ID != "replay" || !devs[0].Connected {
+		t.Errorf("ListDevices = %+v, want the replay device", devs)
+	}
+	if err := srv.RemoveDevice("replay"); err != nil {
+		t.Fatalf("RemoveDevice: %v", err)
+	}
+	if devs := srv.ListDevices(); len(devs) != 0 {
+		t.Errorf("ListDevices after RemoveDevice = %+v, want none", devs)
+	}
+	if err := srv.RemoveDevice("replay"); err == nil {
+		t.Error("removing a disconnected device succeeded")
+	}
+}
@@ -0,0 +1,33 @@
+// serverargs.go — -server-arg：原樣附加到 scrcpy server 的 key=value 參數（例如 power_on=false、clipboard_autosync=false），
+// 不必為每個 scrcpy 選項新增旗標。可重複指定；影響讀取協定或由其他旗標控制的參數會在啟動時被拒絕（見 adb.ValidateServerArg）。
+
+package main
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+// serverArgList 實作 flag.Value 以支援重複指定
+type serverArgList []string
+
+var serverArgs serverArgList
+
+func init() {
+	flag.Var(&serverArgs, "server-arg", "附加到 scrcpy server 的參數，格式 key=value（可重複指定，例如 -server-arg power_on=false）")
+}
+
+func (l *serverArgList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *serverArgList) Set(v string) error {
+	v = strings.TrimSpace(v)
+	if err := adb.ValidateServerArg(v); err != nil {
+		return err
+	}
+	*l = append(*l, v)
+	return nil
+}
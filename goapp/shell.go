@@ -0,0 +1,153 @@
+// shell.go — POST /devices/{id}/shell：在裝置上執行 adb shell 指令並串流回傳輸出（例如 getprop、input keyevent）。
+// 權限等同裝置的 shell 使用者，預設關閉，需以 -enable-shell 開啟並設定 -api-token（見 apitoken.go）；
+// 指令的第一個字必須在 -shell-allow 清單內，且不可含 shell 特殊字元（避免以 ; | $() 等串接其他指令）。
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os/exec"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+const (
+	shellCmdMaxLen   = 1024
+	shellBodyMaxSize = 4 << 10
+)
+
+// shellAllowed 為 -shell-allow 解析後的指令名稱（main 啟動時設定，之後唯讀）
+var shellAllowed = map[string]bool{}
+
+// initShellAllow 解析逗號分隔的指令名稱清單
+func initShellAllow(list string) {
+	for _, name := range strings.Split(list, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			shellAllowed[name] = true
+		}
+	}
+}
+
+// validateShellCmd 檢查指令長度、字元與允許清單，回傳第一個錯誤
+func validateShellCmd(cmd string) error {
+	if cmd == "" {
+		return fmt.Errorf("empty command")
+	}
+	if len(cmd) > shellCmdMaxLen {
+		return fmt.Errorf("command too long (max %d bytes)", shellCmdMaxLen)
+	}
+	for _, c := range cmd {
+		if !isShellSafe(c) {
+			return fmt.Errorf("character %q not allowed", c)
+		}
+	}
+	name := strings.Fields(cmd)[0]
+	if !shellAllowed[name] {
+		return fmt.Errorf("command %q not in -shell-allow", name)
+	}
+	return nil
+}
+
+// isShellSafe 只允許英數字、空白與不具 shell 語意的標點
+func isShellSafe(c rune) bool {
+	switch {
+	case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		return true
+	}
+	return strings.ContainsRune(" ._-/:=,@%+", c)
+}
+
+// shellStream 將指令輸出逐塊寫成 NDJSON 行 {"output":"..."} 並立即 flush；
+// 切在多位元組字元中間的 bytes 留到下一塊，避免輸出被替換成 U+FFFD
+type shellStream struct {
+	w       http.ResponseWriter
+	enc     *json.Encoder
+	pending []byte
+}
+
+func newShellStream(w http.ResponseWriter) *shellStream {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	return &shellStream{w: w, enc: json.NewEncoder(w)}
+}
+
+func (s *shellStream) Write(p []byte) (int, error) {
+	b := append(s.pending, p...)
+	cut := len(b)
+	for i := len(b) - 1; i >= 0 && i > len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if !utf8.FullRune(b[i:]) {
+				cut = i
+			}
+			break
+		}
+	}
+	s.pending = append([]byte(nil), b[cut:]...)
+	if cut > 0 {
+		if err := s.line(map[string]any{"output": string(b[:cut])}); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// line 寫出一行 NDJSON 並 flush
+func (s *shellStream) line(v any) error {
+	if err := s.enc.Encode(v); err != nil {
+		return err
+	}
+	return http.NewResponseController(s.w).Flush()
+}
+
+// finish 送出剩下的輸出與最後一行（結束碼或錯誤）
+func (s *shellStream) finish(last map[string]any) {
+	if len(s.pending) > 0 {
+		_ = s.line(map[string]any{"output": string(s.pending)})
+		s.pending = nil
+	}
+	_ = s.line(last)
+}
+
+// === HTTP: POST /devices/{id}/shell handler ===
+// body 為 {"cmd":"getprop ro.product.model"}；回應為 application/x-ndjson，輸出隨產生送出，每行 {"output":"..."}，
+// 最後一行為 {"exitCode":N}（指令以非 0 結束時仍為 200），adb 本身失敗時為 {"error":{"code":"adb_failed","message":"..."}}
+func handleDeviceShell(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil || !requireADB(w, s) {
+		return
+	}
+	var req struct {
+		Cmd string `json:"cmd"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, shellBodyMaxSize)).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_json", "Invalid JSON")
+		return
+	}
+	req.Cmd = strings.TrimSpace(req.Cmd)
+	if err := validateShellCmd(req.Cmd); err != nil {
+		writeError(w, http.StatusForbidden, "shell_not_allowed", err.Error())
+		return
+	}
+
+	log.Printf("[ADB][%s] shell: %s", s.id, req.Cmd)
+	out := newShellStream(w)
+	err := s.dev.Shell(r.Context(), req.Cmd, out)
+	var ce *adb.CommandError
+	var ee *exec.ExitError
+	switch {
+	case err == nil:
+		out.finish(map[string]any{"exitCode": 0})
+	case errors.As(err, &ce) && ce.Kind == nil && errors.As(err, &ee) && r.Context().Err() == nil:
+		out.finish(map[string]any{"exitCode": ee.ExitCode()}) // 指令本身失敗：輸出已照常送出
+	default:
+		log.Printf("[ADB][%s] shell 失敗: %v", s.id, err)
+		// 輸出已開始串流，狀態碼無法再變更，改以最後一行回報
+		out.finish(map[string]any{"error": map[string]string{"code": "adb_failed", "message": err.Error()}})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+// shellTestServer 以假的 adb（script 為 adb shell 之後執行的 sh 內容）與 -enable-shell 啟動路由
+func shellTestServer(t *testing.T, script string) *httptest.Server {
+	t.Helper()
+	if runtime.GOOS == "windows" {
+		t.Skip("fake adb is a shell script")
+	}
+	dir := t.TempDir()
+	fake := "#!/bin/sh\n[ \"$1\" = start-server ] && exit 0\n" + script
+	if err := os.WriteFile(filepath.Join(dir, "adb"), []byte(fake), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+	dev, err := adb.NewDevice("", adb.Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stateMu.Lock()
+	old := curSession
+	curSession = &deviceSession{id: "shell-dev", dev: dev, log: logger}
+	stateMu.Unlock()
+	initShellAllow("getprop")
+	setFlag(t, "enable-shell", "true")
+	setFlag(t, "api-token", "s3cret")
+	mux, _ := newMux()
+	srv := httptest.NewServer(mux)
+	t.Cleanup(func() {
+		srv.Close()
+		stateMu.Lock()
+		curSession = old
+		stateMu.Unlock()
+	})
+	return srv
+}
+
+func postShell(t *testing.T, srv *httptest.Server, token string) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest("POST", srv.URL+"/devices/shell-dev/shell", strings.NewReader(`{"cmd":"getprop ro.product.model"}`))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := srv.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+func TestShellNeedsToken(t *testing.T) {
+	srv := shellTestServer(t, "echo Pixel\n")
+	for _, token := range []string{"", "wrong"} {
+		if resp := postShell(t, srv, token); resp.StatusCode != http.StatusUnauthorized {
+			t.Errorf("token %q: status %s, want 401", token, resp.Status)
+		}
+	}
+
+	setFlag(t, "api-token", "")
+	mux, _ := newMux()
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("POST", "/devices/shell-dev/shell", strings.NewReader(`{"cmd":"getprop"}`)))
+	if w.Code == http.StatusOK || w.Code == http.StatusUnauthorized {
+		t.Errorf("shell registered without -api-token (status %d)", w.Code)
+	}
+}
+
+func TestShellStreamsOutput(t *testing.T) {
+	// 第一行輸出後停頓：串流時應在指令結束前就收到第一行；最後一行「機」以 3 次 write 送出
+	srv := shellTestServer(t, "echo first\nsleep 1\nprintf '\\346'; printf '\\251'; printf '\\237\\n'\nexit 3\n")
+	start := time.Now()
+	resp := postShell(t, srv, "s3cret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status %s", resp.Status)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/x-ndjson" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	sc := bufio.NewScanner(resp.Body)
+	var output strings.Builder
+	var last map[string]any
+	for sc.Scan() {
+		var line map[string]any
+		if err := json.Unmarshal(sc.Bytes(), &line); err != nil {
+			t.Fatalf("bad line %q: %v", sc.Text(), err)
+		}
+		if out, ok := line["output"].(string); ok {
+			if output.Len() == 0 && time.Since(start) > 800*time.Millisecond {
+				t.Errorf("first output arrived after %v, not streamed", time.Since(start))
+			}
+			output.WriteString(out)
+			continue
+		}
+		last = line
+	}
+	if got := output.String(); got != "first\n機\n" {
+		t.Errorf("output = %q, want %q", got, "first\n機\n")
+	}
+	if last["exitCode"] != float64(3) {
+		t.Errorf("last line = %v, want exitCode 3", last)
+	}
+}
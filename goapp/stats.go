@@ -0,0 +1,89 @@
+// stats.go — GET /stats：一次列出所有裝置的串流資訊（fps、位元率、觀察到的 GOP 與距上一個 IDR 的時間）
+// 與前端連線品質（ping RTT、RTP SSRC/序號、RTCP 接收報告、解碼器失步恢復次數），
+// 前端欄位與 GET /devices/{id}/clients 相同，方便監控端定期抓取而不必逐台查詢。
+
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// deviceStats 為 GET /stats 中的單一裝置
+type deviceStats struct {
+	ID      string        `json:"id"`
+	Stream  *streamInfo   `json:"stream,omitempty"` // 僅目前連線中的裝置
+	Clients []clientStats `json:"clients"`
+}
+
+// streamInfo 為裝置 session 的串流資訊（GET /stats 與 GET /devices 的 stream 欄位）
+type streamInfo struct {
+	Codec  string  `json:"codec"`
+	Width  uint16  `json:"width"`
+	Height uint16  `json:"height"`
+	FPS    float64 `json:"fps"`
+	Kbps   float64 `json:"kbps"` // 依讀取位元組估算
+	// 關鍵幀：平滑後的 GOP 幀數與間隔秒數、距上一個 IDR 的秒數（尚未收到 IDR 時省略），見 gop.go
+	GOPFrames        float64  `json:"gopFrames"`
+	KeyframeInterval float64  `json:"keyframeIntervalSec"`
+	SinceIDR         *float64 `json:"sinceIdrSec,omitempty"`
+}
+
+// streamInfoLocked 取出 session 目前的串流資訊；呼叫端需持有 stateMu
+func (s *deviceSession) streamInfoLocked() *streamInfo {
+	st := &streamInfo{
+		Codec:  s.codec,
+		Width:  s.videoW,
+		Height: s.videoH,
+		FPS:    math.Round(s.fps*10) / 10,
+		Kbps:   math.Round(s.kbps),
+
+		GOPFrames:        math.Round(s.gopFrames*10) / 10,
+		KeyframeInterval: math.Round(s.keyframeInterval*100) / 100,
+	}
+	if !s.lastIDRAt.IsZero() {
+		since := math.Round(time.Since(s.lastIDRAt).Seconds()*100) / 100
+		st.SinceIDR = &since
+	}
+	return st
+}
+
+// statsLocked 列出目前連線中的裝置與有前端的裝置，依裝置 ID 排序；呼叫端需持有 stateMu
+func statsLocked() []deviceStats {
+	var ids []string
+	if curSession != nil {
+		ids = append(ids, curSession.id)
+	}
+	for _, c := range clients {
+		ids = append(ids, c.device)
+	}
+	slices.Sort(ids)
+	ids = slices.Compact(ids)
+
+	devices := make([]deviceStats, 0, len(ids))
+	for _, id := range ids {
+		d := deviceStats{ID: id, Clients: clientStatsLocked(id)}
+		if curSession != nil && curSession.id == id {
+			d.Stream = curSession.streamInfoLocked()
+		}
+		devices = append(devices, d)
+	}
+	return devices
+}
+
+// === HTTP: GET /stats handler ===
+// 回應 {"uptimeSec", "devices": [{"id", "stream", "clients": [...]}]}
+func handleStats(w http.ResponseWriter, r *http.Request) {
+	stateMu.RLock()
+	devices := statsLocked()
+	stateMu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"uptimeSec": int64(time.Since(processStart).Seconds()),
+		"devices":   devices,
+	})
+}
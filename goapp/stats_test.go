@@ -0,0 +1,171 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+// getStats 呼叫 GET /stats 並解出裝置列表
+func getStats(t *testing.T) []deviceStats {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handleStats(w, httptest.NewRequest("GET", "/stats", nil))
+	var resp struct {
+		Devices []deviceStats `json:"devices"`
+	}
+	if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+		t.Fatalf("decode /stats: %v", err)
+	}
+	return resp.Devices
+}
+
+// statsClient 找出 /stats 中指定裝置的指定前端
+func statsClient(t *testing.T, devices []deviceStats, device, id string) clientStats {
+	t.Helper()
+	for _, d := range devices {
+		if d.ID != device {
+			continue
+		}
+		for _, c := range d.Clients {
+			if c.ID == id {
+				return c
+			}
+		}
+	}
+	t.Fatalf("/stats has no client %s on device %s: %+v", id, device, devices)
+	return clientStats{}
+}
+
+func TestStatsListsClientsOfEveryDevice(t *testing.T) {
+	a := addTestClient(t, "stats-a1", "stats-dev-a", discardTrack{})
+	addTestClient(t, "stats-b1", "stats-dev-b", discardTrack{})
+	stateMu.Lock()
+	a.rtt = 42 * time.Millisecond
+	stateMu.Unlock()
+
+	devices := getStats(t)
+	var ids []string
+	for _, d := range devices {
+		ids = append(ids, d.ID)
+	}
+	ia, ib := slices.Index(ids, "stats-dev-a"), slices.Index(ids, "stats-dev-b")
+	if ia < 0 || ib < 0 || ia > ib {
+		t.Fatalf("/stats devices = %v, want stats-dev-a before stats-dev-b", ids)
+	}
+	if c := statsClient(t, devices, "stats-dev-a", "stats-a1"); c.RTTMs != 42 {
+		t.Errorf("rttMs = %v, want 42", c.RTTMs)
+	}
+	statsClient(t, devices, "stats-dev-b", "stats-b1")
+}
+
+func TestStatsReportsSSRCAndLastRTP(t *testing.T) {
+	c := addTestClient(t, "stats-rtp", "stats-dev-rtp", discardTrack{})
+	stateMu.Lock()
+	c.ssrc = 0x5eed
+	stateMu.Unlock()
+	if !clientConnected(c.id, nil) {
+		t.Fatal("client not registered")
+	}
+
+	e := statsClient(t, getStats(t), "stats-dev-rtp", "stats-rtp")
+	if e.SSRC != 0x5eed {
+		t.Errorf("ssrc = %#x, want 0x5eed", e.SSRC)
+	}
+	if e.Seq != nil || e.TS != nil {
+		t.Errorf("seq/ts reported before any RTP was sent: %v/%v", e.Seq, e.TS)
+	}
+
+	idr := [][]byte{{0x67, 0x42, 0x00, 0x1f}, {0x68, 0xce}, {0x65, 0x88, 0x84}}
+	fanOutAU("stats-dev-rtp", videoAU{nalus: idr, ts: 9000, idr: true, hasSPS: true, hasPPS: true, hasVPS: true, params: true})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		e = statsClient(t, getStats(t), "stats-dev-rtp", "stats-rtp")
+		if e.TS != nil && *e.TS == 9000 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("/stats never reported the sent AU: ts=%v", e.TS)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if e.Seq == nil {
+		t.Error("seq missing after RTP was sent")
+	}
+}
+
+func TestStatsCountsDecoderRecoveries(t *testing.T) {
+	sess := &deviceSession{id: "stats-dev-desync", log: logger}
+	useFakeControl(t, sess)
+	c := addTestClient(t, "stats-desync", sess.id, discardTrack{})
+	if !clientConnected(c.id, nil) {
+		t.Fatal("client not registered")
+	}
+	if e := statsClient(t, getStats(t), sess.id, c.id); e.Recoveries != 0 {
+		t.Fatalf("recoveries = %d before any desync", e.Recoveries)
+	}
+
+	// 同一個前端在 desyncWindow 內連續回報 PLI：判定失步並恢復
+	for range desyncPLICount {
+		if noteKeyframeLoss(c.id) {
+			recoverClientDecoder(sess, c.id)
+		}
+	}
+	if e := statsClient(t, getStats(t), sess.id, c.id); e.Recoveries != 1 {
+		t.Errorf("recoveries = %d, want 1", e.Recoveries)
+	}
+}
+
+func TestStatsReportsDeviceStream(t *testing.T) {
+	sess := &deviceSession{id: "stats-dev-gop", log: logger, codec: "h264"}
+	useFakeControl(t, sess)
+	stateMu.Lock()
+	sess.fps, sess.gopFrames, sess.keyframeInterval = 30, 300, 10
+	sess.lastIDRAt = time.Now().Add(-2 * time.Second)
+	stateMu.Unlock()
+
+	for _, d := range getStats(t) {
+		if d.ID != sess.id {
+			continue
+		}
+		st := d.Stream
+		if st == nil {
+			t.Fatal("/stats has no stream for the connected device")
+		}
+		if st.GOPFrames != 300 || st.KeyframeInterval != 10 || st.FPS != 30 {
+			t.Errorf("stream = %+v, want gopFrames 300, keyframeIntervalSec 10, fps 30", st)
+		}
+		if st.SinceIDR == nil || *st.SinceIDR < 2 {
+			t.Errorf("sinceIdrSec = %v, want >= 2", st.SinceIDR)
+		}
+		return
+	}
+	t.Fatalf("/stats does not list the connected device %s", sess.id)
+}
+
+func TestStatsReportsReceptionReports(t *testing.T) {
+	c := addTestClient(t, "stats-rr", "stats-dev-rr", discardTrack{})
+	stateMu.Lock()
+	c.ssrc = 0xabc
+	stateMu.Unlock()
+	if e := statsClient(t, getStats(t), "stats-dev-rr", c.id); e.RTCP != nil {
+		t.Fatalf("rtcp reported before any Receiver Report: %+v", e.RTCP)
+	}
+
+	// 其他 SSRC 的報告忽略；本前端的丟包率 64/256、抖動 900 個 90kHz 單位
+	noteReceptionReports(c.id, []rtcp.ReceptionReport{
+		{SSRC: 0xdef, FractionLost: 255, TotalLost: 999},
+		{SSRC: 0xabc, FractionLost: 64, TotalLost: 10, Jitter: 900},
+	})
+	e := statsClient(t, getStats(t), "stats-dev-rr", c.id)
+	if e.RTCP == nil {
+		t.Fatal("/stats has no rtcp after a Receiver Report")
+	}
+	if e.RTCP.FractionLost != 25 || e.RTCP.TotalLost != 10 || e.RTCP.JitterMs != 10 {
+		t.Errorf("rtcp = %+v, want fractionLostPct 25, totalLost 10, jitterMs 10", *e.RTCP)
+	}
+}
@@ -0,0 +1,106 @@
+// subscribe.go — 在同一個行程內取得裝置的原始 access unit（例如做 OCR、物件偵測），不經過 WebRTC。
+// 訂閱以裝置 ID 為準，server 重啟（調整畫質、方向）後仍持續收到；每個訂閱者有自己的緩衝，
+// 跟不上時丟棄該訂閱者的 AU 並從下一個 IDR 重新開始，不影響 RTP 發送與其他訂閱者。
+// 訂閱者收到的第一個 AU（以及丟棄後重新開始的那個）前面會補上快取的參數集，可直接交給解碼器。
+
+package main
+
+import (
+	"sync"
+
+	"github.com/yourname/scrcpy-go/media"
+)
+
+// auSubBufferDefault 為 Subscribe 未指定緩衝時的 AU 數
+const auSubBufferDefault = 30
+
+type auSubscriber struct {
+	device string
+	ch     chan media.AccessUnit
+	resync bool // 曾丟棄 AU（或剛訂閱），等下一個 IDR（受 auSubsMu 保護）
+}
+
+var (
+	auSubsMu sync.Mutex
+	auSubs   = make(map[*auSubscriber]struct{})
+)
+
+// Subscribe 訂閱此裝置的 access unit（第一個收到的一定是含參數集的關鍵幀）。
+// buf <= 0 時使用 auSubBufferDefault；呼叫回傳的 cancel 取消訂閱並關閉 channel。
+// NALUs 為複本（同一個 AU 的訂閱者共用），訂閱者不可修改
+func (s *deviceSession) Subscribe(buf int) (<-chan media.AccessUnit, func()) {
+	return subscribeAUs(s.id, buf)
+}
+
+// subscribeAUs 訂閱指定裝置的 access unit，見 deviceSession.Subscribe
+func subscribeAUs(device string, buf int) (<-chan media.AccessUnit, func()) {
+	if buf <= 0 {
+		buf = auSubBufferDefault
+	}
+	sub := &auSubscriber{device: device, ch: make(chan media.AccessUnit, buf), resync: true}
+	auSubsMu.Lock()
+	auSubs[sub] = struct{}{}
+	auSubsMu.Unlock()
+
+	var once sync.Once
+	return sub.ch, func() {
+		once.Do(func() {
+			auSubsMu.Lock()
+			delete(auSubs, sub)
+			auSubsMu.Unlock()
+			close(sub.ch)
+		})
+	}
+}
+
+// auSubscribed 回傳裝置是否有訂閱者（-idle-pause 視為有觀看者）
+func auSubscribed(device string) bool {
+	auSubsMu.Lock()
+	defer auSubsMu.Unlock()
+	for sub := range auSubs {
+		if sub.device == device {
+			return true
+		}
+	}
+	return false
+}
+
+// publishAU 由視訊迴圈呼叫，將 AU 交給該裝置的訂閱者；不阻塞，訂閱者緩衝滿時丟棄。
+// 訂閱者何時用完無從得知，交出的是不引用 frame 的複本（有訂閱者要收時才複製一次）；
+// 從這個 IDR 開始的訂閱者另外收到補上參數集的版本
+func publishAU(device string, p rtpPayload) {
+	var withPS [][]byte
+	if p.idr {
+		withPS = withParamSets(p.nalus, true) // 需要 stateMu，先於 auSubsMu 取得
+	}
+	auSubsMu.Lock()
+	defer auSubsMu.Unlock()
+	var plain, first *media.AccessUnit // 有訂閱者要收時才複製
+	for sub := range auSubs {
+		if sub.device != device {
+			continue
+		}
+		var au *media.AccessUnit
+		if sub.resync {
+			if !p.idr {
+				continue
+			}
+			sub.resync = false
+			if first == nil {
+				first = &media.AccessUnit{NALUs: cloneNALUs(withPS), TS: p.ts, Keyframe: true}
+			}
+			au = first
+		} else {
+			if plain == nil {
+				plain = &media.AccessUnit{NALUs: cloneNALUs(p.nalus), TS: p.ts, Keyframe: p.idr}
+			}
+			au = plain
+		}
+		select {
+		case sub.ch <- *au:
+		default:
+			sub.resync = true
+			evSubFramesDropped.Add(1)
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+
+	"github.com/yourname/scrcpy-go/media"
+)
+
+func TestSubscribeStartsWithParamSets(t *testing.T) {
+	sps, pps := []byte{0x67, 0x42, 0x00, 0x1f}, []byte{0x68, 0xce}
+	idr, p := []byte{0x65, 0x88, 0x84}, []byte{0x41, 0x9a}
+	stateMu.Lock()
+	oldSPS, oldPPS, oldCodec := lastSPS, lastPPS, videoCodec
+	lastSPS, lastPPS, videoCodec = sps, pps, "h264"
+	stateMu.Unlock()
+	t.Cleanup(func() {
+		stateMu.Lock()
+		lastSPS, lastPPS, videoCodec = oldSPS, oldPPS, oldCodec
+		stateMu.Unlock()
+	})
+
+	const dev = "sub-dev"
+	a, cancelA := subscribeAUs(dev, 4)
+	defer cancelA()
+	check := func(name string, ch <-chan media.AccessUnit, want ...[]byte) {
+		t.Helper()
+		select {
+		case au := <-ch:
+			if !slices.EqualFunc(au.NALUs, want, bytes.Equal) {
+				t.Errorf("%s: got %x, want %x", name, au.NALUs, want)
+			}
+		default:
+			if want != nil {
+				t.Errorf("%s: got nothing, want %x", name, want)
+			}
+		}
+	}
+
+	// 訂閱後先略過一般幀；第一個 IDR 補上快取的 SPS/PPS
+	publishAU(dev, rtpPayload{nalus: [][]byte{p}, ts: 1})
+	check("before the first IDR", a)
+	publishAU(dev, rtpPayload{nalus: [][]byte{idr}, ts: 2, idr: true})
+	check("first IDR", a, sps, pps, idr)
+	publishAU(dev, rtpPayload{nalus: [][]byte{p}, ts: 3})
+	check("after the IDR", a, p)
+
+	// 之後加入的訂閱者從下一個 IDR 開始，同一個 IDR 原本的訂閱者不重複收到參數集
+	b, cancelB := subscribeAUs(dev, 4)
+	defer cancelB()
+	publishAU(dev, rtpPayload{nalus: [][]byte{idr}, ts: 4, idr: true})
+	check("next IDR, first subscriber", a, idr)
+	check("next IDR, new subscriber", b, sps, pps, idr)
+
+	// AU 自帶參數集時不重複補上
+	publishAU(dev, rtpPayload{nalus: [][]byte{sps, pps, idr}, ts: 5, idr: true})
+	check("IDR with its own parameter sets", a, sps, pps, idr)
+
+	cancelA()
+	if _, ok := <-a; ok {
+		t.Error("channel still open after cancel")
+	}
+}
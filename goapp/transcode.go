@@ -0,0 +1,268 @@
+// transcode.go — 前端以 /offer?maxWidth=N 要求縮小的畫面時，為它另開一個 ffmpeg 縮放並重新編碼（-transcode 開啟）。
+// 裝置仍只有一條 scrcpy 串流：fanOutAU 把該前端的 AU 交給它的 transcoder 而不是 rtpQueue，
+// ffmpeg 解碼、縮到最寬 N 像素、以 libx264（ultrafast、zerolatency、無 B-frame）編成 H.264，
+// 輸出依 AUD 切回 AU 後放進前端自己的 rtpQueue，由原本的發送 goroutine 寫入 track。
+// 因此同一台裝置可以同時有原畫質與縮小的前端。每個縮放的前端各占一個 ffmpeg 行程（解碼 + 編碼，1080p 約一個 CPU 核心）。
+// 裝置的 IDR 會強制 ffmpeg 輸出 IDR（-force_key_frames source），前端的 PLI 一樣經由 RESET_VIDEO 滿足；
+// ffmpeg 結束時以指數退避重新啟動（同 rtmp.go），每次都從參數集 + IDR 開始。
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	transcodeQueueSize = 30 // 等待寫入 ffmpeg 的 AU 上限；塞滿時丟棄並等下一個 IDR
+	transcodeMinWidth  = 64
+	transcodeReadChunk = 64 << 10
+	nalAUD             = 9 // H.264 access unit delimiter
+)
+
+// transcoder 為一個前端的 ffmpeg 縮放行程
+type transcoder struct {
+	client   *clientInfo
+	maxWidth int
+	frames   chan rtpPayload
+	resync   atomic.Bool // 曾丟棄 AU，需從下一個 IDR 重新開始
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newTranscoder(c *clientInfo, maxWidth int) *transcoder {
+	return &transcoder{
+		client:   c,
+		maxWidth: maxWidth,
+		frames:   make(chan rtpPayload, transcodeQueueSize),
+		stop:     make(chan struct{}),
+	}
+}
+
+// parseMaxWidth 解析 /offer 的 ?maxWidth=N；未指定時回傳 0
+func parseMaxWidth(r *http.Request) (int, error) {
+	raw := r.URL.Query().Get("maxWidth")
+	if raw == "" {
+		return 0, nil
+	}
+	if !*flagTranscode {
+		return 0, errors.New("maxWidth requires the server to run with -transcode")
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < transcodeMinWidth {
+		return 0, fmt.Errorf("invalid maxWidth %q (integer >= %d)", raw, transcodeMinWidth)
+	}
+	return n &^ 1, nil // H.264 4:2:0 需要偶數寬度
+}
+
+// push 把 AU 交給前端：有 transcoder 時送進 ffmpeg，否則直接放入 RTP 佇列。回傳值同 rtpQueue.push
+func (c *clientInfo) push(p rtpPayload) (dropped, needKF bool) {
+	if c.transcoder == nil {
+		return c.queue.push(p)
+	}
+	return c.transcoder.feed(p)
+}
+
+// feed 將一個 AU 交給 ffmpeg；不阻塞，佇列滿時丟棄並從下一個 IDR 重新開始
+func (t *transcoder) feed(p rtpPayload) (dropped, needKF bool) {
+	p.frame.retain()
+	select {
+	case t.frames <- p:
+		return false, false
+	default:
+		p.frame.release()
+		evFramesDropped.Add(1)
+		return true, !t.resync.Swap(true)
+	}
+}
+
+func (t *transcoder) close() {
+	t.stopOnce.Do(func() { close(t.stop) })
+}
+
+// run 反覆啟動 ffmpeg，異常結束時以指數退避重試，直到 close（removeClient）
+func (t *transcoder) run() {
+	backoff := rtmpBackoffMin
+	for {
+		started := time.Now()
+		err := t.stream()
+		select {
+		case <-t.stop:
+			return
+		default:
+		}
+		if time.Since(started) > rtmpBackoffMax {
+			backoff = rtmpBackoffMin
+		}
+		logger.Warn("transcode_ffmpeg_exited", "client", t.client.id, "err", err, "retryIn", backoff)
+		evTranscodeRestarts.Add(1)
+		select {
+		case <-t.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, rtmpBackoffMax)
+		t.resync.Store(true)
+		if sess := sessionForDevice(t.client.device); sess != nil {
+			requestKeyframeDebounced(sess, "transcode_restart")
+		}
+	}
+}
+
+// stream 執行一次 ffmpeg：AU 寫入 stdin，stdout 的 H.264 切成 AU 放入前端的 RTP 佇列；
+// ffmpeg 結束或寫入失敗時回傳錯誤，close 時回傳 nil
+func (t *transcoder) stream() error {
+	inFormat := "h264"
+	stateMu.RLock()
+	if videoCodec == "h265" {
+		inFormat = "hevc"
+	}
+	stateMu.RUnlock()
+	cmd := exec.Command("ffmpeg", "-hide_banner", "-loglevel", "warning",
+		"-fflags", "nobuffer", "-flags", "low_delay", "-probesize", "32", "-analyzeduration", "0",
+		"-use_wallclock_as_timestamps", "1", "-f", inFormat, "-i", "pipe:0",
+		"-vf", fmt.Sprintf("scale='min(%d,iw)':-2", t.maxWidth),
+		"-c:v", "libx264", "-preset", "ultrafast", "-tune", "zerolatency", "-profile:v", "baseline",
+		"-bf", "0", "-g", "600", "-force_key_frames", "source",
+		"-x264-params", "aud=1:repeat-headers=1",
+		"-flush_packets", "1", "-f", "h264", "pipe:1")
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	exited := make(chan error, 1)
+	go func() {
+		t.readOutput(stdout)
+		exited <- cmd.Wait() // 讀完 stdout 才能 Wait
+	}()
+
+	waitKF := true
+	for {
+		select {
+		case <-t.stop:
+			stdin.Close()
+			select {
+			case <-exited:
+			case <-time.After(rtmpStopGrace):
+				cmd.Process.Kill()
+				<-exited
+			}
+			return nil
+		case err := <-exited:
+			if err == nil {
+				err = errors.New("ffmpeg exited")
+			}
+			return err
+		case p := <-t.frames:
+			if t.resync.Swap(false) {
+				waitKF = true
+			}
+			if waitKF {
+				if !p.idr {
+					p.frame.release()
+					continue
+				}
+				waitKF = false
+			}
+			err := writeAnnexB(stdin, withParamSets(p.nalus, p.idr))
+			p.frame.release()
+			if err != nil {
+				cmd.Process.Kill()
+				<-exited
+				return fmt.Errorf("write to ffmpeg: %w", err)
+			}
+		}
+	}
+}
+
+// readOutput 將 ffmpeg 輸出的 AU 以 90kHz 牆鐘時間戳放入前端的 RTP 佇列，直到 stdout 結束
+func (t *transcoder) readOutput(r io.Reader) {
+	start := time.Now()
+	splitAUs(r, func(nalus [][]byte) {
+		idr := false
+		for _, n := range nalus {
+			if classifyNALU(n, false) == nalIDR {
+				idr = true
+			}
+		}
+		ts := uint32(time.Since(start) * 90000 / time.Second)
+		if _, needKF := t.client.queue.push(rtpPayload{nalus: nalus, ts: ts, idr: idr}); needKF {
+			if sess := sessionForDevice(t.client.device); sess != nil {
+				requestKeyframeDebounced(sess, "transcode_overflow")
+			}
+		}
+	})
+}
+
+// splitAUs 從 r 讀取 H.264 Annex-B 位元組流，每湊滿一個 AU（以 AUD 為界，不含 AUD）就呼叫 emit，直到 r 結束。
+// emit 收到的 NALU 為複本，可自行保留
+func splitAUs(r io.Reader, emit func(nalus [][]byte)) error {
+	var (
+		buf     []byte // 尚未切出的資料，從目前 NALU 的起始碼開始
+		au      [][]byte
+		scanned int // buf 中已找過下一個起始碼的位置
+	)
+	addNALU := func(n []byte) {
+		if len(n) == 0 {
+			return
+		}
+		if naluType(n) == nalAUD {
+			if len(au) > 0 {
+				emit(au)
+				au = nil
+			}
+			return
+		}
+		au = append(au, bytes.Clone(n))
+	}
+	chunk := make([]byte, transcodeReadChunk)
+	for {
+		k, err := r.Read(chunk)
+		buf = append(buf, chunk[:k]...)
+		// 切出所有已經讀到下一個起始碼的 NALU
+		start, end := findStartCode(buf, 0)
+		for start >= 0 {
+			next, nextEnd := findStartCode(buf, max(end, scanned))
+			if next < 0 {
+				break
+			}
+			addNALU(buf[end:next])
+			start, end = next, nextEnd
+		}
+		if start > 0 {
+			buf = buf[:copy(buf, buf[start:])]
+			end -= start
+		}
+		// 起始碼可能跨越兩次讀取：下次從最後 3 bytes 起重新找
+		scanned = max(len(buf)-3, end)
+		if err != nil {
+			if start >= 0 {
+				addNALU(buf[end:])
+			}
+			if len(au) > 0 {
+				emit(au)
+			}
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"testing/iotest"
+)
+
+func TestSplitAUs(t *testing.T) {
+	aud := []byte{0x09, 0xf0}
+	sps, pps := []byte{0x67, 0x42, 0xc0, 0x1f}, []byte{0x68, 0xce, 0x3c, 0x80}
+	idr := append([]byte{0x65, 0x88}, bytes.Repeat([]byte{0xab}, 3000)...)
+	p1, p2 := []byte{0x41, 0x9a, 0x00, 0x00, 0x03, 0x01}, []byte{0x41, 0x9b, 0x02}
+
+	var stream bytes.Buffer
+	for i, n := range [][]byte{aud, sps, pps, idr, aud, p1, aud, p2} {
+		if i%2 == 0 {
+			stream.Write([]byte{0, 0, 0, 1})
+		} else {
+			stream.Write([]byte{0, 0, 1})
+		}
+		stream.Write(n)
+	}
+	want := [][][]byte{{sps, pps, idr}, {p1}, {p2}}
+
+	for name, r := range map[string]func() io.Reader{
+		"whole":    func() io.Reader { return bytes.NewReader(stream.Bytes()) },
+		"bytewise": func() io.Reader { return iotest.OneByteReader(bytes.NewReader(stream.Bytes())) },
+	} {
+		t.Run(name, func(t *testing.T) {
+			var got [][][]byte
+			if err := splitAUs(r(), func(nalus [][]byte) { got = append(got, nalus) }); err != nil {
+				t.Fatal(err)
+			}
+			if !slices.EqualFunc(got, want, func(a, b [][]byte) bool { return slices.EqualFunc(a, b, bytes.Equal) }) {
+				t.Errorf("got %d AUs %x, want %x", len(got), got, want)
+			}
+		})
+	}
+}
+
+func TestParseMaxWidth(t *testing.T) {
+	if _, err := parseMaxWidth(httptest.NewRequest("POST", "/offer?maxWidth=640", nil)); err == nil {
+		t.Error("maxWidth accepted without -transcode")
+	}
+	setFlag(t, "transcode", "true")
+	for query, want := range map[string]int{"": 0, "?maxWidth=640": 640, "?maxWidth=641": 640} {
+		if got, err := parseMaxWidth(httptest.NewRequest("POST", "/offer"+query, nil)); err != nil || got != want {
+			t.Errorf("%q: got %d, %v; want %d", query, got, err, want)
+		}
+	}
+	for _, bad := range []string{"abc", "0", "-640"} {
+		if _, err := parseMaxWidth(httptest.NewRequest("POST", "/offer?maxWidth="+bad, nil)); err == nil {
+			t.Errorf("maxWidth=%s accepted", bad)
+		}
+	}
+}
+
+// 縮放的前端：視訊迴圈的 AU 交給 ffmpeg 而不是 RTP 佇列，ffmpeg 跟不上時丟棄並只請求一次關鍵幀
+func TestFanOutFeedsTranscoder(t *testing.T) {
+	c := newClient("transcoded", "transcode-dev", nil, discardTrack{}, nil)
+	c.transcoder = newTranscoder(c, 640)
+	c.sending, c.needKF = true, false
+	stateMu.Lock()
+	clients[c.id] = c
+	stateMu.Unlock()
+	t.Cleanup(func() { removeClient(c.id, nil) })
+
+	p := videoAU{nalus: [][]byte{{0x41, 0x9a}}, ts: 3000, hasVPS: true}
+	for range transcodeQueueSize {
+		if res := fanOutAU("transcode-dev", p); res.pushed != 1 || res.dropped != 0 {
+			t.Fatalf("fanOutAU = %+v, want one AU pushed", res)
+		}
+	}
+	if n := len(c.transcoder.frames); n != transcodeQueueSize {
+		t.Errorf("transcoder got %d AUs, want %d", n, transcodeQueueSize)
+	}
+	if n := len(c.queue.items); n != 0 {
+		t.Errorf("RTP queue got %d untranscoded AUs", n)
+	}
+	if res := fanOutAU("transcode-dev", p); res.dropped != 1 || !res.overflow {
+		t.Errorf("first overflow = %+v, want dropped and a keyframe request", res)
+	}
+	if res := fanOutAU("transcode-dev", p); res.dropped != 1 || res.overflow {
+		t.Errorf("second overflow = %+v, want dropped without another keyframe request", res)
+	}
+}
@@ -0,0 +1,51 @@
+// version.go — GET /version：回報本服務的建置版本、Go 版本、啟動的 scrcpy-server 版本與執行時間，
+// 方便在多台主機上找出仍在跑舊版執行檔或 server jar 不一致的實例。
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"time"
+
+	"github.com/yourname/scrcpy-go/adb"
+)
+
+// processStart 為服務啟動時間
+var processStart = time.Now()
+
+// buildVersion 回傳 module 版本與 VCS 資訊（go build 時自動嵌入；go run 或非 git 目錄下可能為空）
+func buildVersion() (version, revision, modified string) {
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "", "", ""
+	}
+	version = info.Main.Version
+	for _, s := range info.Settings {
+		switch s.Key {
+		case "vcs.revision":
+			revision = s.Value
+		case "vcs.modified":
+			modified = s.Value
+		}
+	}
+	return version, revision, modified
+}
+
+// === HTTP: GET /version handler ===
+// 回應 {"version","revision","modified","go","scrcpyServer","uptimeSec"}
+func handleVersion(w http.ResponseWriter, r *http.Request) {
+	version, revision, modified := buildVersion()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"version":      version,
+		"revision":     revision,
+		"modified":     modified == "true",
+		"go":           runtime.Version(),
+		"scrcpyServer": adb.ServerVersion,
+		"uptimeSec":    int64(time.Since(processStart).Seconds()),
+	})
+}
@@ -0,0 +1,68 @@
+// watchdog.go — 視訊卡住時重新啟動 scrcpy server。
+// 讀取卡住（沒有 EOF、只是不再有 frame）時視訊迴圈會一直阻塞；scrcpy 在畫面靜止時仍會重複送出前一幀，
+// 因此長時間沒有 frame 代表串流已失效。POST /devices/{id}/restart 手動重啟，-stall-restart 則自動重啟；
+// 兩者都沿用既有的 PeerConnection/track，前端不需重新連線。
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const stallCheckEvery = time.Second
+
+// sinceLastFrame 回傳距上一個 frame（尚未收到時為 session 建立）的時間
+func (s *deviceSession) sinceLastFrame() time.Duration {
+	if at := s.lastFrameAt.Load(); at != 0 {
+		return time.Since(time.Unix(0, at))
+	}
+	return time.Since(s.createdAt)
+}
+
+// startStallWatchdog 每 stallCheckEvery 檢查一次，超過 -stall-restart 沒有 frame 時重啟 server；
+// 新 session 由 startSession 啟動自己的 watchdog
+func startStallWatchdog(sess *deviceSession) {
+	t := time.NewTicker(stallCheckEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-sess.done:
+			return
+		case <-t.C:
+		}
+		stalled := sess.sinceLastFrame()
+		if stalled <= *flagStallRestart {
+			continue
+		}
+		sess.log.Warn("video_stalled", "since", stalled, "action", "restart")
+		evWatchdogRestarts.Add(1)
+		if _, err := restartSession(sess, sess.dev.Options()); err != nil {
+			sess.log.Error("watchdog_restart_failed", "err", err)
+		}
+		return
+	}
+}
+
+// === HTTP: POST /devices/{id}/restart handler ===
+// 以目前的選項重新啟動 scrcpy server（視訊卡住時使用），保留已連線的前端
+func handleDeviceRestart(w http.ResponseWriter, r *http.Request) {
+	s := deviceForRequest(w, r)
+	if s == nil || !requireADB(w, s) {
+		return
+	}
+	stalled := s.sinceLastFrame()
+	s.log.Info("manual_restart", "sinceLastFrame", stalled)
+	if _, err := restartSession(s, s.dev.Options()); err != nil {
+		writeRestartError(w, s.id, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{
+		"status":            "ok",
+		"id":                s.id,
+		"sinceLastFrameSec": stalled.Seconds(),
+	})
+}
@@ -0,0 +1,74 @@
+// webhook.go — -webhook-url：裝置 session 開始與結束時 POST JSON 事件，供外部的裝置清單/調度系統同步狀態。
+// 事件在背景 goroutine 送出，逾時或失敗時短暫重試，不會拖慢視訊串流；全部失敗只記錄日誌。
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	webhookTimeout  = 3 * time.Second
+	webhookAttempts = 3
+	webhookBackoff  = 500 * time.Millisecond // 每次重試前的等待，逐次加倍
+)
+
+var webhookClient = &http.Client{Timeout: webhookTimeout}
+
+// webhookEvent 為送出的 JSON 內容
+type webhookEvent struct {
+	Event      string    `json:"event"`   // device_connected | device_disconnected
+	Device     string    `json:"device"`  // 裝置 ID（adb 序號，無線 adb 為 IP:port）
+	Session    string    `json:"session"` // 同一次連線的開始/結束事件相同（重啟 server 時沿用）
+	Timestamp  time.Time `json:"timestamp"`
+	Resolution struct {
+		W uint16 `json:"w"`
+		H uint16 `json:"h"`
+	} `json:"resolution"`
+}
+
+// notifyWebhook 於背景送出事件；未設定 -webhook-url 時不做事
+func notifyWebhook(event string, sess *deviceSession, w, h uint16) {
+	if *flagWebhookURL == "" {
+		return
+	}
+	ev := webhookEvent{Event: event, Device: sess.id, Session: sess.sid, Timestamp: time.Now().UTC()}
+	ev.Resolution.W, ev.Resolution.H = w, h
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	goSafe("webhook", func() {
+		backoff := webhookBackoff
+		for attempt := 1; ; attempt++ {
+			err := postWebhook(*flagWebhookURL, body)
+			if err == nil {
+				sess.log.Debug("webhook_sent", "webhookEvent", event)
+				return
+			}
+			if attempt == webhookAttempts {
+				sess.log.Warn("webhook_failed", "webhookEvent", event, "attempts", attempt, "err", err)
+				return
+			}
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	})
+}
+
+// postWebhook 送出一次；非 2xx 視為失敗
+func postWebhook(url string, body []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %s", resp.Status)
+	}
+	return nil
+}